@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/cache"
+)
+
+// ErrUnknownCacheCommand is returned for unsupported `cache` subcommands.
+var ErrUnknownCacheCommand = errors.New("unknown cache command, expected 'clean'")
+
+// Open the evaluation cache, ignoring --no-cache.
+func openCache() (*cache.Cache, error) {
+	if opts.CacheDir != "" {
+		return cache.New(opts.CacheDir, version), nil
+	}
+
+	dir, err := cache.DefaultDir()
+	if err != nil {
+		return nil, err
+	}
+	return cache.New(dir, version), nil
+}
+
+// Handle `helmfile-nix cache <command>`.
+func cacheCommand(args []string) error {
+	if len(args) != 1 || args[0] != "clean" {
+		return fmt.Errorf("%w: %v", ErrUnknownCacheCommand, args)
+	}
+
+	c, err := openCache()
+	if err != nil {
+		return err
+	}
+	if err := c.Clean(); err != nil {
+		return err
+	}
+	fmt.Printf("Removed cached evaluations from %s\n", c.Dir())
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/jessevdk/go-flags"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/environment"
+	"github.com/reMarkable/helmfile-nix/pkgs/nixchart"
+)
+
+// ErrChartArgs is returned when `chart` is not given a command and a chart directory.
+var ErrChartArgs = errors.New("expected 'chart render <dir>' or 'chart package <dir>'")
+
+// ChartOptions are the options of `helmfile-nix chart`, parsed after the global ones.
+type ChartOptions struct {
+	Values      []string `long:"values" description:"YAML file with values for the chart, can be repeated"`
+	Set         []string `long:"set" description:"Set a value for the chart like helm's --set, can be repeated"`
+	SetString   []string `long:"set-string" description:"Like --set, but the values are always strings"`
+	Namespace   string   `long:"namespace" description:"Namespace of the release"`
+	Release     string   `long:"release" description:"Name of the release, defaults to the name of the chart directory"`
+	Version     string   `long:"chart-version" description:"Version of the packaged chart, overriding the one in meta"`
+	AppVersion  string   `long:"app-version" description:"App version of the packaged chart, overriding the one in meta"`
+	Destination string   `long:"destination" description:"Directory to write the packaged chart to" default:"."`
+	Index       bool     `long:"index" description:"Add the packaged chart to the index.yaml in the destination"`
+	URL         string   `long:"url" description:"With --index, the URL of the chart repository"`
+}
+
+// Handle `helmfile-nix chart <command> <dir>`: render prints the manifests of the nixChart in dir,
+// package writes it as a chart archive.
+func chartCommand(ctx context.Context, charts *nixchart.Renderer, args []string, w io.Writer) error {
+	var co ChartOptions
+	rest, err := flags.NewParser(&co, flags.PassDoubleDash).ParseArgs(args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 2 {
+		return fmt.Errorf("%w, got %v", ErrChartArgs, rest)
+	}
+	command, dir := rest[0], rest[1]
+
+	values, err := environment.StateValues{Files: co.Values, Set: co.Set, SetString: co.SetString}.Values()
+	if err != nil {
+		return err
+	}
+	name := co.Release
+	if name == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		name = filepath.Base(abs)
+	}
+	release := map[string]any{"name": name, "nixChart": dir, "values": values}
+	if co.Namespace != "" {
+		release["namespace"] = co.Namespace
+	}
+
+	switch command {
+	case "render":
+		return charts.RenderManifests(ctx, release, w)
+	case "package":
+		archive, err := charts.Package(ctx, release, co.Version, co.AppVersion, co.Destination)
+		if err != nil {
+			return err
+		}
+		if co.Index {
+			if err := nixchart.UpdateIndex(co.Destination, archive, co.URL); err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(w, "Packaged %s\n", archive)
+		return err
+	}
+	return fmt.Errorf("%w, got %v", ErrChartArgs, rest)
+}
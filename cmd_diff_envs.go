@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/environment"
+	"github.com/reMarkable/helmfile-nix/pkgs/helmfile"
+)
+
+// ErrDiffEnvsArgs is returned when diff-envs is not given exactly two environments.
+var ErrDiffEnvsArgs = errors.New("diff-envs expects two environments, e.g. 'diff-envs stage prod'")
+
+// Render the helmfile for two environments and write their structural differences to w.
+// Rendered nixCharts, values .nix files and nested helmfiles are compared by content,
+// as they are written to new paths for every render.
+func diffEnvs(ctx context.Context, renderer *helmfile.Renderer, valuesWriter *environment.ValuesWriter, hfFileName, base string, envs []string, w io.Writer) error {
+	if len(envs) != 2 {
+		return fmt.Errorf("%w, got %v", ErrDiffEnvsArgs, envs)
+	}
+
+	rendered := make([][]byte, len(envs))
+	for i, env := range envs {
+		content, generated, err := renderEnv(ctx, renderer, valuesWriter, hfFileName, base, env, stateValues())
+		if err == nil {
+			content, err = helmfile.ResolveGenerated(content, base, generated)
+		}
+		if err == nil {
+			content, err = redactSecrets(ctx, valuesWriter, base, env, content)
+		}
+		if err != nil {
+			return fmt.Errorf("environment %s: %w", env, err)
+		}
+		rendered[i] = content
+	}
+
+	diffs, err := helmfile.Compare(rendered[0], rendered[1])
+	if err != nil {
+		return err
+	}
+
+	if len(diffs) == 0 {
+		_, err := fmt.Fprintf(w, "No differences between %s and %s\n", envs[0], envs[1])
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", envs[0], envs[1]); err != nil {
+		return err
+	}
+	return helmfile.FormatDifferences(w, diffs)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/environment"
+)
+
+// Write the environments of the helmfile in base to w, with the files merged for each and what it inherits from.
+func listEnvs(ctx context.Context, valuesWriter *environment.ValuesWriter, base string, w io.Writer) error {
+	descriptions, err := valuesWriter.Describe(ctx, base)
+	if err != nil {
+		return err
+	}
+	if len(descriptions) == 0 {
+		return fmt.Errorf("%w in %s", ErrNoEnvironments, base)
+	}
+
+	for _, d := range descriptions {
+		name := d.Name
+		if len(d.Inherits) > 0 {
+			name += " (inherits " + strings.Join(d.Inherits, ", ") + ")"
+		}
+		if _, err := fmt.Fprintf(w, "%s\n  files: %s\n", name, strings.Join(d.Files, ", ")); err != nil {
+			return err
+		}
+		if len(d.Secrets) > 0 {
+			if _, err := fmt.Fprintf(w, "  secrets: %s\n", strings.Join(d.Secrets, ", ")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Check that envs have env files, for --strict-env.
+func checkEnvs(valuesWriter *environment.ValuesWriter, base string, envs []string) error {
+	for _, env := range envs {
+		if err := valuesWriter.CheckEnvironment(base, env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
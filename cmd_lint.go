@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/environment"
+	"github.com/reMarkable/helmfile-nix/pkgs/helmfile"
+)
+
+// ErrLintFindings is returned when lint finds problems in a rendered helmfile.
+var ErrLintFindings = errors.New("lint found problems")
+
+// Render the helmfile for each environment and check it against the helmfile state schema.
+// Findings are written to w, prefixed with the environment when there are several.
+func lint(ctx context.Context, renderer *helmfile.Renderer, valuesWriter *environment.ValuesWriter, hfFileName, base string, envs []string, w io.Writer) error {
+	total := 0
+	for _, env := range envs {
+		content, _, err := renderEnv(ctx, renderer, valuesWriter, hfFileName, base, env, stateValues())
+		if err != nil {
+			return fmt.Errorf("environment %s: %w", env, err)
+		}
+
+		findings, err := helmfile.Lint(content)
+		if err != nil {
+			return fmt.Errorf("environment %s: %w", env, err)
+		}
+		total += len(findings)
+
+		prefix := ""
+		if len(envs) > 1 {
+			prefix = env + ": "
+		}
+		if err := helmfile.FormatFindings(w, prefix, findings); err != nil {
+			return err
+		}
+	}
+
+	if total > 0 {
+		return fmt.Errorf("%w: %d finding(s)", ErrLintFindings, total)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/environment"
+	"github.com/reMarkable/helmfile-nix/pkgs/helmfile"
+)
+
+// Static errors for rendering.
+var (
+	ErrNoEnvironments = errors.New("no environments found")
+	ErrSecretsOnDisk  = errors.New("the environment has secrets, use --show-secrets to write them to disk")
+)
+
+// Render the helmfile for every environment in its env directories.
+// Writes one file per environment to outputDir, or labelled documents to w if it is empty.
+// In outputDir the charts and values files of each environment go to a directory named after it.
+func renderAllEnvs(ctx context.Context, renderer *helmfile.Renderer, valuesWriter *environment.ValuesWriter, hfFileName, base, outputDir string, w io.Writer) error {
+	envs, err := valuesWriter.Environments(base)
+	if err != nil {
+		return err
+	}
+	if len(envs) == 0 {
+		return fmt.Errorf("%w for %s", ErrNoEnvironments, filepath.Join(base, hfFileName))
+	}
+
+	exporter := helmfile.NewExporter(outputDir)
+	for i, env := range envs {
+		content, generated, err := renderEnv(ctx, renderer, valuesWriter, hfFileName, base, env, stateValues())
+		if err != nil {
+			return fmt.Errorf("environment %s: %w", env, err)
+		}
+
+		if outputDir != "" {
+			target := env + "." + helmfile.YAMLExtension(hfFileName)
+			err := checkNoSecrets(ctx, valuesWriter, base, env)
+			if err == nil {
+				err = exporter.Export(target, env, base, content, generated)
+			}
+			if err != nil {
+				return fmt.Errorf("environment %s: %w", env, err)
+			}
+			l.Printf("Rendered environment %s to %s\n", env, filepath.Join(outputDir, target))
+			continue
+		}
+
+		content, err = redactSecrets(ctx, valuesWriter, base, env, content)
+		if err != nil {
+			return fmt.Errorf("environment %s: %w", env, err)
+		}
+
+		if i > 0 {
+			if _, err := io.WriteString(w, "---\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "# Environment: %s\n%s", env, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace the secrets of env in rendered content, unless --show-secrets is given.
+func redactSecrets(ctx context.Context, valuesWriter *environment.ValuesWriter, base, env string, content []byte) ([]byte, error) {
+	if opts.ShowSecrets {
+		return content, nil
+	}
+	secrets, err := valuesWriter.Secrets(ctx, base, env)
+	if err != nil {
+		return nil, err
+	}
+	return helmfile.Redact(content, environment.SecretStrings(secrets))
+}
+
+// The files written with --output-dir are meant to be deployed, so they can not be redacted.
+// Refuse to write the secrets of env to disk, unless --show-secrets is given.
+func checkNoSecrets(ctx context.Context, valuesWriter *environment.ValuesWriter, base, env string) error {
+	if opts.ShowSecrets {
+		return nil
+	}
+	secrets, err := valuesWriter.Secrets(ctx, base, env)
+	if err != nil {
+		return err
+	}
+	if secrets != nil {
+		return ErrSecretsOnDisk
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/environment"
+	"github.com/reMarkable/helmfile-nix/pkgs/helmfile"
+)
+
+// Write the merged values of env to w as YAML.
+// With explain set to text each value is annotated with where it came from, and json writes that as a list.
+// Secrets are redacted unless --show-secrets is given.
+func writeValues(ctx context.Context, valuesWriter *environment.ValuesWriter, base, env, explain string, w io.Writer) error {
+	values, provenance, err := valuesWriter.Explain(ctx, base, env, stateValues())
+	if err != nil {
+		return err
+	}
+
+	if !opts.ShowSecrets {
+		if secrets, ok := values[environment.SecretsKey]; ok {
+			values[environment.SecretsKey] = redactAll(secrets)
+		}
+		for i, p := range provenance {
+			if p.Path == environment.SecretsKey || strings.HasPrefix(p.Path, environment.SecretsKey+".") {
+				provenance[i].Value = redactAll(p.Value)
+			}
+		}
+	}
+
+	switch explain {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(struct {
+			Environment string                   `json:"environment"`
+			Values      []environment.Provenance `json:"values"`
+		}{env, provenance})
+	case "text":
+		return environment.WriteExplained(w, values, provenance)
+	}
+	return environment.WriteExplained(w, values, nil)
+}
+
+// Replace every value in v with helmfile.Redacted, keeping its structure.
+func redactAll(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, c := range v {
+			out[k] = redactAll(c)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, c := range v {
+			out[i] = redactAll(c)
+		}
+		return out
+	}
+	return helmfile.Redacted
+}
@@ -25,7 +25,9 @@ in
 buildGoApplication {
   pname = "helmfile-nix";
   inherit version;
-  ldflags = "-X main.version=${version} -w -s";
+  # Ship the nixpkgs lib we were built with for --offline. It may not be the revision
+  # pinned in eval.nix, cached evaluations are keyed by the lib content to tell them apart.
+  ldflags = "-X main.version=${version} -X main.bundledLib=${pkgs.path}/lib -w -s";
   pwd = ./.;
   src = ./.;
   nativeBuildInputs = with pkgs; [
@@ -1,9 +1,14 @@
+# lib can be passed in to avoid fetching the pinned flake, e.g. in offline mode.
+{
+  # pin nixpkgs.lib
+  lib ?
+    (builtins.getFlake "github:nix-community/nixpkgs.lib/4b620020fd73bdd5104e32c702e65b60b6869426").lib,
+}:
+
 with builtins;
 
 rec {
-  # pin nixpkgs.lib
-  lib =
-    (builtins.getFlake "github:nix-community/nixpkgs.lib/4b620020fd73bdd5104e32c702e65b60b6869426").lib;
+  inherit lib;
 
   # Multiline secret values
   mlVals = val: ''
@@ -15,17 +20,16 @@ rec {
   # Escape go template variables
   escape_var = var: ''{{"${var}"}}'';
 
-  # render helmfile to object
-  render =
-    file: state: env: val:
+  # arguments passed to helmfile.nix and values files
+  args =
+    env: val:
     let
-      hf = import "/${state}/${file}";
       var = {
         values = fromJSON (readFile val);
         environment.name = env;
       };
     in
-    hf {
+    {
       inherit
         escape_var
         lib
@@ -35,4 +39,20 @@ rec {
         ;
       val = var.values;
     };
+
+  # render helmfile to object
+  render =
+    file: state: env: val:
+    let
+      hf = import "/${state}/${file}";
+    in
+    hf (args env val);
+
+  # render a release values file to object, it may be a plain attrset or a function like helmfile.nix
+  renderValues =
+    file: state: env: val:
+    let
+      values = import "/${state}/${file}";
+    in
+    if isFunction values then values (args env val) else values;
 }
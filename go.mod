@@ -3,11 +3,16 @@ module github.com/reMarkable/helmfile-nix
 go 1.25
 
 require (
+	filippo.io/age v1.2.1
+	github.com/BurntSushi/toml v1.5.0
 	github.com/jessevdk/go-flags v1.6.1
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require github.com/sergi/go-diff v1.3.1 // indirect
+require (
+	github.com/sergi/go-diff v1.3.1 // indirect
+	golang.org/x/crypto v0.24.0 // indirect
+)
 
 require (
 	github.com/andreyvit/diff v0.0.0-20170406064948-c7f18ee00883
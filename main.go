@@ -8,14 +8,19 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"syscall"
 
 	flags "github.com/jessevdk/go-flags"
 
+	"github.com/reMarkable/helmfile-nix/pkgs/cache"
 	"github.com/reMarkable/helmfile-nix/pkgs/environment"
 	"github.com/reMarkable/helmfile-nix/pkgs/filesystem"
 	"github.com/reMarkable/helmfile-nix/pkgs/helmfile"
 	"github.com/reMarkable/helmfile-nix/pkgs/nixchart"
+	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
+	"github.com/reMarkable/helmfile-nix/pkgs/tempfiles"
 )
 
 //go:embed eval.nix
@@ -23,16 +28,32 @@ var eval string
 
 var version = "dev"
 
-// List of temporary directories that need to be cleaned up after use.
-var cleanup []string
+// Path to a nixpkgs lib shipped alongside the binary, set at build time.
+var bundledLib = ""
 
 // Options - We only care about these settings, the remaining are passed through unharmed to helmfile
 type Options struct {
-	File           string   `short:"f" long:"file" description:"helmfile.nix to use" default:"."`
-	Env            string   `short:"e" long:"environment" description:"Environment to deploy to" default:"dev"`
-	ShowTrace      []bool   `long:"show-trace" description:"Enable stacktraces"`
-	StateValuesSet []string `long:"state-values-set" description:"Set state values"`
-	Version        bool     `short:"v" long:"version" description:"Print version and exit"`
+	File                 string   `short:"f" long:"file" description:"helmfile.nix to use" default:"."`
+	Env                  string   `short:"e" long:"environment" description:"Environment to deploy to" default:"dev"`
+	ShowTrace            []bool   `long:"show-trace" description:"Enable stacktraces"`
+	StateValuesSet       []string `long:"state-values-set" description:"Set state values"`
+	StateValuesSetString []string `long:"state-values-set-string" description:"Set state values, always as strings"`
+	StateValuesFile      []string `long:"state-values-file" description:"Merge a YAML file into the state values, can be repeated"`
+	EnvDir               string   `long:"env-dir" description:"Directory with the env files, relative to the helmfile. Defaults to env"`
+	EnvDefaults          string   `long:"env-defaults" description:"Name of the defaults env file, without extension. Defaults to defaults"`
+	EnvSharedDir         []string `long:"env-shared-dir" description:"More env directories searched in order, relative to the helmfile, can be repeated"`
+	Offline              bool     `long:"offline" env:"HELMFILE_NIX_OFFLINE" description:"Evaluate without network access, using a local nixpkgs lib"`
+	NixLib               string   `long:"nix-lib" env:"HELMFILE_NIX_LIB" description:"Path to a local nixpkgs lib to use instead of fetching the pinned one"`
+	NoCache              bool     `long:"no-cache" env:"HELMFILE_NIX_NO_CACHE" description:"Do not use the evaluation cache"`
+	CacheDir             string   `long:"cache-dir" env:"HELMFILE_NIX_CACHE_DIR" description:"Directory for the evaluation cache"`
+	AllEnvs              bool     `long:"all-envs" description:"Render every environment found in env/"`
+	StrictEnv            bool     `long:"strict-env" env:"HELMFILE_NIX_STRICT_ENV" description:"Fail for an environment without an env file instead of using only the defaults"`
+	OutputDir            string   `long:"output-dir" description:"Write rendered environments to this directory instead of stdout"`
+	AgeKeyFile           string   `long:"age-key-file" env:"SOPS_AGE_KEY_FILE" description:"age key file to decrypt env/secrets with, defaults to the one sops uses"`
+	ShowSecrets          bool     `long:"show-secrets" description:"Do not redact secrets in rendered output"`
+	Explain              string   `long:"explain" description:"With values, show where each value came from" optional:"yes" optional-value:"text" choice:"text" choice:"json"`
+	ErrorFormat          string   `long:"error-format" env:"HELMFILE_NIX_ERROR_FORMAT" description:"Format of evaluation errors" choice:"text" choice:"json" default:"text"`
+	Version              bool     `short:"v" long:"version" description:"Print version and exit"`
 }
 
 var (
@@ -41,22 +62,25 @@ var (
 	l      = log.Default()
 )
 
-// Main app flow.
 func main() {
-	retcode := 0
-	defer func() {
-		os.Exit(retcode)
-	}()
+	os.Exit(run())
+}
 
+// Main app flow, returns the exit code. Nothing in it exits, so the deferred cleanup always runs.
+func run() int {
 	// Create context that cancels on SIGINT or SIGTERM
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	// Temporary files of this run, removed when it ends or is interrupted.
+	temp := tempfiles.NewManager()
+	defer temp.Cleanup()
+	context.AfterFunc(ctx, temp.Cleanup)
+
 	args, err := parseArgs()
 	if err != nil {
 		l.Println("Could not parse args: ", err)
-		retcode = 1
-		return
+		return 1
 	}
 	if opts.Version {
 		fmt.Printf("helmfile-nix version %s\n", version)
@@ -66,9 +90,18 @@ func main() {
 		callErr := cmd.Run()
 		if callErr != nil {
 			l.Println("Running helmfile failed: ", callErr)
-			retcode = 1
+			return 1
 		}
-		return
+		return 0
+	}
+
+	command, commandArgs := findCommand(args)
+	if command == "cache" {
+		if err := cacheCommand(commandArgs); err != nil {
+			l.Println("Cache command failed: ", err)
+			return 1
+		}
+		return 0
 	}
 
 	seen := false
@@ -87,63 +120,252 @@ func main() {
 		if err != nil {
 			l.Println("Running helmfile failed: ", err)
 		}
-		retcode = 1
-		return
+		return 1
 	}
 
 	l.Printf("Args: %v\n", args)
 	l.Printf("file: %v env: %v\n", opts.Env, opts.File)
 
-	hfFileName, base, err := filesystem.FindFileNameAndBase(opts.File, []string{"helmfile.nix", "helmfile.gotmpl.nix"})
+	lib, err := resolveLib()
 	if err != nil {
-		l.Fatalln("Could not find helmfile: ", err)
+		l.Println("Could not find nixpkgs lib: ", err)
+		return 1
 	}
 
-	// Write environment values JSON
-	valuesWriter := environment.NewValuesWriter(l)
-	valJSON, err := valuesWriter.WriteJSON(base, opts.Env, opts.StateValuesSet)
-	if err != nil {
-		l.Fatalln("Could not write values.json: ", err)
+	var evalCache *cache.Cache
+	if !opts.NoCache {
+		evalCache, err = openCache()
+		if err != nil {
+			l.Println("Could not open cache: ", err)
+			return 1
+		}
 	}
 
-	defer func() {
-		if err := os.Remove(valJSON.Name()); err != nil {
-			l.Fatalf("Could not remove values.json: %s", err)
+	evaluator := nixeval.NewNixEval(opts.Offline)
+	if command == "chart" {
+		if err := chartCommand(ctx, nixchart.NewRenderer(evaluator, lib, evalCache, temp), commandArgs, os.Stdout); err != nil {
+			reportError(os.Stderr, opts.ErrorFormat, "Chart command failed", err)
+			return 1
 		}
-	}()
+		return 0
+	}
+
+	hfFileName, base, err := filesystem.FindFileNameAndBase(opts.File, []string{"helmfile.nix", "helmfile.gotmpl.nix"})
+	if err != nil {
+		l.Println("Could not find helmfile: ", err)
+		return 1
+	}
 
 	// Render helmfile
-	renderer := helmfile.NewRenderer(eval, len(opts.ShowTrace) > 0, opts.StateValuesSet, l)
-	hfContent, chartCleanup, err := renderer.Render(ctx, hfFileName, base, opts.Env, valJSON.Name())
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{
+		Evaluator:  evaluator,
+		Cache:      evalCache,
+		Temp:       temp,
+		AgeKeyFile: opts.AgeKeyFile,
+		Layout:     envLayout(),
+		Logger:     l,
+	})
+	renderer := helmfile.NewRenderer(eval, evaluator, helmfile.RendererOptions{
+		Lib:          lib,
+		Cache:        evalCache,
+		Temp:         temp,
+		ValuesWriter: valuesWriter,
+		ShowTrace:    len(opts.ShowTrace) > 0,
+		StateValues:  stateValues(),
+		Logger:       l,
+	})
+
+	if command == "envs" {
+		if err := listEnvs(ctx, valuesWriter, base, os.Stdout); err != nil {
+			reportError(os.Stderr, opts.ErrorFormat, "Failed to list environments", err)
+			return 1
+		}
+		return 0
+	}
+
+	// With --all-envs every environment is rendered, so there is nothing to check.
+	if opts.StrictEnv && !opts.AllEnvs {
+		envs := []string{opts.Env}
+		if command == "diff-envs" {
+			envs = commandArgs
+		}
+		if err := checkEnvs(valuesWriter, base, envs); err != nil {
+			reportError(os.Stderr, opts.ErrorFormat, "Unknown environment", err)
+			return 1
+		}
+	}
+
+	if command == "diff-envs" {
+		if err := diffEnvs(ctx, renderer, valuesWriter, hfFileName, base, commandArgs, os.Stdout); err != nil {
+			reportError(os.Stderr, opts.ErrorFormat, "Failed to diff environments", err)
+			return 1
+		}
+		return 0
+	}
+
+	if command == "values" {
+		if err := writeValues(ctx, valuesWriter, base, opts.Env, opts.Explain, os.Stdout); err != nil {
+			reportError(os.Stderr, opts.ErrorFormat, "Failed to merge values", err)
+			return 1
+		}
+		return 0
+	}
+
+	if command == "lint" {
+		envs := []string{opts.Env}
+		if opts.AllEnvs {
+			envs, err = valuesWriter.Environments(base)
+			if err != nil || len(envs) == 0 {
+				l.Println("Could not find environments: ", err)
+				return 1
+			}
+		}
+		if err := lint(ctx, renderer, valuesWriter, hfFileName, base, envs, os.Stdout); err != nil {
+			reportError(os.Stderr, opts.ErrorFormat, "Lint failed", err)
+			return 1
+		}
+		return 0
+	}
+
+	render := command == "render"
+	if (opts.AllEnvs || opts.OutputDir != "") && !render {
+		l.Println("--all-envs and --output-dir can only be used with render")
+		return 1
+	}
+
+	if opts.AllEnvs {
+		if err := renderAllEnvs(ctx, renderer, valuesWriter, hfFileName, base, opts.OutputDir, os.Stdout); err != nil {
+			reportError(os.Stderr, opts.ErrorFormat, "Failed to render environments", err)
+			return 1
+		}
+		return 0
+	}
+
+	hfContent, generated, err := renderEnv(ctx, renderer, valuesWriter, hfFileName, base, opts.Env, stateValues())
 	if err != nil {
-		l.Fatalln("Failed to render helmfile: ", err)
+		reportError(os.Stderr, opts.ErrorFormat, "Failed to render helmfile", err)
+		return 1
+	}
+
+	if render && opts.OutputDir != "" {
+		exporter := helmfile.NewExporter(opts.OutputDir)
+		err := checkNoSecrets(ctx, valuesWriter, base, opts.Env)
+		if err == nil {
+			err = exporter.Export("helmfile."+helmfile.YAMLExtension(hfFileName), "", base, hfContent, generated)
+		}
+		if err != nil {
+			l.Println("Could not write rendered helmfile: ", err)
+			return 1
+		}
+		return 0
 	}
-	cleanup = chartCleanup
 
-	if args[len(args)-1] == "render" {
+	if render {
+		hfContent, err = redactSecrets(ctx, valuesWriter, base, opts.Env, hfContent)
+		if err != nil {
+			reportError(os.Stderr, opts.ErrorFormat, "Failed to redact secrets", err)
+			return 1
+		}
 		fmt.Println(string(hfContent))
-		return
+		return 0
 	}
 
 	writer := helmfile.NewWriter()
 	hfFile, err := writer.WriteYAML(hfFileName, base, hfContent)
 	if err != nil {
-		l.Fatalf("Could not write helmfile YAML: %s", err)
+		l.Println("Could not write helmfile YAML: ", err)
+		return 1
 	}
+	// Removed by temp, also when interrupted.
+	temp.Track(hfFile.Name())
 
+	// helmfile needs the same state values nix got.
+	if err := executor.Execute(ctx, hfFile.Name(), append(stateValuesArgs(), args[1:]...), base, opts.Env); err != nil {
+		l.Println("Running helmfile failed: ", err)
+		return 1
+	}
+	return 0
+}
+
+// Render the helmfile for a single environment.
+// Returns the rendered YAML and the chart directories and files it generated in the workspace.
+func renderEnv(ctx context.Context, renderer *helmfile.Renderer, valuesWriter *environment.ValuesWriter, hfFileName, base, env string, overrides environment.StateValues) ([]byte, []string, error) {
+	// Write environment values JSON
+	valJSON, err := valuesWriter.WriteJSON(ctx, base, env, overrides)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not write values.json: %w", err)
+	}
+	// In the workspace of the run, so it may already be gone when interrupted.
 	defer func() {
-		if err := os.Remove(hfFile.Name()); err != nil {
-			panic(fmt.Sprintf("unable to remove %s: %s", hfFile.Name(), err))
+		if err := os.Remove(valJSON); err != nil && !os.IsNotExist(err) {
+			l.Printf("Could not remove values.json: %s", err)
 		}
 	}()
 
-	callErr := executor.Execute(ctx, hfFile.Name(), args[1:], base, opts.Env)
+	return renderer.Render(ctx, hfFileName, base, env, valJSON)
+}
+
+// The state values given on the command line.
+// Files are made absolute, as helmfile runs in the directory of the helmfile.
+func stateValues() environment.StateValues {
+	files := make([]string, 0, len(opts.StateValuesFile))
+	for _, f := range opts.StateValuesFile {
+		if abs, err := filepath.Abs(f); err == nil {
+			f = abs
+		}
+		files = append(files, f)
+	}
+	return environment.StateValues{Files: files, Set: opts.StateValuesSet, SetString: opts.StateValuesSetString}
+}
+
+// The env directory layout given on the command line, overriding the project config.
+func envLayout() environment.Layout {
+	return environment.Layout{Dir: opts.EnvDir, Defaults: opts.EnvDefaults, Shared: opts.EnvSharedDir}
+}
+
+// The state values as helmfile arguments.
+func stateValuesArgs() []string {
+	sv := stateValues()
+	var args []string
+	for _, f := range sv.Files {
+		args = append(args, "--state-values-file", f)
+	}
+	for _, s := range sv.Set {
+		args = append(args, "--state-values-set", s)
+	}
+	for _, s := range sv.SetString {
+		args = append(args, "--state-values-set-string", s)
+	}
+	return args
+}
 
-	nixchart.CleanupCharts(cleanup)
-	if callErr != nil {
-		l.Println("Running helmfile failed: ", callErr)
-		retcode = 1
+// Resolve the local nixpkgs lib to use, if any.
+// An empty result means the pinned lib is fetched by nix.
+func resolveLib() (string, error) {
+	switch {
+	case opts.NixLib != "":
+		return nixeval.ResolveLib(opts.NixLib)
+	case opts.Offline && bundledLib != "":
+		return nixeval.ResolveLib(bundledLib)
+	case opts.Offline:
+		return "", fmt.Errorf("%w: offline mode needs --nix-lib or HELMFILE_NIX_LIB", nixeval.ErrLibNotFound)
+	}
+	return "", nil
+}
+
+// The commands helmfile-nix handles itself, any other is passed to helmfile.
+var commands = []string{"cache", "chart", "envs", "diff-envs", "values", "lint", "render"}
+
+// Find the helmfile-nix command in the remaining arguments, and return it with the arguments after it.
+// Flags for helmfile that go-flags does not know are left in args, and may come before the command,
+// so it is the first of the commands, wherever it is. Returns an empty command if there is none.
+func findCommand(args []string) (string, []string) {
+	for i := 1; i < len(args); i++ {
+		if slices.Contains(commands, args[i]) {
+			return args[i], args[i+1:]
+		}
 	}
+	return "", nil
 }
 
 // Parse the command line arguments, return remaining arguments.
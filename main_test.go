@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"slices"
 	"strings"
 	"testing"
 
@@ -11,6 +14,9 @@ import (
 
 	"github.com/reMarkable/helmfile-nix/pkgs/environment"
 	"github.com/reMarkable/helmfile-nix/pkgs/helmfile"
+	"github.com/reMarkable/helmfile-nix/pkgs/nixchart"
+	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
+	"github.com/reMarkable/helmfile-nix/pkgs/tempfiles"
 )
 
 var cwd, _ = os.Getwd()
@@ -49,20 +55,20 @@ releases:
 func TestRender(t *testing.T) {
 	t.Parallel()
 	logger := log.Default()
-	valuesWriter := environment.NewValuesWriter(logger)
-	renderer := helmfile.NewRenderer(eval, false, []string{}, logger)
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{Logger: logger})
+	renderer := helmfile.NewRenderer(eval, nixeval.NewNixEval(false), helmfile.RendererOptions{Logger: logger})
 
-	valJSON, err := valuesWriter.WriteJSON(cwd+"/testData/helm", "dev", []string{})
+	valJSON, err := valuesWriter.WriteJSON(t.Context(), cwd+"/testData/helm", "dev", environment.StateValues{})
 	if err != nil {
 		t.Error("Failed to write values JSON: ", err)
 	}
 	defer func() {
-		if err := os.Remove(valJSON.Name()); err != nil {
+		if err := os.Remove(valJSON); err != nil {
 			t.Error("Failed to remove temp values file: ", err)
 		}
 	}()
 
-	hf, _, err := renderer.Render(t.Context(), "helmfile.nix", cwd+"/testData/helm", "dev", valJSON.Name())
+	hf, _, err := renderer.Render(t.Context(), "helmfile.nix", cwd+"/testData/helm", "dev", valJSON)
 	if err != nil {
 		t.Error("Failed to parse helmfile: ", err)
 	}
@@ -74,20 +80,20 @@ func TestRender(t *testing.T) {
 func TestRenderTemplated(t *testing.T) {
 	t.Parallel()
 	logger := log.Default()
-	valuesWriter := environment.NewValuesWriter(logger)
-	renderer := helmfile.NewRenderer(eval, false, []string{}, logger)
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{Logger: logger})
+	renderer := helmfile.NewRenderer(eval, nixeval.NewNixEval(false), helmfile.RendererOptions{Logger: logger})
 
-	valJSON, err := valuesWriter.WriteJSON(cwd+"/testData/helm-templated", "dev", []string{})
+	valJSON, err := valuesWriter.WriteJSON(t.Context(), cwd+"/testData/helm-templated", "dev", environment.StateValues{})
 	if err != nil {
 		t.Error("Failed to write values JSON: ", err)
 	}
 	defer func() {
-		if err := os.Remove(valJSON.Name()); err != nil {
+		if err := os.Remove(valJSON); err != nil {
 			t.Error("Failed to remove temp values file: ", err)
 		}
 	}()
 
-	hf, _, err := renderer.Render(t.Context(), "helmfile.gotmpl.nix", cwd+"/testData/helm-templated", "dev", valJSON.Name())
+	hf, _, err := renderer.Render(t.Context(), "helmfile.gotmpl.nix", cwd+"/testData/helm-templated", "dev", valJSON)
 	if err != nil {
 		t.Error("Failed to parse helmfile: ", err)
 	}
@@ -134,18 +140,18 @@ var vals = `{"bad":123,"bar":"true","foo":{"bad":"hello","bar":false,"baz":true,
 func TestWriteValJson(t *testing.T) {
 	t.Parallel()
 	logger := log.Default()
-	valuesWriter := environment.NewValuesWriter(logger)
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{Logger: logger})
 
-	f, err := valuesWriter.WriteJSON(cwd+"/testData/helm", "test", []string{"foo.bar=false", "bad=123", "foo.bad=hello"})
+	f, err := valuesWriter.WriteJSON(t.Context(), cwd+"/testData/helm", "test", environment.StateValues{Set: []string{"foo.bar=false", "bad=123", "foo.bad=hello"}})
 	if err != nil {
 		t.Error("Failed to write values file: ", err)
 	}
 	defer func() {
-		if err := os.Remove(f.Name()); err != nil {
+		if err := os.Remove(f); err != nil {
 			panic("Failed to remove values file: " + err.Error())
 		}
 	}()
-	res, err := os.ReadFile(f.Name())
+	res, err := os.ReadFile(f)
 	if err != nil {
 		t.Error("Failed to read file: ", err)
 	}
@@ -153,3 +159,402 @@ func TestWriteValJson(t *testing.T) {
 		t.Errorf("Result not as expected:\n%v", diff.LineDiff(string(res), vals))
 	}
 }
+
+var outputAllEnvs = `# Environment: dev
+releases:
+    - name: test
+---
+# Environment: test
+releases:
+    - name: test
+`
+
+func TestRenderAllEnvs(t *testing.T) {
+	t.Parallel()
+	logger := log.Default()
+	evaluator := nixeval.NewFake().Respond("helmfile.nix", []byte(`[{"releases":[{"name":"test"}]}]`))
+	renderer := helmfile.NewRenderer(eval, evaluator, helmfile.RendererOptions{Logger: logger})
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{Logger: logger})
+
+	var out strings.Builder
+	err := renderAllEnvs(t.Context(), renderer, valuesWriter, "helmfile.nix", cwd+"/testData/helm", "", &out)
+	if err != nil {
+		t.Fatal("Failed to render environments: ", err)
+	}
+	if out.String() != outputAllEnvs {
+		t.Errorf("Result not as expected:\n%v", diff.LineDiff(out.String(), outputAllEnvs))
+	}
+
+	calls := evaluator.Calls()
+	if len(calls) != 2 || !strings.Contains(calls[0], `"dev"`) || !strings.Contains(calls[1], `"test"`) {
+		t.Errorf("Expected one evaluation per environment, got: %v", calls)
+	}
+}
+
+func TestRenderAllEnvs_OutputDir(t *testing.T) {
+	t.Parallel()
+	logger := log.Default()
+	evaluator := nixeval.NewFake().Respond("helmfile.nix", []byte(`[{"releases":[{"name":"test","chart":"../chart/"}]}]`))
+	renderer := helmfile.NewRenderer(eval, evaluator, helmfile.RendererOptions{Logger: logger})
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{Logger: logger})
+	outputDir := t.TempDir() + "/out"
+
+	err := renderAllEnvs(t.Context(), renderer, valuesWriter, "helmfile.nix", cwd+"/testData/helm", outputDir, io.Discard)
+	if err != nil {
+		t.Fatal("Failed to render environments: ", err)
+	}
+
+	for _, env := range []string{"dev", "test"} {
+		content, err := os.ReadFile(outputDir + "/" + env + ".yaml")
+		if err != nil {
+			t.Fatalf("Missing output for %s: %v", env, err)
+		}
+		if string(content) != "releases:\n    - chart: ./"+env+"/charts/chart\n      name: test\n" {
+			t.Errorf("Unexpected output for %s: %q", env, content)
+		}
+		if _, err := os.Stat(outputDir + "/" + env + "/charts/chart/Chart.yaml"); err != nil {
+			t.Errorf("Missing chart for %s: %v", env, err)
+		}
+	}
+}
+
+func TestRenderAllEnvs_NoEnvironments(t *testing.T) {
+	t.Parallel()
+	logger := log.Default()
+	renderer := helmfile.NewRenderer(eval, nixeval.NewFake(), helmfile.RendererOptions{Logger: logger})
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{Logger: logger})
+
+	err := renderAllEnvs(t.Context(), renderer, valuesWriter, "helmfile.nix", t.TempDir(), "", io.Discard)
+	if !errors.Is(err, ErrNoEnvironments) {
+		t.Errorf("Expected %v, got: %v", ErrNoEnvironments, err)
+	}
+}
+
+var outputDiffEnvs = `--- dev
++++ test
+~ release default/test
+    ~ values[0].replicas: 1 -> 3
+`
+
+func TestDiffEnvs(t *testing.T) {
+	t.Parallel()
+	logger := log.Default()
+	evaluator := nixeval.NewFake().
+		Respond(`"dev"`, []byte(`[{"releases":[{"name":"test","namespace":"default","values":[{"replicas":1}]}]}]`)).
+		Respond(`"test"`, []byte(`[{"releases":[{"name":"test","namespace":"default","values":[{"replicas":3}]}]}]`))
+	renderer := helmfile.NewRenderer(eval, evaluator, helmfile.RendererOptions{Logger: logger})
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{Logger: logger})
+
+	var out strings.Builder
+	err := diffEnvs(t.Context(), renderer, valuesWriter, "helmfile.nix", cwd+"/testData/helm", []string{"dev", "test"}, &out)
+	if err != nil {
+		t.Fatal("Failed to diff environments: ", err)
+	}
+	if out.String() != outputDiffEnvs {
+		t.Errorf("Result not as expected:\n%v", diff.LineDiff(out.String(), outputDiffEnvs))
+	}
+
+	out.Reset()
+	err = diffEnvs(t.Context(), renderer, valuesWriter, "helmfile.nix", cwd+"/testData/helm", []string{"dev", "dev"}, &out)
+	if err != nil {
+		t.Fatal("Failed to diff environments: ", err)
+	}
+	if out.String() != "No differences between dev and dev\n" {
+		t.Errorf("Unexpected output for identical environments: %q", out.String())
+	}
+}
+
+func TestDiffEnvs_Generated(t *testing.T) {
+	t.Parallel()
+	base := cwd + "/testData/helm"
+	releases := `[{"releases":[{"name":"nix","namespace":"default","nixChart":"../nixChart"},{"name":"app","namespace":"default","chart":"../chart/","values":["values/app.nix"]}]}]`
+	evaluator := nixeval.NewFake().
+		Respond("chart.nix", []byte(`[{"kind":"ConfigMap"}]`)).
+		Respond(`.renderValues "values/app.nix" "`+base+`" "dev"`, []byte(`{"replicas":1}`)).
+		Respond(`.renderValues "values/app.nix" "`+base+`" "test"`, []byte(`{"replicas":3}`)).
+		Respond(`.render "helmfile.nix"`, []byte(releases))
+	temp := testTemp(t)
+	renderer := helmfile.NewRenderer(eval, evaluator, helmfile.RendererOptions{Temp: temp})
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{Temp: temp})
+
+	// The chart and the values file are written to new paths for every render.
+	var out strings.Builder
+	err := diffEnvs(t.Context(), renderer, valuesWriter, "helmfile.nix", base, []string{"dev", "dev"}, &out)
+	if err != nil {
+		t.Fatal("Failed to diff environments: ", err)
+	}
+	if out.String() != "No differences between dev and dev\n" {
+		t.Errorf("Unexpected output for identical environments: %q", out.String())
+	}
+
+	out.Reset()
+	err = diffEnvs(t.Context(), renderer, valuesWriter, "helmfile.nix", base, []string{"dev", "test"}, &out)
+	if err != nil {
+		t.Fatal("Failed to diff environments: ", err)
+	}
+	expected := "--- dev\n+++ test\n~ release default/app\n    ~ values[0].replicas: 1 -> 3\n"
+	if out.String() != expected {
+		t.Errorf("Result not as expected:\n%v", diff.LineDiff(out.String(), expected))
+	}
+}
+
+func TestDiffEnvs_Args(t *testing.T) {
+	t.Parallel()
+	logger := log.Default()
+	renderer := helmfile.NewRenderer(eval, nixeval.NewFake(), helmfile.RendererOptions{Logger: logger})
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{Logger: logger})
+
+	err := diffEnvs(t.Context(), renderer, valuesWriter, "helmfile.nix", cwd+"/testData/helm", []string{"dev"}, io.Discard)
+	if !errors.Is(err, ErrDiffEnvsArgs) {
+		t.Errorf("Expected %v, got: %v", ErrDiffEnvsArgs, err)
+	}
+}
+
+func TestReportError(t *testing.T) {
+	t.Parallel()
+	evalErr := nixeval.ParseError([]byte("error: undefined variable 'foo'\n\n       at /src/helmfile.nix:3:10:\n"), nil)
+	err := fmt.Errorf("failed to eval nix: %w", evalErr)
+
+	var text strings.Builder
+	reportError(&text, "text", "Failed to render helmfile", err)
+	expected := "Failed to render helmfile: failed to eval nix: /src/helmfile.nix:3:10: undefined variable 'foo'\n" +
+		"error: undefined variable 'foo'\n" +
+		"  --> /src/helmfile.nix:3:10\n"
+	if text.String() != expected {
+		t.Errorf("Unexpected text report:\n%v", diff.LineDiff(text.String(), expected))
+	}
+
+	var js strings.Builder
+	reportError(&js, "json", "Failed to render helmfile", err)
+	expected = `{"error":"Failed to render helmfile: failed to eval nix: /src/helmfile.nix:3:10: undefined variable 'foo'",` +
+		`"nix":{"message":"undefined variable 'foo'","file":"/src/helmfile.nix","line":3,"column":10}}` + "\n"
+	if js.String() != expected {
+		t.Errorf("Unexpected json report: %s", js.String())
+	}
+
+	js.Reset()
+	reportError(&js, "json", "Failed to render helmfile", ErrNoEnvironments)
+	if js.String() != `{"error":"Failed to render helmfile: no environments found"}`+"\n" {
+		t.Errorf("Unexpected json report: %s", js.String())
+	}
+}
+
+func TestLint(t *testing.T) {
+	t.Parallel()
+	logger := log.Default()
+	evaluator := nixeval.NewFake().
+		Respond(`"dev"`, []byte(`[{"releases":[{"name":"test","chart":"../chart/"}]}]`)).
+		Respond(`"test"`, []byte(`[{"releases":[{"name":"test","chart":"../chart/","namspace":"web"}]}]`))
+	renderer := helmfile.NewRenderer(eval, evaluator, helmfile.RendererOptions{Logger: logger})
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{Logger: logger})
+
+	var out strings.Builder
+	err := lint(t.Context(), renderer, valuesWriter, "helmfile.nix", cwd+"/testData/helm", []string{"dev"}, &out)
+	if err != nil || out.Len() != 0 {
+		t.Errorf("Expected no findings for dev, got: %v %q", err, out.String())
+	}
+
+	out.Reset()
+	err = lint(t.Context(), renderer, valuesWriter, "helmfile.nix", cwd+"/testData/helm", []string{"dev", "test"}, &out)
+	if !errors.Is(err, ErrLintFindings) {
+		t.Errorf("Expected %v, got: %v", ErrLintFindings, err)
+	}
+	expected := "test: document 1: releases[0].namspace: unknown field, did you mean \"namespace\"?\n"
+	if out.String() != expected {
+		t.Errorf("Unexpected lint output: %q", out.String())
+	}
+}
+
+func TestLint_RenderedOutput(t *testing.T) {
+	t.Parallel()
+	for name, content := range map[string]string{"output": output, "outputTemplated": outputTemplated} {
+		findings, err := helmfile.Lint([]byte(content))
+		if err != nil || len(findings) != 0 {
+			t.Errorf("Expected %s to pass lint, got: %v %v", name, err, findings)
+		}
+	}
+}
+
+func TestRenderAllEnvs_Secrets(t *testing.T) {
+	t.Parallel()
+	logger := log.Default()
+	evaluator := nixeval.NewFake().
+		Respond(`"dev"`, []byte(`[{"releases":[{"name":"test","chart":"../chart/","values":[{"password":"dev-password","url":"https://svc:dev-password@db"}]}]}]`))
+	renderer := helmfile.NewRenderer(eval, evaluator, helmfile.RendererOptions{Logger: logger})
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{AgeKeyFile: cwd + "/testData/helm-secrets/keys.txt", Logger: logger})
+
+	var out strings.Builder
+	if err := renderAllEnvs(t.Context(), renderer, valuesWriter, "helmfile.nix", cwd+"/testData/helm-secrets", "", &out); err != nil {
+		t.Fatalf("Failed to render environments: %s", err)
+	}
+	if strings.Contains(out.String(), "dev-password") || !strings.Contains(out.String(), "url: https://svc:<redacted>@db") {
+		t.Errorf("Expected secrets to be redacted, got:\n%s", out.String())
+	}
+
+	err := renderAllEnvs(t.Context(), renderer, valuesWriter, "helmfile.nix", cwd+"/testData/helm-secrets", t.TempDir(), io.Discard)
+	if !errors.Is(err, ErrSecretsOnDisk) {
+		t.Errorf("Expected %v, got: %v", ErrSecretsOnDisk, err)
+	}
+}
+
+func TestDiffEnvs_Secrets(t *testing.T) {
+	t.Parallel()
+	logger := log.Default()
+	evaluator := nixeval.NewFake().
+		Respond(`"dev"`, []byte(`[{"releases":[{"name":"test","chart":"../chart/","values":[{"password":"dev-password"}]}]}]`)).
+		Respond(`"test"`, []byte(`[{"releases":[{"name":"test","chart":"../chart/","values":[{"password":"test-password"}]}]}]`))
+	renderer := helmfile.NewRenderer(eval, evaluator, helmfile.RendererOptions{Logger: logger})
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{AgeKeyFile: cwd + "/testData/helm-secrets/keys.txt", Logger: logger})
+
+	var out strings.Builder
+	err := diffEnvs(t.Context(), renderer, valuesWriter, "helmfile.nix", cwd+"/testData/helm-secrets", []string{"dev", "test"}, &out)
+	if err != nil {
+		t.Fatal("Failed to diff environments: ", err)
+	}
+	if strings.Contains(out.String(), "dev-password") || !strings.Contains(out.String(), `"<redacted>" -> "test-password"`) {
+		t.Errorf("Expected secrets to be redacted, got:\n%s", out.String())
+	}
+}
+
+func TestWriteValues(t *testing.T) {
+	t.Parallel()
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{AgeKeyFile: cwd + "/testData/helm-secrets/keys.txt"})
+
+	var out strings.Builder
+	if err := writeValues(t.Context(), valuesWriter, cwd+"/testData/helm-secrets", "dev", "json", &out); err != nil {
+		t.Fatalf("Failed to write values: %s", err)
+	}
+	if strings.Contains(out.String(), "dev-password") {
+		t.Errorf("Expected secrets to be redacted, got:\n%s", out.String())
+	}
+	expected := `{
+      "path": "secrets.db.password",
+      "value": "<redacted>",
+      "source": "env/secrets/dev.yaml",
+      "line": 2
+    }`
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("Expected the source of the password, got:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := writeValues(t.Context(), valuesWriter, cwd+"/testData/helm-secrets", "dev", "", &out); err != nil {
+		t.Fatalf("Failed to write values: %s", err)
+	}
+	expected = "replicas: 2\nsecrets:\n  apiToken: <redacted>\n  db:\n    password: <redacted>\n    user: <redacted>\n"
+	if out.String() != expected {
+		t.Errorf("Unexpected values:\n%s", out.String())
+	}
+}
+
+func TestListEnvs(t *testing.T) {
+	t.Parallel()
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{})
+
+	var out strings.Builder
+	if err := listEnvs(t.Context(), valuesWriter, cwd+"/testData/helm-secrets", &out); err != nil {
+		t.Fatalf("Failed to list environments: %s", err)
+	}
+	expected := "dev\n  files: env/defaults.yaml, env/dev.yaml\n  secrets: env/secrets/defaults.yaml, env/secrets/dev.yaml\n"
+	if out.String() != expected {
+		t.Errorf("Result not as expected:\n%v", diff.LineDiff(out.String(), expected))
+	}
+
+	err := listEnvs(t.Context(), valuesWriter, t.TempDir(), io.Discard)
+	if !errors.Is(err, ErrNoEnvironments) {
+		t.Errorf("Expected %v, got: %v", ErrNoEnvironments, err)
+	}
+}
+
+func TestCheckEnvs(t *testing.T) {
+	t.Parallel()
+	valuesWriter := environment.NewValuesWriter(environment.ValuesWriterOptions{})
+
+	if err := checkEnvs(valuesWriter, cwd+"/testData/helm", []string{"dev", "test"}); err != nil {
+		t.Errorf("Expected known environments to pass, got: %v", err)
+	}
+	err := checkEnvs(valuesWriter, cwd+"/testData/helm", []string{"dev", "prod"})
+	if !errors.Is(err, environment.ErrUnknownEnvironment) {
+		t.Errorf("Expected %v, got: %v", environment.ErrUnknownEnvironment, err)
+	}
+}
+
+func TestChartCommand_Package(t *testing.T) {
+	t.Parallel()
+	evaluator := nixeval.NewFake().Respond("chart.nix", []byte(`{"meta":{"version":"1.0.0"},"resources":[{"kind":"Deployment"}]}`))
+	charts := nixchart.NewRenderer(evaluator, "", nil, nil)
+	repo := t.TempDir()
+
+	var out strings.Builder
+	args := []string{"package", cwd + "/testData/nixChart", "--set", "replicas=2", "--chart-version", "1.1.0", "--destination", repo, "--index"}
+	if err := chartCommand(t.Context(), charts, args, &out); err != nil {
+		t.Fatalf("Failed to package chart: %s", err)
+	}
+	if out.String() != "Packaged "+repo+"/nixChart-1.1.0.tgz\n" {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+	index, err := os.ReadFile(repo + "/index.yaml")
+	if err != nil {
+		t.Fatalf("Expected an index.yaml: %s", err)
+	}
+	if !strings.Contains(string(index), "- nixChart-1.1.0.tgz") {
+		t.Errorf("Expected the archive in the index, got:\n%s", index)
+	}
+	if calls := evaluator.Calls(); len(calls) != 1 {
+		t.Errorf("Expected one evaluation, got: %v", calls)
+	}
+}
+
+func TestChartCommand_Args(t *testing.T) {
+	t.Parallel()
+	charts := nixchart.NewRenderer(nixeval.NewFake(), "", nil, nil)
+	for _, args := range [][]string{{}, {"package"}, {"publish", "."}} {
+		if err := chartCommand(t.Context(), charts, args, io.Discard); !errors.Is(err, ErrChartArgs) {
+			t.Errorf("chartCommand(%v) error = %v, want %v", args, err, ErrChartArgs)
+		}
+	}
+}
+
+func TestChartCommand_Render(t *testing.T) {
+	t.Parallel()
+	evaluator := nixeval.NewFake().Respond("chart.nix", []byte(`[{"kind":"Deployment","metadata":{"namespace":"ns"}}]`))
+	charts := nixchart.NewRenderer(evaluator, "", nil, nil)
+
+	var out strings.Builder
+	args := []string{"render", cwd + "/testData/nixChart", "--set", "a.b=c", "--namespace", "ns", "--release", "web"}
+	if err := chartCommand(t.Context(), charts, args, &out); err != nil {
+		t.Fatalf("Failed to render chart: %s", err)
+	}
+	expected := "---\n# Source: web/resources.yaml\nkind: Deployment\nmetadata:\n    namespace: ns\n"
+	if out.String() != expected {
+		t.Errorf("Result not as expected:\n%v", diff.LineDiff(out.String(), expected))
+	}
+}
+
+func TestFindCommand(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		args        []string
+		command     string
+		commandArgs []string
+	}{
+		{[]string{"helmfile-nix", "diff-envs", "dev", "prod"}, "diff-envs", []string{"dev", "prod"}},
+		// An unknown flag for helmfile and its value before the command.
+		{[]string{"helmfile-nix", "--kube-context", "prod", "diff-envs", "dev", "prod"}, "diff-envs", []string{"dev", "prod"}},
+		{[]string{"helmfile-nix", "--kube-context", "prod", "render"}, "render", []string{}},
+		{[]string{"helmfile-nix", "--kube-context", "prod", "sync"}, "", nil},
+		{[]string{"helmfile-nix"}, "", nil},
+	} {
+		command, commandArgs := findCommand(tc.args)
+		if command != tc.command || !slices.Equal(commandArgs, tc.commandArgs) {
+			t.Errorf("findCommand(%v) = %q %v, want %q %v", tc.args, command, commandArgs, tc.command, tc.commandArgs)
+		}
+	}
+}
+
+func testTemp(t *testing.T) *tempfiles.Manager {
+	t.Helper()
+	temp := tempfiles.NewManager()
+	t.Cleanup(temp.Cleanup)
+	return temp
+}
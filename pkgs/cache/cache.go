@@ -0,0 +1,123 @@
+// Package cache provides a content-addressed on-disk cache for nix evaluation results.
+package cache
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
+)
+
+// Cache stores evaluation results on disk, keyed by a hash of all evaluation inputs.
+// A nil *Cache is valid and disables caching.
+type Cache struct {
+	dir     string
+	version string
+}
+
+// New creates a cache in dir. The version is part of every key, so results
+// are never shared between different helmfile-nix versions.
+func New(dir string, version string) *Cache {
+	return &Cache{
+		dir:     dir,
+		version: version,
+	}
+}
+
+// DefaultDir returns the default cache directory in the user cache directory.
+func DefaultDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "helmfile-nix"), nil
+}
+
+// Dir returns the directory of the cache.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Get returns the cached data for key, if present.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// Put stores data for key. The write is atomic, so concurrent readers never see partial entries.
+func (c *Cache) Put(key string, data []byte) error {
+	p := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(p), "tmp.*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+// Clean removes all cached entries.
+// Only the entries are removed, so pointing the cache at a shared directory is safe.
+func (c *Cache) Clean() error {
+	return os.RemoveAll(c.entries())
+}
+
+// Eval returns the cached result of an evaluation, or evaluates expr and caches the result.
+// The key is built by addInputs, which must add every input that affects the result.
+func (c *Cache) Eval(ctx context.Context, evaluator nixeval.Evaluator, expr string, trace bool, addInputs func(*Key) error) ([]byte, error) {
+	if c == nil {
+		return evaluator.Eval(ctx, expr, trace)
+	}
+
+	k := NewKey()
+	k.AddString("version", c.version)
+	if err := addInputs(k); err != nil {
+		return nil, fmt.Errorf("could not compute cache key: %w", err)
+	}
+	key := k.Sum()
+
+	if data, ok := c.Get(key); ok {
+		log.Println("Using cached evaluation", key)
+		return data, nil
+	}
+
+	data, err := evaluator.Eval(ctx, expr, trace)
+	if err != nil {
+		return data, err
+	}
+
+	if err := c.Put(key, data); err != nil {
+		log.Println("Could not write evaluation to cache:", err)
+	}
+	return data, nil
+}
+
+func (c *Cache) entries() string {
+	return filepath.Join(c.dir, "eval")
+}
+
+func (c *Cache) path(key string) string {
+	if len(key) < 2 {
+		return filepath.Join(c.entries(), key+".json")
+	}
+	return filepath.Join(c.entries(), key[:2], key+".json")
+}
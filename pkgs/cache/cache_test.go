@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
+)
+
+var errBoom = errors.New("boom")
+
+func TestCache_GetPut(t *testing.T) {
+	t.Parallel()
+	c := New(t.TempDir(), "test")
+
+	if _, ok := c.Get("abcdef"); ok {
+		t.Fatal("Get() on empty cache should miss")
+	}
+
+	if err := c.Put("abcdef", []byte(`[]`)); err != nil {
+		t.Fatalf("Put() error: %v", err)
+	}
+
+	data, ok := c.Get("abcdef")
+	if !ok || string(data) != `[]` {
+		t.Errorf("Get() = %s, %v, want stored entry", data, ok)
+	}
+}
+
+func TestCache_Clean(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	other := filepath.Join(dir, "unrelated.txt")
+	if err := os.WriteFile(other, []byte("keep"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	c := New(dir, "test")
+	if err := c.Put("abcdef", []byte(`[]`)); err != nil {
+		t.Fatalf("Put() error: %v", err)
+	}
+
+	if err := c.Clean(); err != nil {
+		t.Fatalf("Clean() error: %v", err)
+	}
+
+	if _, ok := c.Get("abcdef"); ok {
+		t.Error("Get() after Clean() should miss")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("Clean() should only remove cache entries: %v", err)
+	}
+}
+
+func TestCache_Eval(t *testing.T) {
+	t.Parallel()
+	c := New(t.TempDir(), "test")
+	evaluator := nixeval.NewFake().Respond("", []byte(`[1]`))
+	inputs := func(k *Key) error {
+		k.AddString("input", "a")
+		return nil
+	}
+
+	for range 2 {
+		out, err := c.Eval(t.Context(), evaluator, "expr", false, inputs)
+		if err != nil {
+			t.Fatalf("Eval() error: %v", err)
+		}
+		if string(out) != `[1]` {
+			t.Errorf("Eval() = %s", out)
+		}
+	}
+
+	if len(evaluator.Calls()) != 1 {
+		t.Errorf("Eval() should only evaluate once, got %d calls", len(evaluator.Calls()))
+	}
+
+	// Different inputs or versions must miss.
+	if _, err := c.Eval(t.Context(), evaluator, "expr", false, func(k *Key) error {
+		k.AddString("input", "b")
+		return nil
+	}); err != nil {
+		t.Fatalf("Eval() error: %v", err)
+	}
+	if _, err := New(c.Dir(), "other").Eval(t.Context(), evaluator, "expr", false, inputs); err != nil {
+		t.Fatalf("Eval() error: %v", err)
+	}
+	if len(evaluator.Calls()) != 3 {
+		t.Errorf("Eval() should miss on changed inputs, got %d calls", len(evaluator.Calls()))
+	}
+}
+
+func TestCache_Eval_Errors(t *testing.T) {
+	t.Parallel()
+	c := New(t.TempDir(), "test")
+	evaluator := nixeval.NewFake().Fail("", errBoom)
+	inputs := func(*Key) error { return nil }
+
+	for range 2 {
+		if _, err := c.Eval(t.Context(), evaluator, "expr", false, inputs); !errors.Is(err, errBoom) {
+			t.Fatalf("Eval() error = %v, want %v", err, errBoom)
+		}
+	}
+	if len(evaluator.Calls()) != 2 {
+		t.Errorf("Eval() should not cache failures, got %d calls", len(evaluator.Calls()))
+	}
+
+	_, err := c.Eval(t.Context(), evaluator, "expr", false, func(*Key) error { return errBoom })
+	if !errors.Is(err, errBoom) {
+		t.Errorf("Eval() error = %v, want key error", err)
+	}
+}
+
+func TestCache_Eval_Nil(t *testing.T) {
+	t.Parallel()
+	var c *Cache
+	evaluator := nixeval.NewFake().Respond("", []byte(`[]`))
+
+	for range 2 {
+		if _, err := c.Eval(t.Context(), evaluator, "expr", false, func(*Key) error {
+			t.Error("Eval() on nil cache should not compute a key")
+			return nil
+		}); err != nil {
+			t.Fatalf("Eval() error: %v", err)
+		}
+	}
+	if len(evaluator.Calls()) != 2 {
+		t.Errorf("Eval() on nil cache should always evaluate, got %d calls", len(evaluator.Calls()))
+	}
+}
@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Relative path literals in nix files, e.g. `import ./lib.nix` or `readFile ../files/config.ini`.
+var nixPathLiteral = regexp.MustCompile(`(?:^|[^A-Za-z0-9_'"./:-])(\.\.?/[A-Za-z0-9._+\-/]*[A-Za-z0-9._+\-])`)
+
+// Key builds a cache key by hashing named inputs.
+type Key struct {
+	h hash.Hash
+}
+
+// NewKey creates an empty key.
+func NewKey() *Key {
+	return &Key{h: sha256.New()}
+}
+
+// Add adds a named input to the key.
+func (k *Key) Add(name string, value []byte) {
+	// Length prefixes keep inputs from running into each other.
+	fmt.Fprintf(k.h, "%d:%s%d:", len(name), name, len(value))
+	k.h.Write(value)
+}
+
+// AddString adds a named string input to the key.
+func (k *Key) AddString(name string, value string) {
+	k.Add(name, []byte(value))
+}
+
+// AddFile adds the path and content of a file to the key.
+func (k *Key) AddFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	k.Add("file:"+path, data)
+	return nil
+}
+
+// AddLib adds the nixpkgs lib at path by its content, so a changed or different lib at the same
+// path is a different key. An empty path is the lib pinned in eval.nix.
+// The lib is hashed once per path and process.
+func (k *Key) AddLib(path string) error {
+	if path == "" {
+		k.AddString("lib", "")
+		return nil
+	}
+	sum, ok := libSums.Load(path)
+	if !ok {
+		lk := NewKey()
+		if err := lk.addNixPath(path, map[string]bool{}); err != nil {
+			return err
+		}
+		sum, _ = libSums.LoadOrStore(path, lk.Sum())
+	}
+	s, _ := sum.(string)
+	k.AddString("lib", s)
+	return nil
+}
+
+// libSums are the hashes of the nixpkgs libs added with AddLib, by path.
+var libSums sync.Map
+
+// AddNixClosure adds a nix file and everything it references through relative
+// path literals, recursively. Directories are added with all their content.
+// Paths built from strings at evaluation time can not be found this way.
+func (k *Key) AddNixClosure(path string) error {
+	return k.addNixPath(path, map[string]bool{})
+}
+
+// Sum returns the hex encoded key.
+func (k *Key) Sum() string {
+	return hex.EncodeToString(k.h.Sum(nil))
+}
+
+func (k *Key) addNixPath(path string, seen map[string]bool) error {
+	path = filepath.Clean(path)
+	if seen[path] {
+		return nil
+	}
+	seen[path] = true
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		// Missing files may be fine, e.g. behind a pathExists check.
+		k.AddString("missing", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return k.addDir(path, seen)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	k.Add("file:"+path, data)
+
+	if !strings.HasSuffix(path, ".nix") {
+		return nil
+	}
+
+	for _, m := range nixPathLiteral.FindAllSubmatch(stripNixComments(data), -1) {
+		if err := k.addNixPath(filepath.Join(filepath.Dir(path), string(m[1])), seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *Key) addDir(path string, seen map[string]bool) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.Name() == ".git" {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	k.AddString("dir:"+path, strings.Join(names, "\n"))
+
+	for _, name := range names {
+		if err := k.addNixPath(filepath.Join(path, name), seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripNixComments removes line comments, so commented out imports are not followed.
+func stripNixComments(data []byte) []byte {
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		if idx := strings.Index(line, "#"); idx >= 0 && !strings.Contains(line[:idx], `"`) {
+			lines[i] = line[:idx]
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
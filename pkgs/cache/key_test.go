@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+}
+
+func closureKey(t *testing.T, path string) string {
+	t.Helper()
+	k := NewKey()
+	if err := k.AddNixClosure(path); err != nil {
+		t.Fatalf("AddNixClosure() error: %v", err)
+	}
+	return k.Sum()
+}
+
+func TestKey_AddNixClosure(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"helmfile.nix":          `{ lib, ... }: import ./releases { config = lib.importJSON ../shared/config.json; }`,
+		"releases/default.nix":  `{ config }: [ (import ./grafana.nix) ] # import ./unused.nix`,
+		"releases/grafana.nix":  `{ name = "grafana"; url = "https://grafana.github.io/helm-charts"; }`,
+		"releases/unused.nix":   `{ }`,
+		"../shared/config.json": `{}`,
+	})
+	hf := filepath.Join(dir, "helmfile.nix")
+	before := closureKey(t, hf)
+
+	if closureKey(t, hf) != before {
+		t.Fatal("AddNixClosure() should be deterministic")
+	}
+
+	// Changes to transitive imports change the key.
+	writeFiles(t, dir, map[string]string{"releases/grafana.nix": `{ name = "loki"; }`})
+	changed := closureKey(t, hf)
+	if changed == before {
+		t.Error("AddNixClosure() should change with imported files")
+	}
+
+	// Files outside the base dir are followed too.
+	writeFiles(t, dir, map[string]string{"../shared/config.json": `{"a":1}`})
+	if closureKey(t, hf) == changed {
+		t.Error("AddNixClosure() should change with files referenced by path")
+	}
+}
+
+func TestKey_AddNixClosure_MissingFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"helmfile.nix": `{ lib, ... }: lib.optional (builtins.pathExists ./extra.nix) (import ./extra.nix)`,
+	})
+	hf := filepath.Join(dir, "helmfile.nix")
+	before := closureKey(t, hf)
+
+	writeFiles(t, dir, map[string]string{"extra.nix": `{ }`})
+	if closureKey(t, hf) == before {
+		t.Error("AddNixClosure() should change when a missing file appears")
+	}
+}
+
+func TestKey_Add(t *testing.T) {
+	t.Parallel()
+	a := NewKey()
+	a.AddString("ab", "c")
+	b := NewKey()
+	b.AddString("a", "bc")
+
+	if a.Sum() == b.Sum() {
+		t.Error("Add() inputs should not run into each other")
+	}
+}
+
+func TestKey_AddFile(t *testing.T) {
+	t.Parallel()
+	k := NewKey()
+	if err := k.AddFile("/nonexistent/values.json"); err == nil {
+		t.Error("AddFile() should fail for missing files")
+	}
+}
+
+func TestKey_AddLib(t *testing.T) {
+	t.Parallel()
+	sum := func(lib string) string {
+		t.Helper()
+		k := NewKey()
+		if err := k.AddLib(lib); err != nil {
+			t.Fatalf("AddLib() error: %v", err)
+		}
+		return k.Sum()
+	}
+
+	// Like the pinned lib and the lib of another nixpkgs, e.g. the one bundled for --offline.
+	pinned := t.TempDir()
+	writeFiles(t, pinned, map[string]string{"default.nix": "import ./trivial.nix", "trivial.nix": "{ version = \"25.05\"; }"})
+	other := t.TempDir()
+	writeFiles(t, other, map[string]string{"default.nix": "import ./trivial.nix", "trivial.nix": "{ version = \"24.11\"; }"})
+
+	if sum(pinned) != sum(pinned) {
+		t.Error("AddLib() should be stable")
+	}
+	if sum(pinned) == sum(other) || sum(pinned) == sum("") {
+		t.Error("AddLib() should tell libs apart")
+	}
+	if err := NewKey().AddLib(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Errorf("AddLib() of a missing lib should be left to nix, got %v", err)
+	}
+}
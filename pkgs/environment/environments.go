@@ -0,0 +1,113 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ListEnvironments returns the names of all environments with a file in the env directories of state.
+// The defaults file and the schema are not environments. Missing env directories yield no environments.
+func ListEnvironments(state string, layout Layout) ([]string, error) {
+	dirs, err := layout.resolve(state)
+	if err != nil {
+		return nil, err
+	}
+
+	var envs []string
+	for _, dir := range dirs.dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, e := range entries {
+			ext := filepath.Ext(e.Name())
+			name := strings.TrimSuffix(e.Name(), ext)
+			if e.IsDir() || !slices.Contains(EnvFileExtensions, ext) || name == dirs.defaults || name == SchemaName || slices.Contains(envs, name) {
+				continue
+			}
+			envs = append(envs, name)
+		}
+	}
+	sort.Strings(envs)
+	return envs, nil
+}
+
+// Environments returns the environments of the helmfile in state, see ListEnvironments.
+func (w *ValuesWriter) Environments(state string) ([]string, error) {
+	return ListEnvironments(state, w.layout)
+}
+
+// ErrUnknownEnvironment is returned in strict mode for an environment without an env file.
+var ErrUnknownEnvironment = errors.New("unknown environment")
+
+// CheckEnvironment returns an error if env is not one of the environments of the helmfile in state.
+// Without it env would be rendered with only the defaults.
+func (w *ValuesWriter) CheckEnvironment(state, env string) error {
+	envs, err := w.Environments(state)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(envs, env) {
+		return nil
+	}
+	if len(envs) == 0 {
+		return fmt.Errorf("%w %q, there are no environments", ErrUnknownEnvironment, env)
+	}
+	return fmt.Errorf("%w %q, expected one of %s", ErrUnknownEnvironment, env, strings.Join(envs, ", "))
+}
+
+// Description is what makes up an environment.
+type Description struct {
+	Name string
+	// Inherits are the environments it inherits from, nearest first.
+	Inherits []string
+	// Files are the env files merged for it, in order.
+	Files []string
+	// Secrets are its secrets files, in order.
+	Secrets []string
+}
+
+// Describe returns the description of every environment of the helmfile in state.
+func (w *ValuesWriter) Describe(ctx context.Context, state string) ([]Description, error) {
+	envs, err := w.Environments(state)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptions := make([]Description, 0, len(envs))
+	for _, env := range envs {
+		layers, err := w.loadLayers(ctx, state, env)
+		if err != nil {
+			return nil, fmt.Errorf("environment %s: %w", env, err)
+		}
+		secrets, err := w.secretsFiles(state, layers)
+		if err != nil {
+			return nil, fmt.Errorf("environment %s: %w", env, err)
+		}
+
+		d := Description{Name: env}
+		for i, l := range layers {
+			if l.path != "" {
+				d.Files = append(d.Files, relOrigin(l.path, state))
+			}
+			if i > 0 && l.name != env {
+				d.Inherits = append([]string{l.name}, d.Inherits...)
+			}
+		}
+		for _, path := range secrets {
+			d.Secrets = append(d.Secrets, relOrigin(path, state))
+		}
+		descriptions = append(descriptions, d)
+	}
+	return descriptions, nil
+}
@@ -0,0 +1,109 @@
+package environment
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListEnvironments(t *testing.T) {
+	t.Parallel()
+	envs, err := ListEnvironments(filepath.Join("..", "..", "testData", "helm"), Layout{})
+	if err != nil {
+		t.Fatalf("ListEnvironments() error: %v", err)
+	}
+
+	if !reflect.DeepEqual(envs, []string{"dev", "test"}) {
+		t.Errorf("ListEnvironments() = %v, want [dev test]", envs)
+	}
+}
+
+func TestListEnvironments_SkipsOtherFiles(t *testing.T) {
+	t.Parallel()
+	tmpDir := t.TempDir()
+	envDir := filepath.Join(tmpDir, "env")
+	if err := os.MkdirAll(filepath.Join(envDir, "nested.yaml"), 0o700); err != nil {
+		t.Fatalf("Failed to create env dir: %v", err)
+	}
+	for _, name := range []string{"defaults.yaml", "prod.yaml", "README.md", "schema.json", "stage.yaml"} {
+		if err := os.WriteFile(filepath.Join(envDir, name), []byte("{}"), 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	envs, err := ListEnvironments(tmpDir, Layout{})
+	if err != nil {
+		t.Fatalf("ListEnvironments() error: %v", err)
+	}
+
+	if !reflect.DeepEqual(envs, []string{"prod", "stage"}) {
+		t.Errorf("ListEnvironments() = %v, want [prod stage]", envs)
+	}
+}
+
+func TestListEnvironments_MissingDir(t *testing.T) {
+	t.Parallel()
+	envs, err := ListEnvironments(t.TempDir(), Layout{})
+	if err != nil {
+		t.Fatalf("ListEnvironments() error: %v", err)
+	}
+
+	if len(envs) != 0 {
+		t.Errorf("ListEnvironments() = %v, want none", envs)
+	}
+}
+
+func TestValuesWriter_CheckEnvironment(t *testing.T) {
+	t.Parallel()
+	w := NewValuesWriter(ValuesWriterOptions{})
+	state := filepath.Join("..", "..", "testData", "helm")
+
+	if err := w.CheckEnvironment(state, "dev"); err != nil {
+		t.Errorf("CheckEnvironment(dev) error: %v", err)
+	}
+
+	err := w.CheckEnvironment(state, "devv")
+	if !errors.Is(err, ErrUnknownEnvironment) {
+		t.Fatalf("CheckEnvironment(devv) error = %v, want %v", err, ErrUnknownEnvironment)
+	}
+	if !strings.Contains(err.Error(), "expected one of dev, test") {
+		t.Errorf("CheckEnvironment(devv) error = %v, want the known environments", err)
+	}
+
+	if err := w.CheckEnvironment(t.TempDir(), "dev"); !errors.Is(err, ErrUnknownEnvironment) {
+		t.Errorf("CheckEnvironment() without environments error = %v, want %v", err, ErrUnknownEnvironment)
+	}
+}
+
+func TestValuesWriter_Describe(t *testing.T) {
+	t.Parallel()
+	dir := writeEnvFiles(t, map[string]string{
+		"defaults.yaml": "a: 1\n",
+		"base.toml":     "a = 2\n",
+		"prod.yaml":     "_inherits: base\n",
+		"prod-eu.yaml":  "_inherits: prod\n",
+	})
+	if err := os.MkdirAll(filepath.Join(dir, "env", "secrets"), 0o700); err != nil {
+		t.Fatalf("Failed to create secrets dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "env", "secrets", "prod.yaml"), []byte("{}"), 0o600); err != nil {
+		t.Fatalf("Failed to write secrets: %v", err)
+	}
+
+	descriptions, err := NewValuesWriter(ValuesWriterOptions{}).Describe(t.Context(), dir)
+	if err != nil {
+		t.Fatalf("Describe() error: %v", err)
+	}
+
+	want := []Description{
+		{Name: "base", Files: []string{"env/defaults.yaml", "env/base.toml"}},
+		{Name: "prod", Inherits: []string{"base"}, Files: []string{"env/defaults.yaml", "env/base.toml", "env/prod.yaml"}, Secrets: []string{"env/secrets/prod.yaml"}},
+		{Name: "prod-eu", Inherits: []string{"prod", "base"}, Files: []string{"env/defaults.yaml", "env/base.toml", "env/prod.yaml", "env/prod-eu.yaml"}, Secrets: []string{"env/secrets/prod.yaml"}},
+	}
+	if !reflect.DeepEqual(descriptions, want) {
+		t.Errorf("Describe() = %+v, want %+v", descriptions, want)
+	}
+}
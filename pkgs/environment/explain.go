@@ -0,0 +1,179 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/schema"
+)
+
+// Provenance is where a value in the environment values came from.
+type Provenance struct {
+	// Path of the value, e.g. `image.tag`.
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+	// Source is the file the value came from, relative to the state directory if it is in it,
+	// or the flag that set it.
+	Source string `json:"source"`
+	// Line in Source, if it is a YAML or JSON file.
+	Line int `json:"line,omitempty"`
+}
+
+// Explain merges the values of env like WriteJSON, and returns them with where each of them came from.
+// Maps are followed down to their values, lists are reported as a whole.
+func (w *ValuesWriter) Explain(ctx context.Context, state, env string, overrides StateValues) (map[string]any, []Provenance, error) {
+	m, sources, err := w.valuesWithSources(ctx, state, env, nil, overrides)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lines := newLineFinder()
+	var provenance []Provenance
+	walkLeaves(m, nil, func(path []any, v any) {
+		p := Provenance{Path: joinPath(path), Value: v}
+		if src, at, ok := sourceOf(sources, path); ok {
+			p.Source = relOrigin(src.origin, state)
+			p.Line = lines.line(src, at)
+		}
+		provenance = append(provenance, p)
+	})
+	return m, provenance, nil
+}
+
+// WriteExplained writes values as YAML, with the source of each value as a comment next to it.
+func WriteExplained(out io.Writer, values map[string]any, provenance []Provenance) error {
+	var doc yaml.Node
+	if err := doc.Encode(values); err != nil {
+		return err
+	}
+
+	sources := make(map[string]string, len(provenance))
+	for _, p := range provenance {
+		sources[p.Path] = p.Source
+		if p.Line > 0 {
+			sources[p.Path] += ":" + strconv.Itoa(p.Line)
+		}
+	}
+	annotate(&doc, "", sources)
+
+	enc := yaml.NewEncoder(out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// annotate adds the sources as comments to the mapping entries of n.
+func annotate(n *yaml.Node, path string, sources map[string]string) {
+	if n.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		p := schema.JoinPath(path, k.Value)
+		if src, ok := sources[p]; ok {
+			if v.Kind == yaml.ScalarNode || (v.Kind != yaml.SequenceNode && len(v.Content) == 0) {
+				v.LineComment = src
+			} else {
+				k.LineComment = src
+			}
+			continue
+		}
+		annotate(v, p, sources)
+	}
+}
+
+// walkLeaves calls fn for every value in v that is not a non-empty map, in the order of their paths.
+func walkLeaves(v any, path []any, fn func([]any, any)) {
+	m, ok := v.(map[string]any)
+	if !ok || (len(m) == 0 && len(path) > 0) {
+		fn(path, v)
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		walkLeaves(m[k], append(path[:len(path):len(path)], k), fn)
+	}
+}
+
+func joinPath(path []any) string {
+	s := ""
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			s = schema.JoinPath(s, p)
+		case int:
+			s = fmt.Sprintf("%s[%d]", s, p)
+		}
+	}
+	return s
+}
+
+// lineFinder finds the lines of values in YAML and JSON files, parsing each file once.
+type lineFinder struct {
+	docs map[string]*yaml.Node
+}
+
+func newLineFinder() *lineFinder {
+	return &lineFinder{docs: map[string]*yaml.Node{}}
+}
+
+// line returns the line of the value at path in the file of src, or 0 if it can not be found.
+func (f *lineFinder) line(src source, path []any) int {
+	switch filepath.Ext(src.origin) {
+	case ".yaml", ".yml", ".json":
+	default:
+		return 0
+	}
+	if src.key != "" {
+		path = path[1:]
+	}
+
+	doc, ok := f.docs[src.origin]
+	if !ok {
+		doc = &yaml.Node{}
+		if data, err := os.ReadFile(src.origin); err != nil || yaml.Unmarshal(data, doc) != nil {
+			doc = nil
+		}
+		f.docs[src.origin] = doc
+	}
+	if doc == nil || len(doc.Content) == 0 {
+		return 0
+	}
+
+	n := doc.Content[0]
+	line := n.Line
+	for _, p := range path {
+		found := false
+		switch p := p.(type) {
+		case string:
+			for i := 0; n.Kind == yaml.MappingNode && i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == p {
+					line, n, found = n.Content[i].Line, n.Content[i+1], true
+					break
+				}
+			}
+		case int:
+			if n.Kind == yaml.SequenceNode && p < len(n.Content) {
+				n, found = n.Content[p], true
+				line = n.Line
+			}
+		}
+		if !found {
+			return 0
+		}
+	}
+	return line
+}
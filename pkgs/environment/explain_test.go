@@ -0,0 +1,55 @@
+package environment
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValuesWriter_Explain(t *testing.T) {
+	t.Parallel()
+	dir := writeEnvFiles(t, map[string]string{
+		"defaults.yaml": "replicas: 1\nimage:\n  repo: app\n  tag: latest\nhosts: [a]\n",
+		"base.toml":     "region = \"eu\"\n",
+		"prod.json":     "{\n  \"_inherits\": \"base\",\n  \"image\": {\"tag\": \"v1\"}\n}\n",
+	})
+
+	values, provenance, err := NewValuesWriter(ValuesWriterOptions{}).Explain(t.Context(), dir, "prod", StateValues{Set: []string{"replicas=3"}})
+	if err != nil {
+		t.Fatalf("Explain() error: %v", err)
+	}
+
+	want := []Provenance{
+		{Path: "hosts", Value: []any{"a"}, Source: "env/defaults.yaml", Line: 5},
+		{Path: "image.repo", Value: "app", Source: "env/defaults.yaml", Line: 3},
+		{Path: "image.tag", Value: "v1", Source: "env/prod.json", Line: 3},
+		{Path: "region", Value: "eu", Source: "env/base.toml"},
+		{Path: "replicas", Value: 3, Source: "--state-values-set replicas=3"},
+	}
+	if !reflect.DeepEqual(provenance, want) {
+		t.Errorf("Explain() = %#v, want %#v", provenance, want)
+	}
+
+	var out strings.Builder
+	if err := WriteExplained(&out, values, provenance); err != nil {
+		t.Fatalf("WriteExplained() error: %v", err)
+	}
+	wantOut := `hosts: # env/defaults.yaml:5
+  - a
+image:
+  repo: app # env/defaults.yaml:3
+  tag: v1 # env/prod.json:3
+region: eu # env/base.toml
+replicas: 3 # --state-values-set replicas=3
+`
+	if out.String() != wantOut {
+		t.Errorf("WriteExplained() =\n%s\nwant\n%s", out.String(), wantOut)
+	}
+}
+
+func TestJoinPath(t *testing.T) {
+	t.Parallel()
+	if got := joinPath([]any{"a", "b.c", 0, "d"}); got != `a."b.c"[0].d` {
+		t.Errorf("joinPath() = %s", got)
+	}
+}
@@ -0,0 +1,120 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// InheritKey is the key in an env file naming the environment it inherits from.
+// It is removed from the merged values.
+const InheritKey = "_inherits"
+
+// Static errors for environment inheritance.
+var (
+	ErrInheritanceCycle = errors.New("environment inheritance cycle")
+	ErrUnknownParent    = errors.New("environment inherits from an unknown environment")
+	ErrInvalidParent    = errors.New("expected " + InheritKey + " to be an environment name")
+)
+
+// layer is the values of a single env file.
+type layer struct {
+	name   string
+	path   string
+	values map[string]any
+}
+
+// loadLayers loads the defaults, every environment env inherits from and env itself,
+// in the order they are merged: defaults first, then from the root of the chain down to env.
+func (w *ValuesWriter) loadLayers(ctx context.Context, state, env string) ([]layer, error) {
+	dirs, err := w.layout.resolve(state)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := w.loadLayer(ctx, dirs, dirs.defaults, env)
+	if err != nil {
+		return nil, err
+	}
+	// The defaults are always the root.
+	delete(defaults.values, InheritKey)
+
+	var chain []layer
+	for name := env; name != "" && name != dirs.defaults; {
+		if slices.ContainsFunc(chain, func(l layer) bool { return l.name == name }) {
+			names := make([]string, 0, len(chain)+1)
+			for _, l := range chain {
+				names = append(names, l.name)
+			}
+			return nil, fmt.Errorf("%w: %s", ErrInheritanceCycle, strings.Join(append(names, name), " -> "))
+		}
+
+		l, err := w.loadLayer(ctx, dirs, name, env)
+		if err != nil {
+			return nil, err
+		}
+		if name != env && l.path == "" {
+			return nil, fmt.Errorf("%w: %s inherits from %s, but there is no env file for it in %s", ErrUnknownParent, chain[len(chain)-1].name, name, strings.Join(dirs.dirs, ", "))
+		}
+
+		parent, err := parentOf(l)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, l)
+		name = parent
+	}
+
+	slices.Reverse(chain)
+	return append([]layer{defaults}, chain...), nil
+}
+
+// loadLayer loads the env file of the named environment from the env directories, whatever its format.
+// A missing file yields empty values and an empty path. Nix env files get the name of the rendered env.
+func (w *ValuesWriter) loadLayer(ctx context.Context, dirs envDirs, name, env string) (layer, error) {
+	path, err := dirs.find(name)
+	if err != nil {
+		return layer{}, err
+	}
+
+	var values map[string]any
+	switch filepath.Ext(path) {
+	case "":
+		values = map[string]any{}
+	case ".json":
+		values, err = LoadJSONFile(path)
+	case ".toml":
+		values, err = LoadTOMLFile(path)
+	case ".nix":
+		values, err = w.loadNixFile(ctx, path, env)
+	default:
+		values, err = LoadYamlFile(path)
+	}
+	if err == nil {
+		err = CheckMergeDirectives(values)
+	}
+	if err != nil {
+		return layer{}, fmt.Errorf("could not load %s: %w", path, err)
+	}
+	if values == nil {
+		values = map[string]any{}
+	}
+	return layer{name: name, path: path, values: values}, nil
+}
+
+// parentOf returns the environment l inherits from, and removes the key from its values.
+func parentOf(l layer) (string, error) {
+	v, ok := l.values[InheritKey]
+	if !ok {
+		return "", nil
+	}
+	delete(l.values, InheritKey)
+
+	parent, ok := v.(string)
+	if !ok || parent == "" {
+		return "", fmt.Errorf("%w in %s, got %v", ErrInvalidParent, l.path, v)
+	}
+	return parent, nil
+}
@@ -0,0 +1,198 @@
+package environment
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
+)
+
+func writeEnvFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "env"), 0o700); err != nil {
+		t.Fatalf("Failed to create env dir: %v", err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, "env", name), []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func TestValuesWriter_Inheritance(t *testing.T) {
+	t.Parallel()
+	dir := writeEnvFiles(t, map[string]string{
+		"defaults.yaml": "region: none\nreplicas: 1\nimage: {tag: latest, repo: app}\n",
+		"prod.yaml":     "replicas: 3\nimage: {tag: v1}\n",
+		"prod-eu.yaml":  "_inherits: prod\nregion: eu\n",
+	})
+
+	m, err := NewValuesWriter(ValuesWriterOptions{}).values(t.Context(), dir, "prod-eu", nil, StateValues{})
+	if err != nil {
+		t.Fatalf("values() error: %v", err)
+	}
+
+	got, _ := json.Marshal(m)
+	want := `{"image":{"repo":"app","tag":"v1"},"region":"eu","replicas":3}`
+	if string(got) != want {
+		t.Errorf("values() = %s, want %s", got, want)
+	}
+}
+
+func TestValuesWriter_Nulls(t *testing.T) {
+	t.Parallel()
+	dir := writeEnvFiles(t, map[string]string{
+		"defaults.yaml": "foo: null\nreplicas: 1\nimage: {tag: null}\n",
+		"prod.yaml":     "replicas: null\nbar: null\nimage: {repo: null}\n",
+	})
+
+	m, err := NewValuesWriter(ValuesWriterOptions{}).values(t.Context(), dir, "prod", nil, StateValues{})
+	if err != nil {
+		t.Fatalf("values() error: %v", err)
+	}
+
+	// Nulls are kept for nix to check, unless they remove a value of an earlier layer.
+	got, _ := json.Marshal(m)
+	want := `{"bar":null,"foo":null,"image":{"repo":null,"tag":null}}`
+	if string(got) != want {
+		t.Errorf("values() = %s, want %s", got, want)
+	}
+}
+
+func TestLoadLayers_Order(t *testing.T) {
+	t.Parallel()
+	dir := writeEnvFiles(t, map[string]string{
+		"base.yaml":    "a: 1\n",
+		"prod.yaml":    "_inherits: base\n",
+		"prod-eu.yaml": "_inherits: prod\n",
+	})
+
+	layers, err := NewValuesWriter(ValuesWriterOptions{}).loadLayers(t.Context(), dir, "prod-eu")
+	if err != nil {
+		t.Fatalf("loadLayers() error: %v", err)
+	}
+
+	var names []string
+	for _, l := range layers {
+		names = append(names, l.name)
+	}
+	if strings.Join(names, ",") != "defaults,base,prod,prod-eu" {
+		t.Errorf("loadLayers() order = %v", names)
+	}
+}
+
+func TestLoadLayers_Errors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		files map[string]string
+		env   string
+		err   error
+		msg   string
+	}{
+		{
+			name:  "cycle",
+			files: map[string]string{"a.yaml": "_inherits: b\n", "b.yaml": "_inherits: c\n", "c.yaml": "_inherits: a\n"},
+			env:   "a",
+			err:   ErrInheritanceCycle,
+			msg:   "a -> b -> c -> a",
+		},
+		{
+			name:  "self",
+			files: map[string]string{"a.yaml": "_inherits: a\n"},
+			env:   "a",
+			err:   ErrInheritanceCycle,
+			msg:   "a -> a",
+		},
+		{
+			name:  "unknown parent",
+			files: map[string]string{"a.yaml": "_inherits: nope\n"},
+			env:   "a",
+			err:   ErrUnknownParent,
+			msg:   "a inherits from nope",
+		},
+		{
+			name:  "invalid parent",
+			files: map[string]string{"a.yaml": "_inherits: [b]\n"},
+			env:   "a",
+			err:   ErrInvalidParent,
+			msg:   "a.yaml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := NewValuesWriter(ValuesWriterOptions{}).loadLayers(t.Context(), writeEnvFiles(t, tt.files), tt.env)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("loadLayers() error = %v, want %v", err, tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("loadLayers() error %q should contain %q", err, tt.msg)
+			}
+		})
+	}
+}
+
+func TestValuesWriter_EnvFileFormats(t *testing.T) {
+	t.Parallel()
+	dir := writeEnvFiles(t, map[string]string{
+		"defaults.json": `{"replicas": 1, "image": {"repo": "app"}}`,
+		"prod.toml":     "replicas = 3\n[image]\ntag = \"v1\"\n",
+		"prod-eu.nix":   "{ env }: { _inherits = \"prod\"; region = env; }",
+	})
+	evaluator := nixeval.NewFake().Respond("prod-eu.nix", []byte(`{"_inherits":"prod","region":"prod-eu"}`))
+
+	m, err := NewValuesWriter(ValuesWriterOptions{Evaluator: evaluator}).values(t.Context(), dir, "prod-eu", nil, StateValues{})
+	if err != nil {
+		t.Fatalf("values() error: %v", err)
+	}
+
+	got, _ := json.Marshal(m)
+	want := `{"image":{"repo":"app","tag":"v1"},"region":"prod-eu","replicas":3}`
+	if string(got) != want {
+		t.Errorf("values() = %s, want %s", got, want)
+	}
+	if calls := evaluator.Calls(); len(calls) != 1 || !strings.Contains(calls[0], `env = "prod-eu"`) {
+		t.Errorf("values() should evaluate the nix env file once with the env name, got %v", calls)
+	}
+}
+
+func TestValuesWriter_NixEnvFileWithoutEvaluator(t *testing.T) {
+	t.Parallel()
+	dir := writeEnvFiles(t, map[string]string{"dev.nix": "{ }"})
+
+	_, err := NewValuesWriter(ValuesWriterOptions{}).values(t.Context(), dir, "dev", nil, StateValues{})
+	if !errors.Is(err, ErrNoEvaluator) {
+		t.Errorf("values() expected %v, got %v", ErrNoEvaluator, err)
+	}
+}
+
+func TestValuesWriter_MergeDirectives(t *testing.T) {
+	t.Parallel()
+	dir := writeEnvFiles(t, map[string]string{
+		"defaults.yaml": "_merge: {hosts: append}\nhosts: [a]\ndebug: true\n",
+		"prod.yaml":     "hosts: [b]\ndebug: null\n",
+	})
+
+	m, err := NewValuesWriter(ValuesWriterOptions{}).values(t.Context(), dir, "prod", nil, StateValues{})
+	if err != nil {
+		t.Fatalf("values() error: %v", err)
+	}
+
+	got, _ := json.Marshal(m)
+	if string(got) != `{"hosts":["a","b"]}` {
+		t.Errorf("values() = %s", got)
+	}
+
+	dir = writeEnvFiles(t, map[string]string{"prod.yaml": "_merge: {hosts: sideways}\n"})
+	_, err = NewValuesWriter(ValuesWriterOptions{}).values(t.Context(), dir, "prod", nil, StateValues{})
+	if !errors.Is(err, ErrInvalidMergeStrategy) || !strings.Contains(err.Error(), "prod.yaml") {
+		t.Errorf("values() expected %v naming the file, got %v", ErrInvalidMergeStrategy, err)
+	}
+}
@@ -0,0 +1,127 @@
+package environment
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is the optional project config next to a helmfile, setting its Layout.
+const ConfigFile = "helmfile-nix.yaml"
+
+// Defaults of the Layout fields.
+const (
+	DefaultEnvDir   = "env"
+	DefaultDefaults = "defaults"
+)
+
+// ErrInvalidConfig is returned when the project config can not be read.
+var ErrInvalidConfig = errors.New("invalid " + ConfigFile)
+
+// Layout is where the env files of a helmfile are. Paths are relative to the directory of the helmfile.
+// Empty fields keep the default, so a zero Layout is env/ with a defaults file.
+type Layout struct {
+	// Dir is the env directory.
+	Dir string `yaml:"envDir"`
+	// Defaults is the name of the defaults file, without extension.
+	Defaults string `yaml:"defaults"`
+	// Shared are env directories searched after Dir, in order, for files it does not have.
+	Shared []string `yaml:"sharedEnvDirs"`
+}
+
+// LoadLayout reads the layout from the ConfigFile in state, or returns a zero Layout if there is none.
+func LoadLayout(state string) (Layout, error) {
+	var l Layout
+	path := filepath.Join(state, ConfigFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return l, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&l); err != nil {
+		return l, fmt.Errorf("%w %s: %w", ErrInvalidConfig, path, err)
+	}
+	return l, nil
+}
+
+// Override returns l with the fields that are set in o replaced.
+func (l Layout) Override(o Layout) Layout {
+	if o.Dir != "" {
+		l.Dir = o.Dir
+	}
+	if o.Defaults != "" {
+		l.Defaults = o.Defaults
+	}
+	if len(o.Shared) > 0 {
+		l.Shared = o.Shared
+	}
+	return l
+}
+
+// envDirs is a resolved Layout.
+type envDirs struct {
+	// dirs are the absolute env directories, in the order they are searched.
+	dirs     []string
+	defaults string
+}
+
+// resolve returns the layout of the helmfile in state: its ConfigFile, overridden by l.
+func (l Layout) resolve(state string) (envDirs, error) {
+	config, err := LoadLayout(state)
+	if err != nil {
+		return envDirs{}, err
+	}
+	l = Layout{Dir: DefaultEnvDir, Defaults: DefaultDefaults}.Override(config).Override(l)
+
+	d := envDirs{defaults: l.Defaults}
+	for _, dir := range append([]string{l.Dir}, l.Shared...) {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(state, dir)
+		}
+		d.dirs = append(d.dirs, dir)
+	}
+	return d, nil
+}
+
+// find returns the env file named name in the first env directory that has one,
+// or an empty path if none has.
+func (d envDirs) find(name string) (string, error) {
+	for _, dir := range d.dirs {
+		path, err := FindEnvFile(dir, name)
+		if err != nil || path != "" {
+			return path, err
+		}
+	}
+	return "", nil
+}
+
+// findExact returns the first of the files that exists in the env directories, searched in order.
+// An env directory having several of them is an error.
+func (d envDirs) findExact(names ...string) (string, error) {
+	for _, dir := range d.dirs {
+		var found []string
+		for _, name := range names {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				found = append(found, path)
+			}
+		}
+		switch len(found) {
+		case 0:
+			continue
+		case 1:
+			return found[0], nil
+		}
+		return "", fmt.Errorf("%w: %v", ErrAmbiguousEnvFile, found)
+	}
+	return "", nil
+}
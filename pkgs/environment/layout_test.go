@@ -0,0 +1,88 @@
+package environment
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFiles writes files relative to a new directory, and returns it.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatalf("Failed to create dir for %s: %v", name, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func TestValuesWriter_SharedEnvDirs(t *testing.T) {
+	t.Parallel()
+	root := writeFiles(t, map[string]string{
+		"common-env/base.yaml":             "region: eu\nreplicas: 1\n",
+		"common-env/prod.yaml":             "replicas: 2\n",
+		"common-env/staging.yaml":          "replicas: 1\n",
+		"apps/web/" + ConfigFile:           "envDir: environments\ndefaults: base\nsharedEnvDirs: [../../common-env]\n",
+		"apps/web/environments/prod.yaml":  "replicas: 3\n",
+		"apps/web/environments/local.yaml": "replicas: 0\n",
+	})
+	state := filepath.Join(root, "apps", "web")
+	writer := NewValuesWriter(ValuesWriterOptions{})
+
+	m, err := writer.values(t.Context(), state, "prod", nil, StateValues{})
+	if err != nil {
+		t.Fatalf("values() error: %v", err)
+	}
+	got, _ := json.Marshal(m)
+	if want := `{"region":"eu","replicas":3}`; string(got) != want {
+		t.Errorf("values() = %s, want %s", got, want)
+	}
+
+	envs, err := writer.Environments(state)
+	if err != nil {
+		t.Fatalf("Environments() error: %v", err)
+	}
+	if want := []string{"local", "prod", "staging"}; !reflect.DeepEqual(envs, want) {
+		t.Errorf("Environments() = %v, want %v", envs, want)
+	}
+
+	// The flags override the config.
+	writer = NewValuesWriter(ValuesWriterOptions{Layout: Layout{Dir: "../../common-env", Shared: []string{"environments"}}})
+	m, err = writer.values(t.Context(), state, "prod", nil, StateValues{})
+	if err != nil {
+		t.Fatalf("values() error: %v", err)
+	}
+	got, _ = json.Marshal(m)
+	if want := `{"region":"eu","replicas":2}`; string(got) != want {
+		t.Errorf("values() with overridden layout = %s, want %s", got, want)
+	}
+}
+
+func TestLoadLayout(t *testing.T) {
+	t.Parallel()
+	l, err := LoadLayout(writeFiles(t, map[string]string{ConfigFile: "envDir: config/env\nsharedEnvDirs: [a, b]\n"}))
+	if err != nil {
+		t.Fatalf("LoadLayout() error: %v", err)
+	}
+	if want := (Layout{Dir: "config/env", Shared: []string{"a", "b"}}); !reflect.DeepEqual(l, want) {
+		t.Errorf("LoadLayout() = %#v, want %#v", l, want)
+	}
+
+	if l, err := LoadLayout(t.TempDir()); err != nil || !reflect.DeepEqual(l, Layout{}) {
+		t.Errorf("LoadLayout() without config = %#v, %v, want a zero layout", l, err)
+	}
+
+	_, err = LoadLayout(writeFiles(t, map[string]string{ConfigFile: "envdir: env\n"}))
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("LoadLayout() error = %v, want %v", err, ErrInvalidConfig)
+	}
+}
@@ -2,11 +2,23 @@
 package environment
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 
+	"github.com/BurntSushi/toml"
 	"gopkg.in/yaml.v3"
 )
 
+// EnvFileExtensions are the extensions env files are looked up by, in order.
+var EnvFileExtensions = []string{".yaml", ".yml", ".json", ".toml", ".nix"}
+
+// ErrAmbiguousEnvFile is returned when an environment has files with several extensions.
+var ErrAmbiguousEnvFile = errors.New("environment has more than one env file")
+
 // LoadYamlFile reads a YAML file and unmarshals it into a map[string]any.
 // If the file does not exist, it returns an empty map.
 func LoadYamlFile(path string) (map[string]any, error) {
@@ -26,3 +38,115 @@ func LoadYamlFile(path string) (map[string]any, error) {
 
 	return m, nil
 }
+
+// LoadJSONFile reads a JSON file and unmarshals it into a map[string]any.
+// Integers are int64 and other numbers float64, like LoadTOMLFile returns them.
+// If the file does not exist, it returns an empty map.
+func LoadJSONFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]any{}, nil
+		}
+
+		return nil, err
+	}
+
+	var m map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+
+	normalized, _ := normalizeJSON(m).(map[string]any)
+	return normalized, nil
+}
+
+// LoadTOMLFile reads a TOML file and unmarshals it into a map[string]any.
+// If the file does not exist, it returns an empty map.
+func LoadTOMLFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]any{}, nil
+		}
+
+		return nil, err
+	}
+
+	var m map[string]any
+	if err := toml.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	normalized, _ := normalizeTOML(m).(map[string]any)
+	return normalized, nil
+}
+
+// FindEnvFile returns the env file of the named environment in dir, or an empty path if it has none.
+func FindEnvFile(dir, name string) (string, error) {
+	var found []string
+	for _, ext := range EnvFileExtensions {
+		p := filepath.Join(dir, name+ext)
+		if _, err := os.Stat(p); err == nil {
+			found = append(found, p)
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", nil
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%w: %v", ErrAmbiguousEnvFile, found)
+}
+
+// normalizeTOML turns tables in arrays into plain lists, like the YAML decoder returns them.
+func normalizeTOML(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = normalizeTOML(e)
+		}
+		return v
+	case []map[string]any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = normalizeTOML(e)
+		}
+		return out
+	case []any:
+		for i, e := range v {
+			v[i] = normalizeTOML(e)
+		}
+		return v
+	}
+	return v
+}
+
+// normalizeJSON turns the json.Numbers of a decoded JSON value into int64 or float64.
+func normalizeJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = normalizeJSON(e)
+		}
+		return v
+	case []any:
+		for i, e := range v {
+			v[i] = normalizeJSON(e)
+		}
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
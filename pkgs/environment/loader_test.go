@@ -1,8 +1,10 @@
 package environment
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -181,3 +183,84 @@ func TestLoadYamlFile_PermissionDenied(t *testing.T) {
 		t.Error("LoadYamlFile() expected error for permission denied, got nil")
 	}
 }
+
+func TestLoadTOMLFile(t *testing.T) {
+	t.Parallel()
+	testFile := filepath.Join(t.TempDir(), "test.toml")
+	content := `
+foo = "bar"
+
+[nested]
+number = 42
+
+[[ports]]
+name = "http"
+`
+	if err := os.WriteFile(testFile, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	result, err := LoadTOMLFile(testFile)
+	if err != nil {
+		t.Fatalf("LoadTOMLFile() error: %v", err)
+	}
+
+	want := map[string]any{
+		"foo":    "bar",
+		"nested": map[string]any{"number": int64(42)},
+		"ports":  []any{map[string]any{"name": "http"}},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("LoadTOMLFile() = %#v, want %#v", result, want)
+	}
+}
+
+func TestLoadJSONFile(t *testing.T) {
+	t.Parallel()
+	testFile := filepath.Join(t.TempDir(), "test.json")
+	if err := os.WriteFile(testFile, []byte(`{"foo": "bar", "url": "https:\/\/caf\u00e9.example.com", "nested": {"number": 42, "big": 9007199254740993, "ratio": 0.5, "ports": [80]}}`), 0o600); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	result, err := LoadJSONFile(testFile)
+	if err != nil {
+		t.Fatalf("LoadJSONFile() error: %v", err)
+	}
+
+	// The big integer is not exact as a float64.
+	want := map[string]any{
+		"foo":    "bar",
+		"url":    "https://café.example.com",
+		"nested": map[string]any{"number": int64(42), "big": int64(9007199254740993), "ratio": 0.5, "ports": []any{int64(80)}},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("LoadJSONFile() = %#v, want %#v", result, want)
+	}
+}
+
+func TestFindEnvFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	for _, name := range []string{"prod.toml", "stage.yml", "dev.json", "dev.yaml"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(""), 0o600); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	for env, want := range map[string]string{"prod": "prod.toml", "stage": "stage.yml", "qa": ""} {
+		got, err := FindEnvFile(dir, env)
+		if err != nil {
+			t.Errorf("FindEnvFile(%s) error: %v", env, err)
+		}
+		if want != "" {
+			want = filepath.Join(dir, want)
+		}
+		if got != want {
+			t.Errorf("FindEnvFile(%s) = %q, want %q", env, got, want)
+		}
+	}
+
+	if _, err := FindEnvFile(dir, "dev"); !errors.Is(err, ErrAmbiguousEnvFile) {
+		t.Errorf("FindEnvFile(dev) expected %v, got %v", ErrAmbiguousEnvFile, err)
+	}
+}
@@ -0,0 +1,222 @@
+package environment
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// MergeDirectiveKey is the key of a map that sets how the lists in it are merged.
+// It maps dotted key paths, relative to the map, to a merge strategy:
+//
+//	_merge:
+//	  hosts: append
+//	  ingress.tolerations: merge-by:key
+//
+// Directives are merged like any other values, so they can be set once in the defaults.
+const MergeDirectiveKey = "_merge"
+
+// List merge strategies.
+const (
+	MergeReplace = "replace"
+	MergeAppend  = "append"
+	MergePrepend = "prepend"
+	// MergeByPrefix is followed by the key identifying list items, e.g. `merge-by:name`.
+	// Items with the same value for the key are merged, other items are appended.
+	MergeByPrefix = "merge-by:"
+)
+
+// ErrInvalidMergeStrategy is returned for a malformed _merge directive.
+var ErrInvalidMergeStrategy = errors.New("invalid merge strategy")
+
+// MergeMaps deep merges b into a, without modifying either.
+// Lists in b replace those in a, unless a _merge directive sets another strategy for them.
+// A null value in b removes the key from a, a null for a key a does not have is kept.
+func MergeMaps(a, b map[string]any) map[string]any {
+	return mergeMaps(a, b, nil)
+}
+
+func mergeMaps(a, b map[string]any, inherited map[string]string) map[string]any {
+	strategies := maps.Clone(inherited)
+	if strategies == nil {
+		strategies = map[string]string{}
+	}
+	maps.Copy(strategies, directives(a))
+	maps.Copy(strategies, directives(b))
+
+	out := make(map[string]any, len(a))
+	maps.Copy(out, a)
+	for k, v := range b {
+		switch v := v.(type) {
+		case nil:
+			// A null only removes a value merged before, otherwise it is kept.
+			if _, ok := out[k]; ok {
+				delete(out, k)
+				continue
+			}
+		case map[string]any:
+			if bv, ok := out[k].(map[string]any); ok {
+				out[k] = mergeMaps(bv, v, nested(strategies, k))
+				continue
+			}
+		case []any:
+			if bv, ok := out[k].([]any); ok {
+				out[k] = mergeLists(bv, v, strategies[k], nested(strategies, k))
+				continue
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// mergeLists merges the list b into a with strategy. items are the strategies below the list,
+// for the maps in it that are merged.
+func mergeLists(a, b []any, strategy string, items map[string]string) []any {
+	switch {
+	case strategy == MergeAppend:
+		return slices.Concat(a, b)
+	case strategy == MergePrepend:
+		return slices.Concat(b, a)
+	case strings.HasPrefix(strategy, MergeByPrefix):
+		return mergeListsBy(a, b, strings.TrimPrefix(strategy, MergeByPrefix), items)
+	}
+	return b
+}
+
+// mergeListsBy merges the maps in b into the maps in a with the same value for key,
+// with the strategies of their keys.
+func mergeListsBy(a, b []any, key string, strategies map[string]string) []any {
+	out := slices.Clone(a)
+	for _, item := range b {
+		m, ok := item.(map[string]any)
+		idx := -1
+		if ok && m[key] != nil {
+			idx = slices.IndexFunc(out, func(existing any) bool {
+				e, ok := existing.(map[string]any)
+				return ok && reflect.DeepEqual(e[key], m[key])
+			})
+		}
+		if idx < 0 {
+			out = append(out, item)
+			continue
+		}
+		base, _ := out[idx].(map[string]any)
+		out[idx] = mergeMaps(base, m, strategies)
+	}
+	return out
+}
+
+// directives returns the strategies set in the _merge directive of m.
+// Malformed entries are ignored here, see CheckMergeDirectives.
+func directives(m map[string]any) map[string]string {
+	d, ok := m[MergeDirectiveKey].(map[string]any)
+	if !ok {
+		return nil
+	}
+	out := make(map[string]string, len(d))
+	for path, s := range d {
+		if s, ok := s.(string); ok {
+			out[path] = s
+		}
+	}
+	return out
+}
+
+// nested returns the strategies below key, relative to it.
+func nested(strategies map[string]string, key string) map[string]string {
+	out := map[string]string{}
+	for path, s := range strategies {
+		if rest, ok := strings.CutPrefix(path, key+"."); ok {
+			out[rest] = s
+		}
+	}
+	return out
+}
+
+// CheckMergeDirectives returns an error for the first malformed _merge directive in m.
+func CheckMergeDirectives(m map[string]any) error {
+	return checkDirectives(m, "")
+}
+
+func checkDirectives(v any, path string) error {
+	switch v := v.(type) {
+	case map[string]any:
+		if d, ok := v[MergeDirectiveKey]; ok {
+			if err := checkDirective(d, joinKey(path, MergeDirectiveKey)); err != nil {
+				return err
+			}
+		}
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			if k == MergeDirectiveKey {
+				continue
+			}
+			if err := checkDirectives(v[k], joinKey(path, k)); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for i, e := range v {
+			if err := checkDirectives(e, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkDirective(d any, path string) error {
+	if d == nil {
+		return nil
+	}
+	m, ok := d.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%w: %s must map key paths to strategies, got %T", ErrInvalidMergeStrategy, path, d)
+	}
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		s, ok := m[k].(string)
+		valid := ok && (s == MergeReplace || s == MergeAppend || s == MergePrepend ||
+			(strings.HasPrefix(s, MergeByPrefix) && len(s) > len(MergeByPrefix)))
+		if m[k] != nil && !valid {
+			return fmt.Errorf("%w: %s.%s is %v, expected %s, %s, %s or %s<key>", ErrInvalidMergeStrategy,
+				path, k, m[k], MergeReplace, MergeAppend, MergePrepend, MergeByPrefix)
+		}
+	}
+	return nil
+}
+
+// WithoutMergeDirectives returns a copy of m without any _merge directives.
+func WithoutMergeDirectives(m map[string]any) map[string]any {
+	out, _ := withoutDirectives(m).(map[string]any)
+	return out
+}
+
+func withoutDirectives(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			if k != MergeDirectiveKey {
+				out[k] = withoutDirectives(e)
+			}
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = withoutDirectives(e)
+		}
+		return out
+	}
+	return v
+}
+
+func joinKey(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,296 @@
+package environment
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func yamlMap(t *testing.T, doc string) map[string]any {
+	t.Helper()
+	var m map[string]any
+	if err := yaml.Unmarshal([]byte(doc), &m); err != nil {
+		t.Fatalf("Failed to decode %q: %v", doc, err)
+	}
+	return m
+}
+
+func TestMergeMaps_ListStrategies(t *testing.T) {
+	t.Parallel()
+	base := `
+_merge:
+  ingress.hosts: append
+hosts: [a]
+ingress:
+  hosts: [a.example.com]
+tolerations:
+  - {key: dedicated, value: web}
+  - {key: spot, effect: NoSchedule}
+`
+	tests := []struct {
+		name     string
+		override string
+		path     []string
+		expected string
+	}{
+		{
+			name:     "replace by default",
+			override: "hosts: [b]",
+			path:     []string{"hosts"},
+			expected: "[b]",
+		},
+		{
+			name:     "append from base directive",
+			override: "ingress: {hosts: [b.example.com]}",
+			path:     []string{"ingress", "hosts"},
+			expected: "[a.example.com, b.example.com]",
+		},
+		{
+			name:     "override directive",
+			override: "_merge: {ingress.hosts: replace}\ningress: {hosts: [b.example.com]}",
+			path:     []string{"ingress", "hosts"},
+			expected: "[b.example.com]",
+		},
+		{
+			name:     "nested directive",
+			override: "ingress: {_merge: {hosts: prepend}, hosts: [b.example.com]}",
+			path:     []string{"ingress", "hosts"},
+			expected: "[b.example.com, a.example.com]",
+		},
+		{
+			name:     "merge by key",
+			override: "_merge: {tolerations: 'merge-by:key'}\ntolerations: [{key: spot, effect: NoExecute}, {key: gpu}]",
+			path:     []string{"tolerations"},
+			expected: "[{key: dedicated, value: web}, {key: spot, effect: NoExecute}, {key: gpu}]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var got any = MergeMaps(yamlMap(t, base), yamlMap(t, tt.override))
+			for _, k := range tt.path {
+				got = got.(map[string]any)[k]
+			}
+			want := yamlMap(t, "v: "+tt.expected)["v"]
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("MergeMaps() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMergeMaps_MergeByNested(t *testing.T) {
+	t.Parallel()
+	base := yamlMap(t, `
+_merge:
+  containers: merge-by:name
+  containers.env: append
+containers:
+  - name: app
+    env: [{name: A}]
+    ports: [80]
+`)
+	override := yamlMap(t, `
+containers:
+  - name: app
+    env: [{name: B}]
+    _merge: {ports: prepend}
+    ports: [8080]
+`)
+
+	got := WithoutMergeDirectives(MergeMaps(base, override))
+	want := yamlMap(t, "containers: [{name: app, env: [{name: A}, {name: B}], ports: [8080, 80]}]")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeMaps() = %v, want %v", got, want)
+	}
+}
+
+func TestMergeMaps_NullDeletes(t *testing.T) {
+	t.Parallel()
+	a := yamlMap(t, "keep: 1\ndrop: 2\nnested: {keep: 1, drop: 2}")
+	b := yamlMap(t, "drop: null\nnested: {drop: ~, unset: null}\nunset: null")
+
+	got := MergeMaps(a, b)
+	want := yamlMap(t, "keep: 1\nnested: {keep: 1, unset: null}\nunset: null")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeMaps() = %v, want %v", got, want)
+	}
+	if _, ok := a["drop"]; !ok {
+		t.Error("MergeMaps() must not modify its arguments")
+	}
+}
+
+func TestCheckMergeDirectives(t *testing.T) {
+	t.Parallel()
+	valid := yamlMap(t, "_merge: {a: append, b: prepend, c: replace, d: 'merge-by:name', e: null}\nx: [{_merge: {y: append}}]")
+	if err := CheckMergeDirectives(valid); err != nil {
+		t.Errorf("CheckMergeDirectives() unexpected error: %v", err)
+	}
+
+	for _, doc := range []string{
+		"_merge: [a]",
+		"_merge: {a: sideways}",
+		"_merge: {a: 'merge-by:'}",
+		"x: [{_merge: {y: 1}}]",
+	} {
+		if err := CheckMergeDirectives(yamlMap(t, doc)); !errors.Is(err, ErrInvalidMergeStrategy) {
+			t.Errorf("CheckMergeDirectives(%q) expected %v, got %v", doc, ErrInvalidMergeStrategy, err)
+		}
+	}
+}
+
+func TestWithoutMergeDirectives(t *testing.T) {
+	t.Parallel()
+	m := yamlMap(t, "_merge: {a: append}\na: [{_merge: {b: append}, b: [1]}]")
+
+	got := WithoutMergeDirectives(m)
+	want := yamlMap(t, "a: [{b: [1]}]")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WithoutMergeDirectives() = %v, want %v", got, want)
+	}
+	if _, ok := m[MergeDirectiveKey]; !ok {
+		t.Error("WithoutMergeDirectives() must not modify its argument")
+	}
+}
+
+func TestMergeMaps(t *testing.T) {
+	t.Parallel()
+	a := map[string]any{"a": 1, "b": map[string]any{"x": 1}}
+	b := map[string]any{"b": map[string]any{"y": 2}, "c": 3}
+	expected := map[string]any{
+		"a": 1,
+		"b": map[string]any{"x": 1, "y": 2},
+		"c": 3,
+	}
+	got := MergeMaps(a, b)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("MergeMaps(a, b) = %#v, want %#v", got, expected)
+	}
+}
+
+func TestMergeMaps_EmptyMaps(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		a        map[string]any
+		b        map[string]any
+		expected map[string]any
+	}{
+		{
+			name:     "both empty",
+			a:        map[string]any{},
+			b:        map[string]any{},
+			expected: map[string]any{},
+		},
+		{
+			name:     "first empty",
+			a:        map[string]any{},
+			b:        map[string]any{"key": "value"},
+			expected: map[string]any{"key": "value"},
+		},
+		{
+			name:     "second empty",
+			a:        map[string]any{"key": "value"},
+			b:        map[string]any{},
+			expected: map[string]any{"key": "value"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got := MergeMaps(tt.a, tt.b)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("MergeMaps() = %#v, want %#v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMergeMaps_NestedConflict(t *testing.T) {
+	t.Parallel()
+	// Test when both maps have nested structures at same key
+	a := map[string]any{
+		"nested": map[string]any{
+			"a": 1,
+			"shared": map[string]any{
+				"x": "original",
+			},
+		},
+	}
+	b := map[string]any{
+		"nested": map[string]any{
+			"b": 2,
+			"shared": map[string]any{
+				"y": "new",
+			},
+		},
+	}
+	expected := map[string]any{
+		"nested": map[string]any{
+			"a": 1,
+			"b": 2,
+			"shared": map[string]any{
+				"x": "original",
+				"y": "new",
+			},
+		},
+	}
+
+	got := MergeMaps(a, b)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("MergeMaps() = %#v, want %#v", got, expected)
+	}
+}
+
+func TestMergeMaps_ValueOverwrite(t *testing.T) {
+	t.Parallel()
+	// Test that b's values overwrite a's values
+	a := map[string]any{"key": "original"}
+	b := map[string]any{"key": "overwritten"}
+	expected := map[string]any{"key": "overwritten"}
+
+	got := MergeMaps(a, b)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("MergeMaps() = %#v, want %#v", got, expected)
+	}
+}
+
+func TestMergeMaps_DeepNesting(t *testing.T) {
+	t.Parallel()
+	a := map[string]any{
+		"level1": map[string]any{
+			"level2": map[string]any{
+				"level3": map[string]any{
+					"level4": "deep-a",
+				},
+			},
+		},
+	}
+	b := map[string]any{
+		"level1": map[string]any{
+			"level2": map[string]any{
+				"level3": map[string]any{
+					"level4-new": "deep-b",
+				},
+			},
+		},
+	}
+	expected := map[string]any{
+		"level1": map[string]any{
+			"level2": map[string]any{
+				"level3": map[string]any{
+					"level4":     "deep-a",
+					"level4-new": "deep-b",
+				},
+			},
+		},
+	}
+
+	got := MergeMaps(a, b)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("MergeMaps() deep nesting = %#v, want %#v", got, expected)
+	}
+}
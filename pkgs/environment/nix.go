@@ -0,0 +1,43 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/cache"
+)
+
+// Static errors for nix env files.
+var (
+	ErrNoEvaluator = errors.New("nix env files need an evaluator")
+	ErrNotAttrset  = errors.New("nix env file must evaluate to an attrset")
+)
+
+// loadNixFile evaluates a nix env file. It must be an attrset, or a function taking `{ env, ... }`.
+func (w *ValuesWriter) loadNixFile(ctx context.Context, path, env string) (map[string]any, error) {
+	if w.evaluator == nil {
+		return nil, ErrNoEvaluator
+	}
+
+	expr := fmt.Sprintf(`let v = import %s; in if builtins.isFunction v then v { env = %s; } else v`, strconv.Quote(path), strconv.Quote(env))
+	out, err := w.cache.Eval(ctx, w.evaluator, expr, false, func(k *cache.Key) error {
+		k.AddString("env", env)
+		return k.AddNixClosure(path)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]any
+	if err := yaml.Unmarshal(out, &m); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotAttrset, err)
+	}
+	if m == nil {
+		return map[string]any{}, nil
+	}
+	return m, nil
+}
@@ -0,0 +1,111 @@
+package environment
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// source is a set of values merged into the environment values, and where they came from.
+type source struct {
+	// origin is the file the values came from, or the flag that set them.
+	origin string
+	values map[string]any
+	// key is set when the values of the file are under this key, like secrets.
+	key string
+}
+
+// originOf returns where the value at path came from, see sourceOf.
+// Returns an empty string for the values themselves, which every source has.
+// state is used to shorten the paths of files in it.
+func originOf(sources []source, path []any, state string) string {
+	if src, _, ok := sourceOf(sources, path); ok {
+		return relOrigin(src.origin, state)
+	}
+	return ""
+}
+
+// sourceOf returns the last source that has the value at path, and the path it has.
+// If no source has it, like a value a merge directive removed, the closest parent that one has is used.
+func sourceOf(sources []source, path []any) (source, []any, bool) {
+	for n := len(path); n > 0; n-- {
+		for i := len(sources) - 1; i >= 0; i-- {
+			if _, ok := lookup(sources[i].values, path[:n]); ok && sources[i].origin != "" {
+				return sources[i], path[:n], true
+			}
+		}
+	}
+	return source{}, nil, false
+}
+
+func relOrigin(origin, state string) string {
+	if !filepath.IsAbs(origin) {
+		return origin
+	}
+	if rel, err := filepath.Rel(state, origin); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return origin
+}
+
+// lookup returns the value at path in v, where path has string keys and int list indices.
+func lookup(v any, path []any) (any, bool) {
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if v, ok = m[p]; !ok {
+				return nil, false
+			}
+		case int:
+			l, ok := v.([]any)
+			if !ok || p >= len(l) {
+				return nil, false
+			}
+			v = l[p]
+		}
+	}
+	return v, true
+}
+
+// splitPath splits a path like `a."b.c"[0].d`, as written by schema.JoinPath,
+// into string keys and int list indices.
+func splitPath(path string) []any {
+	var out []any
+	for path != "" {
+		switch {
+		case path[0] == '.':
+			path = path[1:]
+		case path[0] == '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return append(out, path)
+			}
+			i, err := strconv.Atoi(path[1:end])
+			if err != nil {
+				return append(out, path)
+			}
+			out = append(out, i)
+			path = path[end+1:]
+		case path[0] == '"':
+			quoted, err := strconv.QuotedPrefix(path)
+			if err != nil {
+				return append(out, path)
+			}
+			key, _ := strconv.Unquote(quoted)
+			out = append(out, key)
+			path = path[len(quoted):]
+		default:
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			out = append(out, path[:end])
+			path = path[end:]
+		}
+	}
+	return out
+}
@@ -0,0 +1,51 @@
+package environment
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitPath(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		path string
+		want []any
+	}{
+		{"", nil},
+		{"a", []any{"a"}},
+		{"a.b[0].c", []any{"a", "b", 0, "c"}},
+		{`a."b.c"[1][2]`, []any{"a", "b.c", 1, 2}},
+	}
+
+	for _, tt := range tests {
+		if got := splitPath(tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitPath(%q) = %#v, want %#v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestOriginOf(t *testing.T) {
+	t.Parallel()
+	sources := []source{
+		{origin: "/state/env/defaults.yaml", values: map[string]any{"a": map[string]any{"b": 1, "c": []any{1}}}},
+		{origin: "/state/env/dev.yaml", values: map[string]any{"a": map[string]any{"b": 2}}},
+		{origin: "/elsewhere/values.yaml", values: map[string]any{"d": true}},
+	}
+
+	tests := []struct {
+		path []any
+		want string
+	}{
+		{[]any{"a", "b"}, "env/dev.yaml"},
+		{[]any{"a", "c", 0}, "env/defaults.yaml"},
+		{[]any{"a", "missing"}, "env/dev.yaml"},
+		{[]any{"d"}, "/elsewhere/values.yaml"},
+		{nil, ""},
+	}
+
+	for _, tt := range tests {
+		if got := originOf(sources, tt.path, "/state"); got != tt.want {
+			t.Errorf("originOf(%v) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
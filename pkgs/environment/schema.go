@@ -0,0 +1,81 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/schema"
+)
+
+// SchemaName is the name of the optional schema for the values in the env directories,
+// either schema.json or schema.nix.
+const SchemaName = "schema"
+
+// ErrInvalidValues is returned when the values of an environment do not match its schema.
+var ErrInvalidValues = errors.New("values do not match the schema")
+
+// loadSchema loads the schema from the first env directory that has one, or returns nil if there is none.
+// A nix schema can be a function taking `{ env, ... }`, like nix env files.
+func (w *ValuesWriter) loadSchema(ctx context.Context, state, env string) (*schema.Schema, string, error) {
+	dirs, err := w.layout.resolve(state)
+	if err != nil {
+		return nil, "", err
+	}
+	path, err := dirs.findExact(SchemaName+".json", SchemaName+".nix")
+	if err != nil || path == "" {
+		return nil, "", err
+	}
+
+	var data []byte
+	if filepath.Ext(path) == ".nix" {
+		var m map[string]any
+		m, err = w.loadNixFile(ctx, path, env)
+		if err == nil {
+			data, err = json.Marshal(m)
+		}
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("could not load %s: %w", path, err)
+	}
+
+	s, err := schema.Parse(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not load %s: %w", path, err)
+	}
+	return s, path, nil
+}
+
+// validate checks the values of env against its schema, if it has one.
+// Each finding names the file, or the flag, the offending value came from.
+// Findings on the values themselves are attributed to envFile, the file of the environment.
+func (w *ValuesWriter) validate(ctx context.Context, state, env, envFile string, values map[string]any, sources []source) error {
+	s, path, err := w.loadSchema(ctx, state, env)
+	if err != nil || s == nil {
+		return err
+	}
+
+	findings := s.Validate(values)
+	if len(findings) == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	for _, f := range findings {
+		origin := originOf(sources, splitPath(f.Path), state)
+		if origin == "" && envFile != "" {
+			origin = relOrigin(envFile, state)
+		}
+		b.WriteString("\n  " + f.String())
+		if origin != "" {
+			b.WriteString(" (from " + origin + ")")
+		}
+	}
+	return fmt.Errorf("environment %s: %w in %s:%s", env, ErrInvalidValues, relOrigin(path, state), b.String())
+}
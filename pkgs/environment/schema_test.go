@@ -0,0 +1,87 @@
+package environment
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
+	"github.com/reMarkable/helmfile-nix/pkgs/schema"
+)
+
+const testSchema = `{
+  "type": "object",
+  "required": ["region", "image"],
+  "properties": {
+    "region": {"type": "string"},
+    "replicas": {"type": "integer", "minimum": 1},
+    "image": {
+      "type": "object",
+      "required": ["tag"],
+      "properties": {"repo": {"type": "string"}, "tag": {"type": "string"}}
+    }
+  }
+}`
+
+func TestValuesWriter_Schema(t *testing.T) {
+	t.Parallel()
+	dir := writeEnvFiles(t, map[string]string{
+		"schema.json":   testSchema,
+		"defaults.yaml": "replicas: 1\nimage: {repo: app}\n",
+		"prod.yaml":     "region: eu\nimage: {tag: v1}\n",
+		"dev.yaml":      "image: {repo: dev}\n",
+	})
+	writer := NewValuesWriter(ValuesWriterOptions{})
+
+	if _, err := writer.values(t.Context(), dir, "prod", nil, StateValues{}); err != nil {
+		t.Errorf("values() error for valid values: %v", err)
+	}
+
+	_, err := writer.values(t.Context(), dir, "dev", nil, StateValues{Set: []string{"replicas=0"}})
+	if !errors.Is(err, ErrInvalidValues) {
+		t.Fatalf("values() error = %v, want %v", err, ErrInvalidValues)
+	}
+	want := `environment dev: values do not match the schema in env/schema.json:
+  missing required field "region" (from env/dev.yaml)
+  image: missing required field "tag" (from env/dev.yaml)
+  replicas: must be at least 1 (from --state-values-set replicas=0)`
+	if err.Error() != want {
+		t.Errorf("values() error =\n%s\nwant\n%s", err, want)
+	}
+}
+
+func TestValuesWriter_Schema_Nix(t *testing.T) {
+	t.Parallel()
+	dir := writeEnvFiles(t, map[string]string{
+		"schema.nix": "{ env }: { }",
+		"dev.yaml":   "replicas: two\n",
+	})
+	evaluator := nixeval.NewFake().Respond("schema.nix", []byte(`{"properties":{"replicas":{"type":"integer"}}}`))
+
+	_, err := NewValuesWriter(ValuesWriterOptions{Evaluator: evaluator}).values(t.Context(), dir, "dev", nil, StateValues{})
+	if !errors.Is(err, ErrInvalidValues) || !strings.Contains(err.Error(), "replicas: expected integer, got string (from env/dev.yaml)") {
+		t.Errorf("values() error = %v, want the replicas from env/dev.yaml to be invalid", err)
+	}
+}
+
+func TestValuesWriter_Schema_Errors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr error
+	}{
+		{"invalid schema", map[string]string{"schema.json": `{"type": "object", "pattern": "("}`}, schema.ErrInvalidSchema},
+		{"ambiguous", map[string]string{"schema.json": "{}", "schema.nix": "{ }"}, ErrAmbiguousEnvFile},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := NewValuesWriter(ValuesWriterOptions{}).values(t.Context(), writeEnvFiles(t, tt.files), "dev", nil, StateValues{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("values() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
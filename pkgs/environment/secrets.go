@@ -0,0 +1,118 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/sops"
+)
+
+// SecretsKey is the key the decrypted secrets are merged under in the values.
+const SecretsKey = "secrets"
+
+// ErrSecrets is returned when a secrets file can not be decrypted.
+var ErrSecrets = errors.New("could not decrypt secrets")
+
+// Secrets returns the decrypted secrets of env, or nil if it has none.
+// Like the env files, the secrets of defaults and every environment env inherits from are merged first.
+func (w *ValuesWriter) Secrets(ctx context.Context, state, env string) (map[string]any, error) {
+	layers, err := w.loadLayers(ctx, state, env)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := w.loadSecrets(state, layers)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets map[string]any
+	for _, s := range sources {
+		secrets = MergeMaps(secrets, s.values[SecretsKey].(map[string]any))
+	}
+	return secrets, nil
+}
+
+// loadSecrets decrypts the secrets files of the layers, in order.
+// The secrets are under SecretsKey in the sources, ready to merge into the values.
+func (w *ValuesWriter) loadSecrets(state string, layers []layer) ([]source, error) {
+	paths, err := w.secretsFiles(state, layers)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make([]source, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s: %w", ErrSecrets, path, err)
+		}
+
+		identities, err := w.identities()
+		if err != nil {
+			return nil, fmt.Errorf("%w %s: %w", ErrSecrets, path, err)
+		}
+		values, err := sops.Decrypt(data, identities)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s: %w", ErrSecrets, path, err)
+		}
+		sources = append(sources, source{origin: path, values: map[string]any{SecretsKey: values}, key: SecretsKey})
+	}
+	return sources, nil
+}
+
+// secretsFiles returns secrets/<name>.yaml in the env directories for each layer that has one, in order.
+func (w *ValuesWriter) secretsFiles(state string, layers []layer) ([]string, error) {
+	dirs, err := w.layout.resolve(state)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, l := range layers {
+		path, err := dirs.findExact(filepath.Join("secrets", l.name+".yaml"))
+		if err != nil {
+			return nil, err
+		}
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// SecretStrings returns the scalar values in secrets as strings, longest first, for redacting them.
+// Numbers and booleans are included, as sops keeps their types.
+func SecretStrings(secrets map[string]any) []string {
+	var out []string
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for _, c := range v {
+				walk(c)
+			}
+		case []any:
+			for _, c := range v {
+				walk(c)
+			}
+		case nil:
+		default:
+			if s := fmt.Sprint(v); s != "" && !slices.Contains(out, s) {
+				out = append(out, s)
+			}
+		}
+	}
+	walk(secrets)
+	sort.Slice(out, func(i, j int) bool {
+		if len(out[i]) != len(out[j]) {
+			return len(out[i]) > len(out[j])
+		}
+		return out[i] < out[j]
+	})
+	return out
+}
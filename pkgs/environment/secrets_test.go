@@ -0,0 +1,74 @@
+package environment
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/sops"
+)
+
+var (
+	secretsTestData = filepath.Join("..", "..", "testData", "helm-secrets")
+	secretsKeyFile  = filepath.Join(secretsTestData, "keys.txt")
+)
+
+func TestValuesWriter_Secrets(t *testing.T) {
+	t.Parallel()
+	m, err := NewValuesWriter(ValuesWriterOptions{AgeKeyFile: secretsKeyFile}).values(t.Context(), secretsTestData, "dev", nil, StateValues{})
+	if err != nil {
+		t.Fatalf("values() error: %v", err)
+	}
+
+	got, _ := json.Marshal(m)
+	want := `{"replicas":2,"secrets":{"apiToken":"dev-token","db":{"password":"dev-password","user":"app"}}}`
+	if string(got) != want {
+		t.Errorf("values() = %s, want %s", got, want)
+	}
+}
+
+func TestValuesWriter_Secrets_DefaultsOnly(t *testing.T) {
+	t.Parallel()
+	secrets, err := NewValuesWriter(ValuesWriterOptions{AgeKeyFile: secretsKeyFile}).Secrets(t.Context(), secretsTestData, "prod")
+	if err != nil {
+		t.Fatalf("Secrets() error: %v", err)
+	}
+
+	want := map[string]any{"db": map[string]any{"user": "app", "password": "default-password"}}
+	if !reflect.DeepEqual(secrets, want) {
+		t.Errorf("Secrets() = %#v, want %#v", secrets, want)
+	}
+}
+
+func TestValuesWriter_Secrets_None(t *testing.T) {
+	t.Parallel()
+	// Without secrets no key is needed.
+	secrets, err := NewValuesWriter(ValuesWriterOptions{AgeKeyFile: filepath.Join(t.TempDir(), "missing.txt")}).Secrets(t.Context(), filepath.Join("..", "..", "testData", "helm"), "dev")
+	if err != nil || secrets != nil {
+		t.Errorf("Secrets() = %#v, %v, want no secrets", secrets, err)
+	}
+}
+
+func TestValuesWriter_Secrets_MissingKey(t *testing.T) {
+	t.Parallel()
+	_, err := NewValuesWriter(ValuesWriterOptions{AgeKeyFile: filepath.Join(t.TempDir(), "missing.txt")}).Secrets(t.Context(), secretsTestData, "dev")
+	if !errors.Is(err, ErrSecrets) || !errors.Is(err, sops.ErrNoIdentities) {
+		t.Errorf("Secrets() error = %v, want %v and %v", err, ErrSecrets, sops.ErrNoIdentities)
+	}
+}
+
+func TestSecretStrings(t *testing.T) {
+	t.Parallel()
+	got := SecretStrings(map[string]any{
+		"a": "short",
+		"b": map[string]any{"c": []any{"the longest", 5432, "", nil}},
+		"d": map[string]any{"ratio": 0.25, "enabled": true, "again": "short"},
+	})
+	// Numbers and booleans are decrypted with their types, but still secrets.
+	want := []string{"the longest", "short", "0.25", "5432", "true"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SecretStrings() = %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,273 @@
+package environment
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidStateValue is returned when a state value has invalid format.
+	ErrInvalidStateValue = errors.New("invalid state value")
+	// ErrNestedKeyNotList is returned when an indexed key is not a list.
+	ErrNestedKeyNotList = errors.New("nested key is not a list")
+	// ErrNestedKeyNotMap is returned when a nested key is not a map.
+	ErrNestedKeyNotMap = errors.New("nested key is not a map")
+)
+
+// maxListIndex guards against a typo like a[1000000000] allocating a huge list.
+const maxListIndex = 65536
+
+// pathElem is one step of a state value key, either a map key or a list index.
+type pathElem struct {
+	key     string
+	index   int
+	isIndex bool
+	// column is where the element starts in the argument, counting from 1.
+	column int
+}
+
+type assignment struct {
+	path  []pathElem
+	value any
+}
+
+// setParser parses one --state-values-set argument, with the same syntax as helm's --set:
+// `a.b[0].c=x,d={1,2}`, where a backslash escapes the next character.
+type setParser struct {
+	arg []rune
+	pos int
+	// typed turns true, false, null and integers into the matching types, like --state-values-set.
+	// Otherwise every value is a string, like --state-values-set-string.
+	typed bool
+}
+
+// applySet sets the values in a state values argument in m.
+// A null value removes the key.
+func applySet(m map[string]any, arg string, typed bool) error {
+	p := &setParser{arg: []rune(arg), typed: typed}
+	assignments, err := p.parse()
+	if err != nil {
+		return err
+	}
+	for _, a := range assignments {
+		if _, err := p.set(m, 0, a.path, a.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *setParser) parse() ([]assignment, error) {
+	var assignments []assignment
+	for p.pos < len(p.arg) {
+		a, err := p.assignment()
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, a)
+	}
+	return assignments, nil
+}
+
+func (p *setParser) assignment() (assignment, error) {
+	var a assignment
+	for {
+		column := p.pos + 1
+		key, err := p.text("=.[,")
+		if err != nil {
+			return a, err
+		}
+		if key == "" {
+			return a, p.errorf(column, "empty key")
+		}
+		a.path = append(a.path, pathElem{key: key, column: column})
+
+		for p.peek() == '[' {
+			elem, err := p.index()
+			if err != nil {
+				return a, err
+			}
+			a.path = append(a.path, elem)
+		}
+
+		switch p.peek() {
+		case '.':
+			p.pos++
+		case '=':
+			p.pos++
+			a.value, err = p.value()
+			return a, err
+		default:
+			return a, p.errorf(p.pos+1, "expected '=' after key")
+		}
+	}
+}
+
+// index parses a list index like [0].
+func (p *setParser) index() (pathElem, error) {
+	column := p.pos + 1
+	p.pos++
+	start := p.pos
+	for p.pos < len(p.arg) && p.arg[p.pos] >= '0' && p.arg[p.pos] <= '9' {
+		p.pos++
+	}
+	if p.pos == len(p.arg) {
+		return pathElem{}, p.errorf(column, "unclosed '['")
+	}
+	if p.arg[p.pos] != ']' || p.pos == start {
+		return pathElem{}, p.errorf(p.pos+1, "expected a list index")
+	}
+	i, err := strconv.Atoi(string(p.arg[start:p.pos]))
+	if err != nil || i > maxListIndex {
+		return pathElem{}, p.errorf(start+1, "list index is larger than %d", maxListIndex)
+	}
+	p.pos++
+	return pathElem{index: i, isIndex: true, column: column}, nil
+}
+
+// value parses the value after '=', and the ',' ending it.
+func (p *setParser) value() (any, error) {
+	if p.peek() != '{' {
+		s, err := p.text(",")
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() == ',' {
+			p.pos++
+		}
+		return p.convert(s), nil
+	}
+
+	column := p.pos + 1
+	p.pos++
+	list := []any{}
+	for p.peek() != '}' {
+		s, err := p.text(",}")
+		if err != nil {
+			return nil, err
+		}
+		if p.pos == len(p.arg) {
+			return nil, p.errorf(column, "unclosed '{'")
+		}
+		list = append(list, p.convert(s))
+		if p.arg[p.pos] == ',' {
+			p.pos++
+		}
+	}
+	p.pos++
+	switch p.peek() {
+	case ',':
+		p.pos++
+	case 0:
+	default:
+		return nil, p.errorf(p.pos+1, "expected ',' after '}'")
+	}
+	return list, nil
+}
+
+// text reads until one of the unescaped stop characters or the end.
+func (p *setParser) text(stop string) (string, error) {
+	var b strings.Builder
+	for ; p.pos < len(p.arg); p.pos++ {
+		r := p.arg[p.pos]
+		if r == '\\' {
+			if p.pos+1 == len(p.arg) {
+				return "", p.errorf(p.pos+1, "nothing to escape after '\\'")
+			}
+			p.pos++
+			b.WriteRune(p.arg[p.pos])
+			continue
+		}
+		if strings.ContainsRune(stop, r) {
+			break
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), nil
+}
+
+// peek returns the current character, or 0 at the end.
+func (p *setParser) peek() rune {
+	if p.pos < len(p.arg) {
+		return p.arg[p.pos]
+	}
+	return 0
+}
+
+// convert types a value the way helm does for --set.
+func (p *setParser) convert(s string) any {
+	if !p.typed {
+		return s
+	}
+	switch strings.ToLower(s) {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+	// Leading zeros, like in a zip code, keep it a string.
+	if s == "0" || s != "" && s[0] != '0' {
+		if i, err := strconv.Atoi(s); err == nil {
+			return i
+		}
+	}
+	return s
+}
+
+// set sets value at path in container, which is created if it is nil, and returns it.
+// The column is that of the key or index holding container, for errors.
+func (p *setParser) set(container any, column int, path []pathElem, value any) (any, error) {
+	elem := path[0]
+	if elem.isIndex {
+		if container == nil {
+			container = []any{}
+		}
+		list, ok := container.([]any)
+		if !ok {
+			return nil, p.errorf(column, "%w", ErrNestedKeyNotList)
+		}
+		for len(list) <= elem.index {
+			list = append(list, nil)
+		}
+		if len(path) == 1 {
+			list[elem.index] = value
+			return list, nil
+		}
+		v, err := p.set(list[elem.index], elem.column, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		list[elem.index] = v
+		return list, nil
+	}
+
+	if container == nil {
+		container = map[string]any{}
+	}
+	m, ok := container.(map[string]any)
+	if !ok {
+		return nil, p.errorf(column, "%w", ErrNestedKeyNotMap)
+	}
+	if len(path) == 1 {
+		if value == nil {
+			delete(m, elem.key)
+		} else {
+			m[elem.key] = value
+		}
+		return m, nil
+	}
+	v, err := p.set(m[elem.key], elem.column, path[1:], value)
+	if err != nil {
+		return nil, err
+	}
+	m[elem.key] = v
+	return m, nil
+}
+
+func (p *setParser) errorf(column int, format string, args ...any) error {
+	return fmt.Errorf("%w %q at column %d: %w", ErrInvalidStateValue, string(p.arg), column, fmt.Errorf(format, args...))
+}
@@ -0,0 +1,115 @@
+package environment
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestApplySet(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		arg   string
+		typed bool
+		want  string
+	}{
+		{"a=1,b=true,c=null,d=text", true, `{"a":1,"b":true,"d":"text"}`},
+		{"a=1,b=true", false, `{"a":"1","b":"true"}`},
+		{"zip=0123,zero=0,neg=-5,float=1.5", true, `{"float":"1.5","neg":-5,"zero":0,"zip":"0123"}`},
+		{"url=https://example.com/?a=b", true, `{"url":"https://example.com/?a=b"}`},
+		{`selector=app=web\,tier=front`, true, `{"selector":"app=web,tier=front"}`},
+		{`dotted\.key=x,back\\slash=y`, true, `{"back\\slash":"y","dotted.key":"x"}`},
+		{"a.b[0].c=x,a.b[2]=y", true, `{"a":{"b":[{"c":"x"},null,"y"]}}`},
+		{"m[1][0]=x", true, `{"m":[null,["x"]]}`},
+		{"list={1,two,\\,},x=y", true, `{"list":[1,"two",","],"x":"y"}`},
+		{"list={}", true, `{"list":[]}`},
+		{"empty=", true, `{"empty":""}`},
+		{"a=1,", true, `{"a":1}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			t.Parallel()
+			m := map[string]any{}
+			if err := applySet(m, tt.arg, tt.typed); err != nil {
+				t.Fatalf("applySet(%q) error: %v", tt.arg, err)
+			}
+			got, _ := json.Marshal(m)
+			if string(got) != tt.want {
+				t.Errorf("applySet(%q) = %s, want %s", tt.arg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplySet_Existing(t *testing.T) {
+	t.Parallel()
+	m := map[string]any{
+		"hosts": []any{"a", "b"},
+		"image": map[string]any{"repo": "app", "tag": "v1"},
+	}
+	if err := applySet(m, "hosts[1]=c,image.tag=v2,image.repo=null", true); err != nil {
+		t.Fatalf("applySet() error: %v", err)
+	}
+
+	got, _ := json.Marshal(m)
+	want := `{"hosts":["a","c"],"image":{"tag":"v2"}}`
+	if string(got) != want {
+		t.Errorf("applySet() = %s, want %s", got, want)
+	}
+}
+
+func TestApplySet_Errors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		arg     string
+		wantErr error
+		want    string
+	}{
+		{"novalue", ErrInvalidStateValue, "at column 8: expected '=' after key"},
+		{"a=1,b", ErrInvalidStateValue, "at column 6: expected '=' after key"},
+		{"=x", ErrInvalidStateValue, "at column 1: empty key"},
+		{"a..b=x", ErrInvalidStateValue, "at column 3: empty key"},
+		{"a=1,,b=2", ErrInvalidStateValue, "at column 5: empty key"},
+		{"a[x]=1", ErrInvalidStateValue, "at column 3: expected a list index"},
+		{"a[]=1", ErrInvalidStateValue, "at column 3: expected a list index"},
+		{"a[0=1", ErrInvalidStateValue, "at column 4: expected a list index"},
+		{"a[0", ErrInvalidStateValue, "at column 2: unclosed '['"},
+		{"a[99999999]=1", ErrInvalidStateValue, "at column 3: list index is larger than 65536"},
+		{"a={1,2", ErrInvalidStateValue, "at column 3: unclosed '{'"},
+		{"a={1}b", ErrInvalidStateValue, "at column 6: expected ',' after '}'"},
+		{`a=x\`, ErrInvalidStateValue, `at column 4: nothing to escape after '\'`},
+		{"str.key=x", ErrNestedKeyNotMap, "at column 1: nested key is not a map"},
+		{"obj.str[0]=x", ErrNestedKeyNotList, "at column 5: nested key is not a list"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			t.Parallel()
+			m := map[string]any{"str": "s", "obj": map[string]any{"str": "s"}}
+			err := applySet(m, tt.arg, true)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("applySet(%q) error = %v, want %v", tt.arg, err, tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("applySet(%q) error = %q, want it to contain %q", tt.arg, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateValues_SetString(t *testing.T) {
+	t.Parallel()
+	m := map[string]any{}
+	overrides := StateValues{Set: []string{"a=1,b=1"}, SetString: []string{"b=2"}}
+	if _, err := overrides.apply(m); err != nil {
+		t.Fatalf("apply() error: %v", err)
+	}
+
+	got, _ := json.Marshal(m)
+	want := `{"a":1,"b":"2"}`
+	if string(got) != want {
+		t.Errorf("apply() = %s, want %s", got, want)
+	}
+}
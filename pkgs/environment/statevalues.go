@@ -0,0 +1,84 @@
+package environment
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrStateValuesFile is returned when a state values file can not be read.
+var ErrStateValuesFile = errors.New("could not read state values file")
+
+// StateValues are the state values given on the command line.
+// They are applied after the env files, in the same order as helmfile applies them.
+type StateValues struct {
+	// Files are YAML files merged in order, like --state-values-file.
+	Files []string
+	// Set are `key=value` overrides applied after the files, like --state-values-set.
+	Set []string
+	// SetString are like Set, but the values are always strings, like --state-values-set-string.
+	SetString []string
+}
+
+// loadFiles loads the state values files, in order.
+func (s StateValues) loadFiles() ([]source, error) {
+	sources := make([]source, 0, len(s.Files))
+	for _, path := range s.Files {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrStateValuesFile, err)
+		}
+		values, err := LoadYamlFile(path)
+		if err == nil {
+			err = CheckMergeDirectives(values)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w %s: %w", ErrStateValuesFile, path, err)
+		}
+		sources = append(sources, source{origin: path, values: values})
+	}
+	return sources, nil
+}
+
+// apply sets the values given with Set and then SetString in m.
+// It returns a source for each of them, with the values it set.
+func (s StateValues) apply(m map[string]any) ([]source, error) {
+	var sources []source
+	for _, flag := range []struct {
+		name   string
+		values []string
+		typed  bool
+	}{
+		{"--state-values-set", s.Set, true},
+		{"--state-values-set-string", s.SetString, false},
+	} {
+		for _, v := range flag.values {
+			if err := applySet(m, v, flag.typed); err != nil {
+				return nil, err
+			}
+			set := map[string]any{}
+			if err := applySet(set, v, flag.typed); err != nil {
+				return nil, err
+			}
+			sources = append(sources, source{origin: flag.name + " " + v, values: set})
+		}
+	}
+	return sources, nil
+}
+
+// Values returns the Files merged in order, with Set and SetString applied,
+// for values given on the command line without an environment.
+func (s StateValues) Values() (map[string]any, error) {
+	sources, err := s.loadFiles()
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]any{}
+	for _, src := range sources {
+		m = MergeMaps(m, src.values)
+	}
+	m = WithoutMergeDirectives(m)
+	if _, err := s.apply(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
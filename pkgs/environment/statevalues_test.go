@@ -0,0 +1,71 @@
+package environment
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValuesWriter_StateValuesFiles(t *testing.T) {
+	t.Parallel()
+	dir := writeEnvFiles(t, map[string]string{
+		"dev.yaml": "a: env\nb: env\nc: env\nd: env\n",
+	})
+	first := filepath.Join(dir, "first.yaml")
+	second := filepath.Join(dir, "second.yaml")
+	if err := os.WriteFile(first, []byte("b: first\nc: first\nd: first\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", first, err)
+	}
+	if err := os.WriteFile(second, []byte("c: second\nd: second\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", second, err)
+	}
+
+	overrides := StateValues{Files: []string{first, second}, Set: []string{"d=set"}}
+	m, err := NewValuesWriter(ValuesWriterOptions{}).values(t.Context(), dir, "dev", nil, overrides)
+	if err != nil {
+		t.Fatalf("values() error: %v", err)
+	}
+
+	got, _ := json.Marshal(m)
+	want := `{"a":"env","b":"first","c":"second","d":"set"}`
+	if string(got) != want {
+		t.Errorf("values() = %s, want %s", got, want)
+	}
+}
+
+func TestValuesWriter_StateValuesFiles_Missing(t *testing.T) {
+	t.Parallel()
+	dir := writeEnvFiles(t, map[string]string{"dev.yaml": "a: 1\n"})
+
+	overrides := StateValues{Files: []string{filepath.Join(dir, "missing.yaml")}}
+	_, err := NewValuesWriter(ValuesWriterOptions{}).values(t.Context(), dir, "dev", nil, overrides)
+	if !errors.Is(err, ErrStateValuesFile) {
+		t.Errorf("values() error = %v, want %v", err, ErrStateValuesFile)
+	}
+}
+
+func TestStateValues_Values(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "values.yaml")
+	if err := os.WriteFile(file, []byte("a: file\nb: file\nc: file\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", file, err)
+	}
+
+	m, err := StateValues{Files: []string{file}, Set: []string{"b=2"}, SetString: []string{"c=3"}}.Values()
+	if err != nil {
+		t.Fatalf("Values() error: %v", err)
+	}
+
+	got, _ := json.Marshal(m)
+	want := `{"a":"file","b":2,"c":"3"}`
+	if string(got) != want {
+		t.Errorf("Values() = %s, want %s", got, want)
+	}
+
+	if _, err := (StateValues{Files: []string{filepath.Join(dir, "missing.yaml")}}).Values(); !errors.Is(err, ErrStateValuesFile) {
+		t.Errorf("Values() error = %v, want %v", err, ErrStateValuesFile)
+	}
+}
@@ -1,84 +1,144 @@
 package environment
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"log"
-	"os"
-	"path/filepath"
-	"strings"
-)
+	"sync"
+
+	"filippo.io/age"
 
-// ErrInvalidStateValue is returned when a state value has invalid format.
-var ErrInvalidStateValue = errors.New("invalid state value")
+	"github.com/reMarkable/helmfile-nix/pkgs/cache"
+	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
+	"github.com/reMarkable/helmfile-nix/pkgs/sops"
+	"github.com/reMarkable/helmfile-nix/pkgs/tempfiles"
+)
 
 // ValuesWriter handles writing environment values to JSON files.
 type ValuesWriter struct {
-	logger *log.Logger
+	evaluator  nixeval.Evaluator
+	cache      *cache.Cache
+	temp       *tempfiles.Manager
+	identities func() ([]age.Identity, error)
+	layout     Layout
+	logger     *log.Logger
+}
+
+// ValuesWriterOptions configures a ValuesWriter. The zero value is valid.
+type ValuesWriterOptions struct {
+	// Evaluator is used for nix env files, which are not supported if it is nil.
+	Evaluator nixeval.Evaluator
+	// Cache caches the evaluations of nix env files, unless it is nil.
+	Cache *cache.Cache
+	// Temp has the workspace the values JSON files are written to, a new one is used if it is nil.
+	Temp *tempfiles.Manager
+	// AgeKeyFile has the age identities secrets are decrypted with. If it is empty, they are
+	// looked for where sops looks for them.
+	AgeKeyFile string
+	// Layout overrides the project config of each helmfile with the fields set in it.
+	Layout Layout
+	// Logger is log.Default() if it is nil.
+	Logger *log.Logger
 }
 
 // NewValuesWriter creates a new values writer.
-func NewValuesWriter(logger *log.Logger) *ValuesWriter {
+func NewValuesWriter(opts ValuesWriterOptions) *ValuesWriter {
+	if opts.Temp == nil {
+		opts.Temp = tempfiles.NewManager()
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
 	return &ValuesWriter{
-		logger: logger,
+		evaluator: opts.Evaluator,
+		cache:     opts.Cache,
+		temp:      opts.Temp,
+		identities: sync.OnceValues(func() ([]age.Identity, error) {
+			return sops.Identities(opts.AgeKeyFile)
+		}),
+		layout: opts.Layout,
+		logger: opts.Logger,
 	}
 }
 
-// WriteJSON merges environment YAML values and writes them to a temporary JSON file.
-// The caller is responsible for removing the file after use.
-func (w *ValuesWriter) WriteJSON(state string, env string, overrides []string) (*os.File, error) {
-	f, err := os.CreateTemp("", "val.*.json")
+// WriteJSON merges the environment values and the state values given on the command line,
+// and writes them to a temporary JSON file in the workspace. Returns the path of the file.
+// It is removed with the workspace, callers may remove it earlier.
+func (w *ValuesWriter) WriteJSON(ctx context.Context, state string, env string, overrides StateValues) (string, error) {
+	return w.WriteJSONWithValues(ctx, state, env, nil, overrides)
+}
+
+// WriteJSONWithValues is like WriteJSON, but also merges extra values after the
+// environment files and before the state values, in order.
+func (w *ValuesWriter) WriteJSONWithValues(ctx context.Context, state string, env string, extra []map[string]any, overrides StateValues) (string, error) {
+	m, err := w.values(ctx, state, env, extra, overrides)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	defer func() {
-		if err := f.Close(); err != nil {
-			log.Fatalf("Could not close values.json: %s", err)
-		}
-	}()
+	// Serialize the values
+	envStr, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
 
-	// Get defaults
-	defaultsPath := filepath.Join(state, "env", "defaults.yaml")
-	envPath := filepath.Join(state, "env", env+".yaml")
+	// The values may have decrypted secrets, the workspace is only readable by the user.
+	return w.temp.WriteTemp("val.*.json", envStr)
+}
 
-	m, err := LoadYamlFile(defaultsPath)
+func (w *ValuesWriter) values(ctx context.Context, state string, env string, extra []map[string]any, overrides StateValues) (map[string]any, error) {
+	m, _, err := w.valuesWithSources(ctx, state, env, extra, overrides)
+	return m, err
+}
+
+// valuesWithSources merges the values, and returns them with everything they were merged from.
+func (w *ValuesWriter) valuesWithSources(ctx context.Context, state string, env string, extra []map[string]any, overrides StateValues) (map[string]any, []source, error) {
+	// Get defaults and the environment with everything it inherits from
+	layers, err := w.loadLayers(ctx, state, env)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	n, err := LoadYamlFile(envPath)
+	var sources []source
+	envFile := ""
+	for _, l := range layers {
+		sources = append(sources, source{origin: l.path, values: l.values})
+		if l.path != "" {
+			envFile = l.path
+		}
+	}
+	secrets, err := w.loadSecrets(state, layers)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	m = MergeMaps(m, n)
-	// Handle state overrides
-	for _, v := range overrides {
-		vals := strings.SplitSeq(v, ",")
-		for val := range vals {
-			kv := strings.Split(val, "=")
-			if len(kv) != 2 {
-				return nil, fmt.Errorf("%w: %s", ErrInvalidStateValue, val)
-			}
-
-			if err := SetNestedMapValue(m, kv[0], kv[1]); err != nil {
-				return nil, fmt.Errorf("could not set nested map value %s: %w", kv[0], err)
-			}
+	sources = append(sources, secrets...)
+	for _, e := range extra {
+		if err := CheckMergeDirectives(e); err != nil {
+			return nil, nil, err
 		}
+		sources = append(sources, source{origin: "the values of the parent helmfile", values: e})
 	}
-
-	// Serialize the values
-	envStr, err := json.Marshal(m)
+	files, err := overrides.loadFiles()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	sources = append(sources, files...)
 
-	// Write the values
-	if _, err := f.Write(envStr); err != nil {
-		return nil, err
+	m := map[string]any{}
+	for _, s := range sources {
+		m = MergeMaps(m, s.values)
 	}
+	m = WithoutMergeDirectives(m)
 
-	return f, nil
+	// Handle state overrides
+	set, err := overrides.apply(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	sources = append(sources, set...)
+
+	if err := w.validate(ctx, state, env, envFile, m, sources); err != nil {
+		return nil, nil, err
+	}
+	return m, sources, nil
 }
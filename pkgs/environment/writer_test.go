@@ -8,6 +8,8 @@ import (
 	"testing"
 
 	"github.com/andreyvit/diff"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/tempfiles"
 )
 
 var testVals = `{"bad":123,"bar":"true","foo":{"bad":"hello","bar":false,"baz":true,"foo":true}}`
@@ -15,25 +17,25 @@ var testVals = `{"bad":123,"bar":"true","foo":{"bad":"hello","bar":false,"baz":t
 func TestValuesWriter_WriteJSON_Success(t *testing.T) {
 	t.Parallel()
 	logger := log.Default()
-	writer := NewValuesWriter(logger)
+	writer := NewValuesWriter(ValuesWriterOptions{Logger: logger})
 
 	// Use the existing test data
 	cwd, _ := os.Getwd()
 	testDataPath := filepath.Join(cwd, "../../testData/helm")
 
-	f, err := writer.WriteJSON(testDataPath, "test", []string{"foo.bar=false", "bad=123", "foo.bad=hello"})
+	f, err := writer.WriteJSON(t.Context(), testDataPath, "test", StateValues{Set: []string{"foo.bar=false", "bad=123", "foo.bad=hello"}})
 	if err != nil {
 		t.Fatalf("WriteJSON() error: %v", err)
 	}
 
 	defer func() {
-		if err := os.Remove(f.Name()); err != nil {
+		if err := os.Remove(f); err != nil {
 			t.Errorf("Failed to remove temp file: %v", err)
 		}
 	}()
 
 	// Read and verify content
-	content, err := os.ReadFile(f.Name())
+	content, err := os.ReadFile(f)
 	if err != nil {
 		t.Fatalf("Failed to read output file: %v", err)
 	}
@@ -46,24 +48,24 @@ func TestValuesWriter_WriteJSON_Success(t *testing.T) {
 func TestValuesWriter_WriteJSON_MissingEnvironmentFiles(t *testing.T) {
 	t.Parallel()
 	logger := log.Default()
-	writer := NewValuesWriter(logger)
+	writer := NewValuesWriter(ValuesWriterOptions{Logger: logger})
 
 	tmpDir := t.TempDir()
 
 	// No env directory exists, should return empty values
-	f, err := writer.WriteJSON(tmpDir, "dev", []string{})
+	f, err := writer.WriteJSON(t.Context(), tmpDir, "dev", StateValues{})
 	if err != nil {
 		t.Fatalf("WriteJSON() with missing env files should not error: %v", err)
 	}
 
 	defer func() {
-		if err = os.Remove(f.Name()); err != nil {
+		if err = os.Remove(f); err != nil {
 			t.Errorf("Failed to remove temp file: %v", err)
 		}
 	}()
 
 	// Verify empty JSON object was written
-	content, err := os.ReadFile(f.Name())
+	content, err := os.ReadFile(f)
 	if err != nil {
 		t.Fatalf("Failed to read output file: %v", err)
 	}
@@ -76,7 +78,7 @@ func TestValuesWriter_WriteJSON_MissingEnvironmentFiles(t *testing.T) {
 func TestValuesWriter_WriteJSON_InvalidOverrideFormat(t *testing.T) {
 	t.Parallel()
 	logger := log.Default()
-	writer := NewValuesWriter(logger)
+	writer := NewValuesWriter(ValuesWriterOptions{Logger: logger})
 
 	tmpDir := t.TempDir()
 	envDir := filepath.Join(tmpDir, "env")
@@ -95,16 +97,17 @@ func TestValuesWriter_WriteJSON_InvalidOverrideFormat(t *testing.T) {
 		override string
 	}{
 		{"no equals sign", "no_equals_sign"},
-		{"multiple equals", "multiple=equals=signs"},
+		{"empty key", "=value"},
+		{"unclosed index", "list[0=value"},
 	}
 
 	for _, tc := range invalidOverrides {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
-			f, err := writer.WriteJSON(tmpDir, "dev", []string{tc.override})
+			f, err := writer.WriteJSON(t.Context(), tmpDir, "dev", StateValues{Set: []string{tc.override}})
 			if err == nil {
-				if f != nil {
-					if err := os.Remove(f.Name()); err != nil {
+				if f != "" {
+					if err := os.Remove(f); err != nil {
 						t.Logf("Failed to cleanup temp file: %v", err)
 					}
 				}
@@ -121,7 +124,7 @@ func TestValuesWriter_WriteJSON_InvalidOverrideFormat(t *testing.T) {
 func TestValuesWriter_WriteJSON_InvalidYAMLSyntax(t *testing.T) {
 	t.Parallel()
 	logger := log.Default()
-	writer := NewValuesWriter(logger)
+	writer := NewValuesWriter(ValuesWriterOptions{Logger: logger})
 
 	tmpDir := t.TempDir()
 	envDir := filepath.Join(tmpDir, "env")
@@ -139,7 +142,7 @@ foo: bar
 		t.Fatalf("Failed to create invalid YAML: %v", err)
 	}
 
-	_, err := writer.WriteJSON(tmpDir, "dev", []string{})
+	_, err := writer.WriteJSON(t.Context(), tmpDir, "dev", StateValues{})
 
 	if err == nil {
 		t.Error("WriteJSON() expected error for invalid YAML, got nil")
@@ -149,7 +152,7 @@ foo: bar
 func TestValuesWriter_WriteJSON_NestedOverrides(t *testing.T) {
 	t.Parallel()
 	logger := log.Default()
-	writer := NewValuesWriter(logger)
+	writer := NewValuesWriter(ValuesWriterOptions{Logger: logger})
 
 	tmpDir := t.TempDir()
 	envDir := filepath.Join(tmpDir, "env")
@@ -167,19 +170,19 @@ foo:
 		t.Fatalf("Failed to create defaults: %v", err)
 	}
 
-	f, err := writer.WriteJSON(tmpDir, "dev", []string{"foo.bar.baz=updated"})
+	f, err := writer.WriteJSON(t.Context(), tmpDir, "dev", StateValues{Set: []string{"foo.bar.baz=updated"}})
 	if err != nil {
 		t.Fatalf("WriteJSON() error: %v", err)
 	}
 
 	defer func() {
-		if err := os.Remove(f.Name()); err != nil {
+		if err := os.Remove(f); err != nil {
 			t.Errorf("Failed to remove temp file: %v", err)
 		}
 	}()
 
 	// Verify the nested value was updated
-	content, err := os.ReadFile(f.Name())
+	content, err := os.ReadFile(f)
 	if err != nil {
 		t.Fatalf("Failed to read output: %v", err)
 	}
@@ -192,7 +195,7 @@ foo:
 func TestValuesWriter_WriteJSON_MultipleOverrides(t *testing.T) {
 	t.Parallel()
 	logger := log.Default()
-	writer := NewValuesWriter(logger)
+	writer := NewValuesWriter(ValuesWriterOptions{Logger: logger})
 
 	tmpDir := t.TempDir()
 	envDir := filepath.Join(tmpDir, "env")
@@ -206,19 +209,19 @@ func TestValuesWriter_WriteJSON_MultipleOverrides(t *testing.T) {
 	}
 
 	// Test comma-separated overrides
-	f, err := writer.WriteJSON(tmpDir, "dev", []string{"foo=1,bar=2,baz=3"})
+	f, err := writer.WriteJSON(t.Context(), tmpDir, "dev", StateValues{Set: []string{"foo=1,bar=2,baz=3"}})
 	if err != nil {
 		t.Fatalf("WriteJSON() error: %v", err)
 	}
 
 	defer func() {
-		if err := os.Remove(f.Name()); err != nil {
+		if err := os.Remove(f); err != nil {
 			t.Errorf("Failed to remove temp file: %v", err)
 		}
 	}()
 
 	// Verify all values were set
-	content, err := os.ReadFile(f.Name())
+	content, err := os.ReadFile(f)
 	if err != nil {
 		t.Fatalf("Failed to read output: %v", err)
 	}
@@ -232,7 +235,7 @@ func TestValuesWriter_WriteJSON_MultipleOverrides(t *testing.T) {
 func TestValuesWriter_NewValuesWriter(t *testing.T) {
 	t.Parallel()
 	logger := log.Default()
-	writer := NewValuesWriter(logger)
+	writer := NewValuesWriter(ValuesWriterOptions{Logger: logger})
 
 	if writer == nil {
 		t.Fatal("NewValuesWriter() returned nil")
@@ -241,4 +244,63 @@ func TestValuesWriter_NewValuesWriter(t *testing.T) {
 	if writer.logger != logger {
 		t.Error("NewValuesWriter() logger not set correctly")
 	}
+
+	writer = NewValuesWriter(ValuesWriterOptions{})
+	if writer.temp == nil || writer.logger == nil {
+		t.Error("NewValuesWriter() did not default the workspace and logger")
+	}
+}
+
+func TestValuesWriter_WriteJSON_Workspace(t *testing.T) {
+	t.Parallel()
+	temp := tempfiles.NewManager()
+	writer := NewValuesWriter(ValuesWriterOptions{Temp: temp})
+
+	path, err := writer.WriteJSON(t.Context(), filepath.Join("..", "..", "testData", "helm"), "test", StateValues{})
+	if err != nil {
+		t.Fatalf("WriteJSON() error: %v", err)
+	}
+	if !strings.HasPrefix(filepath.Base(filepath.Dir(path)), "helmfile-nix-") {
+		t.Errorf("WriteJSON() should write to the workspace, got %s", path)
+	}
+
+	temp.Cleanup()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Cleanup() did not remove %s", path)
+	}
+}
+
+func TestValuesWriter_WriteJSONWithValues(t *testing.T) {
+	t.Parallel()
+	logger := log.Default()
+	writer := NewValuesWriter(ValuesWriterOptions{Logger: logger})
+
+	cwd, _ := os.Getwd()
+	testDataPath := filepath.Join(cwd, "../../testData/helm")
+
+	extra := []map[string]any{
+		{"bar": "extra", "foo": map[string]any{"bad": "extra"}},
+		{"baz": 1},
+	}
+	f, err := writer.WriteJSONWithValues(t.Context(), testDataPath, "test", extra, StateValues{Set: []string{"foo.bad=hello"}})
+	if err != nil {
+		t.Fatalf("WriteJSONWithValues() error: %v", err)
+	}
+
+	defer func() {
+		if err := os.Remove(f); err != nil {
+			t.Errorf("Failed to remove temp file: %v", err)
+		}
+	}()
+
+	content, err := os.ReadFile(f)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+
+	// Extra values override the environment files, overrides win over both.
+	expected := `{"bar":"extra","baz":1,"foo":{"bad":"hello","bar":true,"baz":true,"foo":true}}`
+	if string(content) != expected {
+		t.Errorf("WriteJSONWithValues() content mismatch:\n%v", diff.LineDiff(string(content), expected))
+	}
 }
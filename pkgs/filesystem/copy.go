@@ -0,0 +1,87 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrSymlinkLoop is returned when a symlink in a copied directory points back into a directory being copied.
+var ErrSymlinkLoop = errors.New("symlink loop")
+
+// CopyDir copies the directory src to dst recursively. Symlinks are followed, also when src is one.
+func CopyDir(src, dst string) error {
+	root, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	return copyDir(root, dst, map[string]bool{})
+}
+
+// copyDir copies the resolved directory src to dst. visited are the resolved directories
+// being copied through symlinks, a symlink to one of them or to a parent of src is a loop.
+func copyDir(src, dst string, visited map[string]bool) error {
+	visited[src] = true
+	defer delete(visited, src)
+
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return err
+			}
+			info, err := os.Stat(resolved)
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return CopyFile(resolved, target)
+			}
+			if visited[resolved] || within(filepath.Dir(path), resolved) {
+				return fmt.Errorf("%w: %s points to %s", ErrSymlinkLoop, path, resolved)
+			}
+			return copyDir(resolved, target, visited)
+		}
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o750)
+		}
+
+		return CopyFile(path, target)
+	})
+}
+
+// within returns whether path is dir or inside it.
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// CopyFile copies the file src to dst, keeping its permissions.
+func CopyFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o750); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, info.Mode().Perm())
+}
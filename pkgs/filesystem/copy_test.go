@@ -0,0 +1,95 @@
+package filesystem
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyDir(t *testing.T) {
+	t.Parallel()
+	dst := filepath.Join(t.TempDir(), "chart")
+
+	if err := CopyDir("../../testData/chart", dst); err != nil {
+		t.Fatalf("CopyDir() error: %v", err)
+	}
+
+	for _, f := range []string{"Chart.yaml", "values.yaml", ".helmignore", "templates/tests/test-connection.yaml"} {
+		want, err := os.ReadFile(filepath.Join("../../testData/chart", f))
+		if err != nil {
+			t.Fatalf("Failed to read source %s: %v", f, err)
+		}
+		got, err := os.ReadFile(filepath.Join(dst, f))
+		if err != nil {
+			t.Fatalf("CopyDir() did not copy %s: %v", f, err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("CopyDir() content mismatch for %s", f)
+		}
+	}
+}
+
+func TestCopyDir_Missing(t *testing.T) {
+	t.Parallel()
+	if err := CopyDir("/nonexistent/chart", t.TempDir()); err == nil {
+		t.Error("CopyDir() should fail for a missing source")
+	}
+}
+
+func TestCopyDir_SymlinkedRoot(t *testing.T) {
+	t.Parallel()
+	tmp := t.TempDir()
+	chart, err := filepath.Abs("../../testData/chart")
+	if err != nil {
+		t.Fatalf("Failed to resolve chart: %v", err)
+	}
+	link := filepath.Join(tmp, "link")
+	if err := os.Symlink(chart, link); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	dst := filepath.Join(tmp, "copy")
+	if err := CopyDir(link, dst); err != nil {
+		t.Fatalf("CopyDir() error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "templates", "tests", "test-connection.yaml")); err != nil {
+		t.Errorf("CopyDir() did not copy the chart: %v", err)
+	}
+}
+
+func TestCopyDir_SymlinkLoop(t *testing.T) {
+	t.Parallel()
+	src := filepath.Join(t.TempDir(), "src")
+	for _, dir := range []string{"a", "b"} {
+		if err := os.MkdirAll(filepath.Join(src, dir), 0o750); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+	links := map[string]string{
+		// To a parent.
+		filepath.Join(src, "a", "up"): src,
+		// Through two directories pointing at each other.
+		filepath.Join(src, "a", "to-b"): filepath.Join(src, "b"),
+		filepath.Join(src, "b", "to-a"): filepath.Join(src, "a"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+
+	err := CopyDir(src, filepath.Join(t.TempDir(), "copy"))
+	if !errors.Is(err, ErrSymlinkLoop) {
+		t.Errorf("CopyDir() error = %v, want %v", err, ErrSymlinkLoop)
+	}
+
+	// Without the link to the parent, the mutual links are still a loop.
+	if err := os.Remove(filepath.Join(src, "a", "up")); err != nil {
+		t.Fatalf("Failed to remove symlink: %v", err)
+	}
+	err = CopyDir(src, filepath.Join(t.TempDir(), "copy"))
+	if !errors.Is(err, ErrSymlinkLoop) {
+		t.Errorf("CopyDir() error = %v, want %v", err, ErrSymlinkLoop)
+	}
+}
@@ -0,0 +1,395 @@
+package helmfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidState is returned when a rendered helmfile has an unexpected structure.
+var ErrInvalidState = errors.New("invalid helmfile state")
+
+// DiffKind describes how a release or field differs.
+type DiffKind string
+
+// Kinds of differences.
+const (
+	Added   DiffKind = "+"
+	Removed DiffKind = "-"
+	Changed DiffKind = "~"
+)
+
+// Difference is a single structural difference between two rendered helmfiles.
+type Difference struct {
+	Kind DiffKind
+	// Subject is "release <namespace>/<name>" for releases, or the top-level key otherwise.
+	// Subjects repeated in later documents end with "(document <n>)".
+	Subject string
+	// Path is the changed field within the subject, empty if the whole subject was added or removed.
+	Path string
+	From any
+	To   any
+}
+
+// Compare returns the structural differences between two rendered helmfiles.
+// Releases are matched by namespace and name, other top-level keys by name.
+// Entries of lists where every entry has a name, like the containers of a chart, are matched
+// by namespace and name too, other lists are compared by index.
+func Compare(from, to []byte) ([]Difference, error) {
+	a, err := parseState(from)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse first helmfile: %w", err)
+	}
+	b, err := parseState(to)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse second helmfile: %w", err)
+	}
+
+	var diffs []Difference
+	for _, subject := range unionKeys(a, b) {
+		av, inA := a[subject]
+		bv, inB := b[subject]
+		switch {
+		case !inA:
+			diffs = append(diffs, Difference{Kind: Added, Subject: subject, To: bv})
+		case !inB:
+			diffs = append(diffs, Difference{Kind: Removed, Subject: subject, From: av})
+		default:
+			diffs = append(diffs, compareValues(subject, "", av, bv)...)
+		}
+	}
+	return diffs, nil
+}
+
+// ResolveGenerated replaces the references in a rendered helmfile to the files and directories
+// it generated, like rendered nixCharts, values .nix files and nested helmfiles, with their content.
+// Their paths are different on every run, so two renders are compared by what is in them instead.
+// Relative references are resolved against base, the directory of the helmfile.
+func ResolveGenerated(content []byte, base string, generated []string) ([]byte, error) {
+	docs, err := decodeDocuments(content)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse rendered helmfile: %w", err)
+	}
+
+	var out []byte
+	for i, doc := range docs {
+		doc, err := resolveGenerated(doc, base, generated)
+		if err != nil {
+			return nil, err
+		}
+		res, err := yaml.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			out = append(out, []byte("---\n")...)
+		}
+		out = append(out, res...)
+	}
+	return out, nil
+}
+
+func resolveGenerated(v any, base string, generated []string) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, c := range v {
+			r, err := resolveGenerated(c, base, generated)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = r
+		}
+	case []any:
+		for i, c := range v {
+			r, err := resolveGenerated(c, base, generated)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = r
+		}
+	case string:
+		p := v
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(base, p)
+		}
+		if slices.Contains(generated, filepath.Clean(p)) {
+			return generatedContent(p, generated)
+		}
+	}
+	return v, nil
+}
+
+// generatedContent returns the YAML documents in a generated file, or the content of every
+// file in a generated directory by their path in it.
+func generatedContent(path string, generated []string) (any, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		files := map[string]any{}
+		err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(path, p)
+			if err != nil {
+				return err
+			}
+			files[filepath.ToSlash(rel)], err = generatedContent(p, generated)
+			return err
+		})
+		return files, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := decodeDocuments(data)
+	if err != nil {
+		// Not YAML, like a go templated helmfile, so it is compared as text.
+		docs = []any{string(data)}
+	}
+	// Nested helmfiles refer to their own generated files, relative to their directory.
+	for i, doc := range docs {
+		if docs[i], err = resolveGenerated(doc, filepath.Dir(path), generated); err != nil {
+			return nil, err
+		}
+	}
+	if len(docs) == 1 {
+		return docs[0], nil
+	}
+	return docs, nil
+}
+
+func decodeDocuments(content []byte) ([]any, error) {
+	var docs []any
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var doc any
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// FormatDifferences writes the differences grouped by subject.
+func FormatDifferences(w io.Writer, diffs []Difference) error {
+	var buf bytes.Buffer
+	last := ""
+	for _, d := range diffs {
+		if d.Path == "" {
+			fmt.Fprintf(&buf, "%s %s\n", d.Kind, d.Subject)
+			last = ""
+			continue
+		}
+		if d.Subject != last {
+			fmt.Fprintf(&buf, "%s %s\n", Changed, d.Subject)
+			last = d.Subject
+		}
+		fmt.Fprintf(&buf, "    %s %s: %s -> %s\n", d.Kind, d.Path, formatValue(d.From), formatValue(d.To))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// parseState flattens all documents of a rendered helmfile into subjects.
+// A subject already in an earlier document gets the 1-based index of its document, so none is lost.
+func parseState(content []byte) (map[string]any, error) {
+	state := map[string]any{}
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	for n := 1; ; n++ {
+		var doc map[string]any
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			return state, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		add := func(subject string, v any) {
+			if _, ok := state[subject]; ok {
+				subject = fmt.Sprintf("%s (document %d)", subject, n)
+			}
+			state[subject] = v
+		}
+		for k, v := range doc {
+			if k != "releases" {
+				add(k, v)
+				continue
+			}
+			releases, ok := v.([]any)
+			if !ok {
+				return nil, fmt.Errorf("%w: releases is %T", ErrInvalidState, v)
+			}
+			for _, r := range releases {
+				release, ok := r.(map[string]any)
+				if !ok {
+					return nil, fmt.Errorf("%w: release is %T", ErrInvalidState, r)
+				}
+				add("release "+releaseID(release), release)
+			}
+		}
+	}
+}
+
+func releaseID(release map[string]any) string {
+	name := fmt.Sprint(release["name"])
+	if ns, ok := release["namespace"].(string); ok && ns != "" {
+		return ns + "/" + name
+	}
+	return name
+}
+
+func compareValues(subject, path string, a, b any) []Difference {
+	am, aIsMap := a.(map[string]any)
+	bm, bIsMap := b.(map[string]any)
+	if aIsMap && bIsMap {
+		var diffs []Difference
+		for _, k := range unionKeys(am, bm) {
+			av, inA := am[k]
+			bv, inB := bm[k]
+			p := joinPath(path, k)
+			switch {
+			case !inA:
+				diffs = append(diffs, Difference{Kind: Added, Subject: subject, Path: p, To: bv})
+			case !inB:
+				diffs = append(diffs, Difference{Kind: Removed, Subject: subject, Path: p, From: av})
+			default:
+				diffs = append(diffs, compareValues(subject, p, av, bv)...)
+			}
+		}
+		return diffs
+	}
+
+	al, aIsList := a.([]any)
+	bl, bIsList := b.([]any)
+	if aIsList && bIsList {
+		aIDs, aNamed := listIDs(al)
+		bIDs, bNamed := listIDs(bl)
+		if aNamed && bNamed {
+			return compareNamed(subject, path, al, aIDs, bl, bIDs)
+		}
+
+		var diffs []Difference
+		for i := range max(len(al), len(bl)) {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(al):
+				diffs = append(diffs, Difference{Kind: Added, Subject: subject, Path: p, To: bl[i]})
+			case i >= len(bl):
+				diffs = append(diffs, Difference{Kind: Removed, Subject: subject, Path: p, From: al[i]})
+			default:
+				diffs = append(diffs, compareValues(subject, p, al[i], bl[i])...)
+			}
+		}
+		return diffs
+	}
+
+	if reflect.DeepEqual(a, b) {
+		return nil
+	}
+	if path == "" {
+		path = "."
+	}
+	return []Difference{{Kind: Changed, Subject: subject, Path: path, From: a, To: b}}
+}
+
+// listIDs returns the ids of the entries of l, like releaseID, if every entry is a map with a name
+// and no two have the same id.
+func listIDs(l []any) ([]string, bool) {
+	ids := make([]string, 0, len(l))
+	for _, e := range l {
+		m, ok := e.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if name, ok := m["name"].(string); !ok || name == "" {
+			return nil, false
+		}
+		id := releaseID(m)
+		if slices.Contains(ids, id) {
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+// compareNamed compares lists of named entries by their ids instead of their indices,
+// so an entry added or moved does not show up as a change of the ones after it.
+func compareNamed(subject, path string, a []any, aIDs []string, b []any, bIDs []string) []Difference {
+	var diffs []Difference
+	for i, id := range aIDs {
+		p := fmt.Sprintf("%s[%q]", path, id)
+		j := slices.Index(bIDs, id)
+		if j < 0 {
+			diffs = append(diffs, Difference{Kind: Removed, Subject: subject, Path: p, From: a[i]})
+			continue
+		}
+		diffs = append(diffs, compareValues(subject, p, a[i], b[j])...)
+	}
+	for j, id := range bIDs {
+		if !slices.Contains(aIDs, id) {
+			diffs = append(diffs, Difference{Kind: Added, Subject: subject, Path: fmt.Sprintf("%s[%q]", path, id), To: b[j]})
+		}
+	}
+	return diffs
+}
+
+func joinPath(path, key string) string {
+	if strings.ContainsAny(key, ".[] ") {
+		key = fmt.Sprintf("%q", key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func unionKeys(a, b map[string]any) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(v any) string {
+	if v == nil {
+		return "<unset>"
+	}
+	// Not escaped, to keep redacted values readable.
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return fmt.Sprint(v)
+	}
+	return strings.TrimSuffix(out.String(), "\n")
+}
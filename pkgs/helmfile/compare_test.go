@@ -0,0 +1,218 @@
+package helmfile
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andreyvit/diff"
+)
+
+var compareFrom = `environments:
+    stage:
+        values: []
+---
+helmDefaults:
+    wait: true
+releases:
+    - name: grafana
+      namespace: monitoring
+      chart: grafana/grafana
+      values:
+        - replicas: 1
+          ingress:
+            hosts:
+                - grafana.stage
+    - name: loki
+      chart: grafana/loki
+`
+
+var compareTo = `environments:
+    prod:
+        values: []
+---
+helmDefaults:
+    wait: true
+releases:
+    - name: loki
+      namespace: logging
+      chart: grafana/loki
+    - name: grafana
+      namespace: monitoring
+      chart: grafana/grafana
+      installed: true
+      values:
+        - replicas: 3
+          ingress:
+            hosts:
+                - grafana.prod
+                - grafana.example.com
+`
+
+var compareExpected = `~ environments
+    + prod: <unset> -> {"values":[]}
+    - stage: {"values":[]} -> <unset>
++ release logging/loki
+- release loki
+~ release monitoring/grafana
+    + installed: <unset> -> true
+    ~ values[0].ingress.hosts[0]: "grafana.stage" -> "grafana.prod"
+    + values[0].ingress.hosts[1]: <unset> -> "grafana.example.com"
+    ~ values[0].replicas: 1 -> 3
+`
+
+func TestCompare(t *testing.T) {
+	t.Parallel()
+	diffs, err := Compare([]byte(compareFrom), []byte(compareTo))
+	if err != nil {
+		t.Fatalf("Compare() error: %v", err)
+	}
+
+	var out strings.Builder
+	if err := FormatDifferences(&out, diffs); err != nil {
+		t.Fatalf("FormatDifferences() error: %v", err)
+	}
+	if out.String() != compareExpected {
+		t.Errorf("Compare() result not as expected:\n%v", diff.LineDiff(out.String(), compareExpected))
+	}
+}
+
+func TestCompare_Equal(t *testing.T) {
+	t.Parallel()
+	diffs, err := Compare([]byte(compareFrom), []byte(compareFrom))
+	if err != nil {
+		t.Fatalf("Compare() error: %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("Compare() of equal helmfiles = %v, want none", diffs)
+	}
+}
+
+func TestCompare_Documents(t *testing.T) {
+	t.Parallel()
+	from := `helmDefaults:
+    wait: true
+releases:
+    - name: grafana
+      chart: grafana/grafana
+---
+helmDefaults:
+    timeout: 300
+---
+releases:
+    - name: grafana
+      chart: grafana/grafana
+`
+	to := strings.Replace(from, "wait: true", "wait: false", 1)
+	to = strings.Replace(to, "grafana/grafana\n---", "grafana/grafana-v2\n---", 1)
+
+	diffs, err := Compare([]byte(from), []byte(to))
+	if err != nil {
+		t.Fatalf("Compare() error: %v", err)
+	}
+	var out strings.Builder
+	if err := FormatDifferences(&out, diffs); err != nil {
+		t.Fatalf("FormatDifferences() error: %v", err)
+	}
+	// The keys of later documents must not hide the differences in the first one.
+	want := `~ helmDefaults
+    ~ wait: true -> false
+~ release grafana
+    ~ chart: "grafana/grafana" -> "grafana/grafana-v2"
+`
+	if out.String() != want {
+		t.Errorf("Compare() result not as expected:\n%v", diff.LineDiff(out.String(), want))
+	}
+}
+
+func TestCompare_NamedLists(t *testing.T) {
+	t.Parallel()
+	from := `releases:
+    - name: app
+      chart: ./app
+      values:
+        - env:
+            - name: LOG_LEVEL
+              value: info
+            - name: PORT
+              value: "80"
+      hooks:
+        - events: [presync]
+        - events: [postsync]
+`
+	to := `releases:
+    - name: app
+      chart: ./app
+      values:
+        - env:
+            - name: DEBUG
+              value: "true"
+            - name: LOG_LEVEL
+              value: debug
+            - name: PORT
+              value: "80"
+      hooks:
+        - events: [postsync]
+`
+	diffs, err := Compare([]byte(from), []byte(to))
+	if err != nil {
+		t.Fatalf("Compare() error: %v", err)
+	}
+	var out strings.Builder
+	if err := FormatDifferences(&out, diffs); err != nil {
+		t.Fatalf("FormatDifferences() error: %v", err)
+	}
+	// An entry added to the front does not change the ones after it, lists without names go by index.
+	want := `~ release app
+    ~ hooks[0].events[0]: "presync" -> "postsync"
+    - hooks[1]: {"events":["postsync"]} -> <unset>
+    ~ values[0].env["LOG_LEVEL"].value: "info" -> "debug"
+    + values[0].env["DEBUG"]: <unset> -> {"name":"DEBUG","value":"true"}
+`
+	if out.String() != want {
+		t.Errorf("Compare() result not as expected:\n%v", diff.LineDiff(out.String(), want))
+	}
+}
+
+func TestResolveGenerated(t *testing.T) {
+	t.Parallel()
+	base := writeHelmfiles(t, map[string]string{
+		"chart-1/nix/templates/resources.yaml": "kind: ConfigMap\n",
+		"team-a/helmfile.123.yaml":             "releases:\n    - name: a\n      chart: ../chart-1/nix\n",
+		"values.yaml":                          "replicas: 2\n",
+	})
+	generated := []string{filepath.Join(base, "chart-1", "nix"), filepath.Join(base, "team-a", "helmfile.123.yaml")}
+	content := "helmfiles:\n    - path: team-a/helmfile.123.yaml\n      values:\n        - values.yaml\n"
+
+	got, err := ResolveGenerated([]byte(content), base, generated)
+	if err != nil {
+		t.Fatalf("ResolveGenerated() error: %v", err)
+	}
+	// Files that were not generated, like values.yaml, are left as they are.
+	want := `helmfiles:
+    - path:
+        releases:
+            - chart:
+                templates/resources.yaml:
+                    kind: ConfigMap
+              name: a
+      values:
+        - values.yaml
+`
+	if string(got) != want {
+		t.Errorf("ResolveGenerated() result not as expected:\n%v", diff.LineDiff(string(got), want))
+	}
+}
+
+func TestCompare_InvalidState(t *testing.T) {
+	t.Parallel()
+	_, err := Compare([]byte("releases: foo\n"), []byte(compareFrom))
+	if !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Compare() error = %v, want %v", err, ErrInvalidState)
+	}
+
+	if _, err := Compare([]byte(compareFrom), []byte("releases: [\n")); err == nil {
+		t.Error("Compare() should fail on invalid YAML")
+	}
+}
@@ -0,0 +1,270 @@
+package helmfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/filesystem"
+)
+
+// Exporter writes rendered helmfiles to a self-contained directory.
+// Local charts, rendered nixCharts, local values files and nested helmfiles are
+// copied next to the helmfile, and the references to them are rewritten to relative paths.
+type Exporter struct {
+	dir string
+}
+
+// NewExporter creates an exporter writing to dir.
+func NewExporter(dir string) *Exporter {
+	return &Exporter{
+		dir: dir,
+	}
+}
+
+// Export writes the rendered helmfile content to target within the export directory.
+// Charts, values files and nested helmfiles are copied to assetsDir, relative to the export directory.
+// base is the directory of the source helmfile, used to resolve local paths.
+// nixCharts are the rendered nixChart directories referenced by content.
+func (e *Exporter) Export(target, assetsDir, base string, content []byte, nixCharts []string) error {
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	ex := export{
+		Exporter:  e,
+		target:    target,
+		assetsDir: assetsDir,
+		base:      base,
+		nixCharts: nixCharts,
+		copied:    map[string]string{},
+		used:      map[string]bool{},
+	}
+
+	var out []byte
+	for {
+		var doc any
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not parse rendered helmfile: %w", err)
+		}
+
+		if m, ok := doc.(map[string]any); ok {
+			if err := ex.rewriteReleases(m); err != nil {
+				return err
+			}
+			if err := ex.rewriteHelmfiles(m); err != nil {
+				return err
+			}
+		}
+
+		res, err := yaml.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if len(out) > 0 {
+			out = append(out, []byte("---\n")...)
+		}
+		out = append(out, res...)
+	}
+
+	p := filepath.Join(e.dir, target)
+	if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+		return err
+	}
+	return os.WriteFile(p, out, 0o600)
+}
+
+// export holds the state of a single Export call.
+type export struct {
+	*Exporter
+	target    string
+	assetsDir string
+	base      string
+	nixCharts []string
+	// Source paths already copied, and their reference relative to the export directory.
+	copied map[string]string
+	// Destinations already in use.
+	used map[string]bool
+}
+
+func (ex *export) rewriteReleases(doc map[string]any) error {
+	releases, ok := doc["releases"].([]any)
+	if !ok {
+		return nil
+	}
+
+	for _, r := range releases {
+		release, ok := r.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		if chart, ok := release["chart"].(string); ok {
+			name := filepath.Base(chart)
+			if slices.Contains(ex.nixCharts, chart) {
+				name = strings.ReplaceAll(releaseID(release), "/", "-")
+			}
+			rel, err := ex.copyLocal(chart, filepath.Join("charts", name), filesystem.CopyDir)
+			if err != nil {
+				return fmt.Errorf("could not copy chart of release %s: %w", releaseID(release), err)
+			}
+			release["chart"] = rel
+		}
+
+		for _, key := range []string{"values", "secrets"} {
+			files, ok := release[key].([]any)
+			if !ok {
+				continue
+			}
+			for i, f := range files {
+				file, ok := f.(string)
+				if !ok {
+					continue
+				}
+				rel, err := ex.copyLocal(file, filepath.Join(key, filepath.Base(file)), filesystem.CopyFile)
+				if err != nil {
+					return fmt.Errorf("could not copy %s of release %s: %w", key, releaseID(release), err)
+				}
+				files[i] = rel
+			}
+		}
+	}
+	return nil
+}
+
+func (ex *export) rewriteHelmfiles(doc map[string]any) error {
+	entries, ok := doc["helmfiles"].([]any)
+	if !ok {
+		return nil
+	}
+
+	for i, e := range entries {
+		entry, isMap := e.(map[string]any)
+		var path string
+		if isMap {
+			path, _ = entry["path"].(string)
+		} else {
+			path, _ = e.(string)
+		}
+		if path == "" {
+			continue
+		}
+
+		// Named after the directory, as generated helmfiles have random names.
+		name := filepath.Base(filepath.Dir(filepath.Join(ex.base, path))) + helmfileExt(path)
+		rel, err := ex.copyLocal(path, filepath.Join("helmfiles", name), ex.exportHelmfile)
+		if err != nil {
+			return fmt.Errorf("could not copy helmfile %s: %w", path, err)
+		}
+
+		if isMap {
+			entry["path"] = rel
+			if err := ex.rewriteValues(entry); err != nil {
+				return err
+			}
+		} else {
+			entries[i] = rel
+		}
+	}
+	return nil
+}
+
+// rewriteValues copies the values files of a `helmfiles` entry.
+func (ex *export) rewriteValues(entry map[string]any) error {
+	files, ok := entry["values"].([]any)
+	if !ok {
+		return nil
+	}
+	for i, f := range files {
+		file, ok := f.(string)
+		if !ok {
+			continue
+		}
+		rel, err := ex.copyLocal(file, filepath.Join("values", filepath.Base(file)), filesystem.CopyFile)
+		if err != nil {
+			return err
+		}
+		files[i] = rel
+	}
+	return nil
+}
+
+// exportHelmfile exports a nested helmfile, with its own assets next to it.
+func (ex *export) exportHelmfile(src, dst string) error {
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(ex.dir, dst)
+	if err != nil {
+		return err
+	}
+	assets := strings.TrimSuffix(rel, helmfileExt(rel))
+
+	err = ex.Export(rel, assets, filepath.Dir(src), content, ex.nixCharts)
+	if err != nil {
+		// Not something we can parse, e.g. a go templated helmfile. Copy it as is.
+		log.Printf("Copying helmfile %s unchanged: %s", src, err)
+		return filesystem.CopyFile(src, dst)
+	}
+	return nil
+}
+
+func helmfileExt(path string) string {
+	if strings.HasSuffix(path, ".yaml.gotmpl") {
+		return ".yaml.gotmpl"
+	}
+	return filepath.Ext(path)
+}
+
+// copyLocal copies a local path to dest within the assets directory, and returns the new
+// reference relative to the target. Paths that are not local are returned unchanged.
+func (ex *export) copyLocal(ref, dest string, copyFn func(src, dst string) error) (string, error) {
+	src := ref
+	if !filepath.IsAbs(src) {
+		src = filepath.Join(ex.base, ref)
+	}
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		// Not a local path, e.g. a chart from a repository.
+		return ref, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	src = filepath.Clean(src)
+	if rel, ok := ex.copied[src]; ok {
+		return rel, nil
+	}
+
+	rel := filepath.Join(ex.assetsDir, dest)
+	// The suffix goes before the extension, which helmfile and editors go by.
+	ext := helmfileExt(dest)
+	for i := 2; ex.used[rel]; i++ {
+		rel = filepath.Join(ex.assetsDir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(dest, ext), i, ext))
+	}
+	ex.used[rel] = true
+
+	if err := os.RemoveAll(filepath.Join(ex.dir, rel)); err != nil {
+		return "", err
+	}
+	if err := copyFn(src, filepath.Join(ex.dir, rel)); err != nil {
+		return "", err
+	}
+
+	ref, err := filepath.Rel(filepath.Dir(ex.target), rel)
+	if err != nil {
+		return "", err
+	}
+	ex.copied[src] = "./" + filepath.ToSlash(ref)
+	return ex.copied[src], nil
+}
@@ -0,0 +1,174 @@
+package helmfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andreyvit/diff"
+)
+
+var exportExpected = `environments:
+    dev:
+        values: []
+---
+releases:
+    - chart: ./charts/chart
+      name: test
+      values:
+        - ./values/defaults.yaml
+        - replicas: 2
+    - chart: ./charts/chart
+      name: test-again
+    - chart: ./charts/monitoring-nix
+      name: nix
+      namespace: monitoring
+    - chart: grafana/grafana
+      name: grafana
+`
+
+func TestExporter_Export(t *testing.T) {
+	t.Parallel()
+	nixChart := t.TempDir()
+	if err := os.WriteFile(filepath.Join(nixChart, "resources.yaml"), []byte("kind: ConfigMap\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write resources.yaml: %v", err)
+	}
+
+	content := `environments:
+    dev:
+        values: []
+---
+releases:
+    - chart: ../chart/
+      name: test
+      values:
+        - env/defaults.yaml
+        - replicas: 2
+    - chart: ../chart/
+      name: test-again
+    - chart: ` + nixChart + `
+      name: nix
+      namespace: monitoring
+    - chart: grafana/grafana
+      name: grafana
+`
+	outDir := t.TempDir()
+	err := NewExporter(outDir).Export("helmfile.yaml", "", filepath.Join(testDataDir, "helm"), []byte(content), []string{nixChart})
+	if err != nil {
+		t.Fatalf("Export() error: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(outDir, "helmfile.yaml"))
+	if err != nil {
+		t.Fatalf("Export() did not write helmfile: %v", err)
+	}
+	if string(got) != exportExpected {
+		t.Errorf("Export() result not as expected:\n%v", diff.LineDiff(string(got), exportExpected))
+	}
+
+	for _, f := range []string{"charts/chart/Chart.yaml", "charts/monitoring-nix/resources.yaml", "values/defaults.yaml"} {
+		if _, err := os.Stat(filepath.Join(outDir, f)); err != nil {
+			t.Errorf("Export() did not copy %s: %v", f, err)
+		}
+	}
+}
+
+func TestExporter_Export_AssetsDir(t *testing.T) {
+	t.Parallel()
+	content := "releases:\n    - chart: ../chart/\n      name: test\n"
+	outDir := t.TempDir()
+
+	for _, env := range []string{"dev", "prod"} {
+		err := NewExporter(outDir).Export(env+".yaml", env, filepath.Join(testDataDir, "helm"), []byte(content), nil)
+		if err != nil {
+			t.Fatalf("Export() error: %v", err)
+		}
+
+		got, err := os.ReadFile(filepath.Join(outDir, env+".yaml"))
+		if err != nil {
+			t.Fatalf("Export() did not write helmfile: %v", err)
+		}
+		want := "releases:\n    - chart: ./" + env + "/charts/chart\n      name: test\n"
+		if string(got) != want {
+			t.Errorf("Export() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestExporter_Export_SameName(t *testing.T) {
+	t.Parallel()
+	base := t.TempDir()
+	for _, dir := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(base, dir), 0o700); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+		if err := os.WriteFile(filepath.Join(base, dir, "values.yaml"), []byte("dir: "+dir+"\n"), 0o600); err != nil {
+			t.Fatalf("Failed to write values: %v", err)
+		}
+	}
+	content := "releases:\n    - chart: grafana/grafana\n      name: grafana\n      values:\n        - a/values.yaml\n        - b/values.yaml\n"
+
+	outDir := t.TempDir()
+	if err := NewExporter(outDir).Export("helmfile.yaml", "", base, []byte(content), nil); err != nil {
+		t.Fatalf("Export() error: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(outDir, "helmfile.yaml"))
+	if err != nil {
+		t.Fatalf("Export() did not write helmfile: %v", err)
+	}
+	want := "releases:\n    - chart: grafana/grafana\n      name: grafana\n      values:\n        - ./values/values.yaml\n        - ./values/values-2.yaml\n"
+	if string(got) != want {
+		t.Errorf("Export() result not as expected:\n%v", diff.LineDiff(string(got), want))
+	}
+	if b, err := os.ReadFile(filepath.Join(outDir, "values", "values-2.yaml")); err != nil || string(b) != "dir: b\n" {
+		t.Errorf("Export() did not copy b/values.yaml to values-2.yaml: %q, %v", b, err)
+	}
+}
+
+func TestExporter_Export_InvalidYAML(t *testing.T) {
+	t.Parallel()
+	err := NewExporter(t.TempDir()).Export("helmfile.yaml", "", testDataDir, []byte("releases: [\n"), nil)
+	if err == nil {
+		t.Error("Export() should fail on invalid YAML")
+	}
+}
+
+func TestYAMLExtension(t *testing.T) {
+	t.Parallel()
+	if YAMLExtension("helmfile.nix") != "yaml" || YAMLExtension("helmfile.gotmpl.nix") != "yaml.gotmpl" {
+		t.Error("YAMLExtension() returned unexpected extensions")
+	}
+}
+
+func TestExporter_Export_Helmfiles(t *testing.T) {
+	t.Parallel()
+	base := writeHelmfiles(t, map[string]string{
+		"team-a/helmfile.123.yaml": "releases:\n    - chart: ../chart\n      name: a\n",
+		"chart/Chart.yaml":         "name: chart\n",
+		"team-a.yaml":              "replicas: 2\n",
+	})
+	content := "helmfiles:\n    - path: team-a/helmfile.123.yaml\n      values:\n        - team-a.yaml\n    - git::https://example.com/helmfile.yaml\n"
+	outDir := t.TempDir()
+
+	if err := NewExporter(outDir).Export("helmfile.yaml", "", base, []byte(content), nil); err != nil {
+		t.Fatalf("Export() error: %v", err)
+	}
+
+	expected := map[string]string{
+		"helmfile.yaml":                            "helmfiles:\n    - path: ./helmfiles/team-a.yaml\n      values:\n        - ./values/team-a.yaml\n    - git::https://example.com/helmfile.yaml\n",
+		"helmfiles/team-a.yaml":                    "releases:\n    - chart: ./team-a/charts/chart\n      name: a\n",
+		"helmfiles/team-a/charts/chart/Chart.yaml": "name: chart\n",
+		"values/team-a.yaml":                       "replicas: 2\n",
+	}
+	for f, want := range expected {
+		got, err := os.ReadFile(filepath.Join(outDir, f))
+		if err != nil {
+			t.Errorf("Export() did not write %s: %v", f, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("Export() unexpected %s:\n%v", f, diff.LineDiff(string(got), want))
+		}
+	}
+}
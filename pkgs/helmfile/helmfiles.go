@@ -0,0 +1,138 @@
+package helmfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/environment"
+)
+
+// Static errors for nested helmfiles.
+var (
+	ErrHelmfilesNotSlice = errors.New("helmfiles is not a list")
+	ErrHelmfileCycle     = errors.New("helmfile includes itself")
+	ErrInvalidValues     = errors.New("expected values to be a list of maps or file names")
+)
+
+// renderHelmfiles renders every helmfile.nix referenced in the `helmfiles` list of doc,
+// and points the entries to the generated YAML files instead.
+// Returns the generated files and chart directories that need cleanup.
+func (r *Renderer) renderHelmfiles(ctx context.Context, doc map[string]any, base, env string, parents []string) ([]string, error) {
+	entries, ok := doc["helmfiles"].([]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: got %T", ErrHelmfilesNotSlice, doc["helmfiles"])
+	}
+
+	var cleanup []string
+	for i, e := range entries {
+		var path string
+		var values any
+		entry, isMap := e.(map[string]any)
+		if isMap {
+			path, _ = entry["path"].(string)
+			values = entry["values"]
+		} else {
+			path, _ = e.(string)
+		}
+		if !strings.HasSuffix(path, ".nix") {
+			continue
+		}
+
+		generated, rendered, err := r.renderHelmfile(ctx, path, values, base, env, parents)
+		cleanup = append(cleanup, rendered...)
+		if err != nil {
+			return cleanup, fmt.Errorf("%s: %w", path, err)
+		}
+
+		if isMap {
+			entry["path"] = generated
+		} else {
+			entries[i] = generated
+		}
+	}
+	return cleanup, nil
+}
+
+// renderHelmfile renders a nested helmfile.nix with the values of its own env/ directory,
+// followed by the values given in the including `helmfiles` entry.
+// Returns the path of the generated YAML relative to base, and everything that needs cleanup.
+func (r *Renderer) renderHelmfile(ctx context.Context, path string, values any, base, env string, parents []string) (string, []string, error) {
+	abs := path
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(base, path)
+	}
+	if slices.Contains(parents, abs) {
+		return "", nil, fmt.Errorf("%w: %s", ErrHelmfileCycle, strings.Join(append(parents, abs), " -> "))
+	}
+
+	extra, err := loadEntryValues(values, base)
+	if err != nil {
+		return "", nil, err
+	}
+
+	fileName, subBase := filepath.Base(abs), filepath.Dir(abs)
+	valJSON, err := r.valuesWriter.WriteJSONWithValues(ctx, subBase, env, extra, r.stateValues)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not write values.json: %w", err)
+	}
+	defer r.temp.Remove(valJSON)
+
+	content, cleanup, err := r.render(ctx, fileName, subBase, env, valJSON, parents)
+	if err != nil {
+		return "", cleanup, err
+	}
+
+	// Written next to the helmfile.nix, so relative paths in it keep working.
+	hfFile, err := NewWriter().WriteYAML(fileName, subBase, content)
+	if err != nil {
+		return "", cleanup, err
+	}
+	r.temp.Track(hfFile.Name())
+	cleanup = append(cleanup, hfFile.Name())
+
+	rel, err := filepath.Rel(base, hfFile.Name())
+	if err != nil {
+		return "", cleanup, err
+	}
+	return rel, cleanup, nil
+}
+
+// loadEntryValues loads the values of a `helmfiles` entry, inline maps or files relative to base.
+func loadEntryValues(values any, base string) ([]map[string]any, error) {
+	if values == nil {
+		return nil, nil
+	}
+	list, ok := values.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: got %T", ErrInvalidValues, values)
+	}
+
+	extra := make([]map[string]any, 0, len(list))
+	for _, v := range list {
+		switch val := v.(type) {
+		case map[string]any:
+			extra = append(extra, val)
+		case string:
+			p := val
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(base, p)
+			}
+			if _, err := os.Stat(p); err != nil {
+				return nil, err
+			}
+			m, err := environment.LoadYamlFile(p)
+			if err != nil {
+				return nil, err
+			}
+			extra = append(extra, m)
+		default:
+			return nil, fmt.Errorf("%w: got %T", ErrInvalidValues, v)
+		}
+	}
+	return extra, nil
+}
@@ -0,0 +1,135 @@
+package helmfile
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/environment"
+)
+
+// valuesEvaluator answers with canned JSON by helmfile directory, and records the values each one got.
+type valuesEvaluator struct {
+	mu        sync.Mutex
+	responses map[string]string
+	values    map[string]string
+}
+
+var renderArgs = regexp.MustCompile(`\.render "[^"]*" "([^"]*)" "[^"]*" "([^"]*)"`)
+
+func (e *valuesEvaluator) Eval(_ context.Context, expr string, _ bool) ([]byte, error) {
+	m := renderArgs.FindStringSubmatch(expr)
+	if m == nil {
+		return nil, errBoom
+	}
+	values, err := os.ReadFile(m[2])
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.values[filepath.Base(m[1])] = string(values)
+	return []byte(e.responses[filepath.Base(m[1])]), nil
+}
+
+func writeHelmfiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, "root", name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	return filepath.Join(dir, "root")
+}
+
+func TestRenderer_Render_Helmfiles(t *testing.T) {
+	t.Parallel()
+	base := writeHelmfiles(t, map[string]string{
+		"helmfile.nix":             "{ ... }: [ ]",
+		"team-a/helmfile.nix":      "{ ... }: [ ]",
+		"team-a/env/defaults.yaml": "team: a\nreplicas: 1\n",
+		"team-b/helmfile.nix":      "{ ... }: [ ]",
+		"team-b.yaml":              "replicas: 3\n",
+	})
+	evaluator := &valuesEvaluator{
+		responses: map[string]string{
+			"root":   `[{"helmfiles":[{"path":"team-a/helmfile.nix","values":[{"replicas":2}]},"team-b/helmfile.nix","plain/helmfile.yaml"]}]`,
+			"team-a": `[{"releases":[{"name":"a","chart":"../chart"}]}]`,
+			"team-b": `[{"helmfiles":[{"path":"../team-a/helmfile.nix","values":["../team-b.yaml"]}]}]`,
+		},
+		values: map[string]string{},
+	}
+	renderer := NewRenderer(testEval, evaluator, RendererOptions{Temp: testTemp(t), StateValues: environment.StateValues{Set: []string{"override=yes"}}})
+
+	yaml, cleanup, err := renderer.Render(t.Context(), "helmfile.nix", base, "dev", "/dev/null")
+	if err != nil {
+		t.Fatalf("Render() unexpected error: %v", err)
+	}
+	generated := regexp.MustCompile(`(team-[ab])/helmfile\.\d+\.yaml`).FindAllString(string(yaml), -1)
+	if len(generated) != 2 || !strings.Contains(string(yaml), "- plain/helmfile.yaml") {
+		t.Fatalf("Render() expected .nix helmfiles to be replaced, got:\n%s", yaml)
+	}
+	if len(cleanup) != 3 {
+		t.Errorf("Render() expected generated files in cleanup, got: %v", cleanup)
+	}
+
+	content, err := os.ReadFile(filepath.Join(base, generated[0]))
+	if err != nil {
+		t.Fatalf("Render() generated file missing: %v", err)
+	}
+	if string(content) != "releases:\n    - chart: ../chart\n      name: a\n" {
+		t.Errorf("Render() unexpected nested helmfile: %q", content)
+	}
+
+	// Values of the sub helmfile's env, the helmfiles entry and the overrides, in order.
+	if evaluator.values["team-a"] != `{"override":"yes","replicas":3,"team":"a"}` {
+		t.Errorf("Render() unexpected values for nested helmfile: %s", evaluator.values["team-a"])
+	}
+}
+
+func TestRenderer_Render_HelmfilesCycle(t *testing.T) {
+	t.Parallel()
+	base := writeHelmfiles(t, map[string]string{
+		"helmfile.nix":        "{ ... }: [ ]",
+		"team-a/helmfile.nix": "{ ... }: [ ]",
+	})
+	evaluator := &valuesEvaluator{
+		responses: map[string]string{
+			"root":   `[{"helmfiles":["team-a/helmfile.nix"]}]`,
+			"team-a": `[{"helmfiles":["../helmfile.nix"]}]`,
+		},
+		values: map[string]string{},
+	}
+	renderer := NewRenderer(testEval, evaluator, RendererOptions{})
+
+	_, _, err := renderer.Render(t.Context(), "helmfile.nix", base, "dev", "/dev/null")
+	if !errors.Is(err, ErrHelmfileCycle) {
+		t.Errorf("Render() error = %v, want %v", err, ErrHelmfileCycle)
+	}
+}
+
+func TestRenderer_Render_HelmfilesInvalidValues(t *testing.T) {
+	t.Parallel()
+	base := writeHelmfiles(t, map[string]string{"helmfile.nix": "{ ... }: [ ]"})
+	evaluator := &valuesEvaluator{
+		responses: map[string]string{"root": `[{"helmfiles":[{"path":"team-a/helmfile.nix","values":[1]}]}]`},
+		values:    map[string]string{},
+	}
+	renderer := NewRenderer(testEval, evaluator, RendererOptions{})
+
+	_, _, err := renderer.Render(t.Context(), "helmfile.nix", base, "dev", "/dev/null")
+	if !errors.Is(err, ErrInvalidValues) {
+		t.Errorf("Render() error = %v, want %v", err, ErrInvalidValues)
+	}
+}
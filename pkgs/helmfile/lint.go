@@ -0,0 +1,67 @@
+package helmfile
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/schema"
+)
+
+// Schema of helmfile state documents, covering the fields helmfile-nix users write.
+//
+//go:embed schema.json
+var stateSchemaJSON []byte
+
+var stateSchema = schema.MustParse(stateSchemaJSON)
+
+// Finding is a problem found by Lint in a rendered helmfile.
+type Finding struct {
+	// Document is the 1-based index of the YAML document the finding is in.
+	Document int `json:"document"`
+	schema.Finding
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("document %d: %s", f.Document, f.Finding)
+}
+
+// Lint checks every document of a rendered helmfile against the built-in helmfile state schema.
+// Go template expressions are accepted wherever a scalar is expected, as they are only
+// resolved by helmfile.
+func Lint(content []byte) ([]Finding, error) {
+	var findings []Finding
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	for doc := 1; ; doc++ {
+		var v any
+		err := dec.Decode(&v)
+		if errors.Is(err, io.EOF) {
+			return findings, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse rendered helmfile: %w", err)
+		}
+
+		for _, f := range stateSchema.Validate(v) {
+			if s, ok := f.Value.(string); ok && strings.Contains(s, "{{") {
+				continue
+			}
+			findings = append(findings, Finding{Document: doc, Finding: f})
+		}
+	}
+}
+
+// FormatFindings writes one line per finding, each starting with prefix.
+func FormatFindings(w io.Writer, prefix string, findings []Finding) error {
+	var buf bytes.Buffer
+	for _, f := range findings {
+		fmt.Fprintf(&buf, "%s%s\n", prefix, f)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
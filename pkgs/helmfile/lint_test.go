@@ -0,0 +1,102 @@
+package helmfile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	t.Parallel()
+	content := `environments:
+    dev:
+        values: []
+---
+repositories:
+    - name: stable
+      url: https://charts.example.com
+releases:
+    - name: a
+      chart: stable/a
+      hooks:
+        - events: [presync]
+          command: echo
+    - name: b
+      chart: [stable/b]
+    - name: c
+      chart: stable/c
+      installed: '{{ .Values.enabled }}'
+    - name: d
+      chart: stable/d
+      namspace: web
+      hooks:
+        - events: [beforesync]
+          command: echo
+`
+	findings, err := Lint([]byte(content))
+	if err != nil {
+		t.Fatalf("Lint() error: %v", err)
+	}
+
+	var got []string
+	for _, f := range findings {
+		got = append(got, f.String())
+	}
+	want := []string{
+		"document 2: releases[1].chart: expected string, got array",
+		`document 2: releases[3].hooks[0].events[0]: must be one of "prepare", "preapply", "presync", "preuninstall", "postuninstall", "postsync", "cleanup"`,
+		`document 2: releases[3].namspace: unknown field, did you mean "namespace"?`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Lint() =\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLint_TopLevel(t *testing.T) {
+	t.Parallel()
+	findings, err := Lint([]byte("relases: []\nhelmDefaults:\n    wait: yes please\n"))
+	if err != nil {
+		t.Fatalf("Lint() error: %v", err)
+	}
+
+	var got []string
+	for _, f := range findings {
+		got = append(got, f.String())
+	}
+	want := []string{
+		"document 1: helmDefaults.wait: expected boolean, got string",
+		`document 1: relases: unknown field, did you mean "releases"?`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Lint() = %q, want %q", got, want)
+	}
+}
+
+func TestLint_InvalidYAML(t *testing.T) {
+	t.Parallel()
+	if _, err := Lint([]byte("releases: [")); err == nil {
+		t.Error("Lint() expected an error for invalid YAML")
+	}
+}
+
+func TestFormatFindings(t *testing.T) {
+	t.Parallel()
+	findings, err := Lint([]byte("releases:\n    - name: a\n      chart: [a]\n    - chart: b\n"))
+	if err != nil {
+		t.Fatalf("Lint() error: %v", err)
+	}
+
+	var buf strings.Builder
+	if err := FormatFindings(&buf, "dev: ", findings); err != nil {
+		t.Fatalf("FormatFindings() error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(findings) || len(findings) == 0 {
+		t.Fatalf("FormatFindings() = %q, want a line for each of %v", buf.String(), findings)
+	}
+	for i, line := range lines {
+		if line != "dev: "+findings[i].String() {
+			t.Errorf("FormatFindings() line %d = %q, want %q", i, line, "dev: "+findings[i].String())
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package helmfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Redacted replaces secrets in rendered output.
+const Redacted = "<redacted>"
+
+// Redact replaces every occurrence of the secrets in the string values of rendered YAML documents,
+// and numbers and booleans equal to a secret. Longer secrets should come first, so a secret
+// containing another one is redacted whole.
+func Redact(content []byte, secrets []string) ([]byte, error) {
+	if len(secrets) == 0 {
+		return content, nil
+	}
+
+	var out []byte
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var doc any
+		if err := dec.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+
+		res, err := yaml.Marshal(redact(doc, secrets))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > 0 {
+			out = append(out, []byte("---\n")...)
+		}
+		out = append(out, res...)
+	}
+	return out, nil
+}
+
+func redact(v any, secrets []string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, c := range v {
+			v[k] = redact(c, secrets)
+		}
+	case []any:
+		for i, c := range v {
+			v[i] = redact(c, secrets)
+		}
+	case string:
+		for _, s := range secrets {
+			v = strings.ReplaceAll(v, s, Redacted)
+		}
+		return v
+	case int, int64, uint64, float64, bool:
+		if slices.Contains(secrets, fmt.Sprint(v)) {
+			return Redacted
+		}
+	}
+	return v
+}
@@ -0,0 +1,52 @@
+package helmfile
+
+import (
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	t.Parallel()
+	content := []byte(`releases:
+    - name: db
+      values:
+        - password: hunter2
+          url: postgres://admin:hunter2@db:5432
+          port: 5432
+---
+environments:
+    dev:
+        values:
+            - hunter2
+`)
+	want := `releases:
+    - name: db
+      values:
+        - password: <redacted>
+          port: 5432
+          url: postgres://admin:<redacted>@db:5432
+---
+environments:
+    dev:
+        values:
+            - <redacted>
+`
+
+	got, err := Redact(content, []string{"hunter2"})
+	if err != nil {
+		t.Fatalf("Redact() error: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("Redact() = %s, want %s", got, want)
+	}
+
+	// Secrets decrypted as numbers are rendered as numbers.
+	got, err = Redact([]byte("port: 5432\nreplicas: 2\n"), []string{"5432"})
+	if err != nil || string(got) != "port: <redacted>\nreplicas: 2\n" {
+		t.Errorf("Redact() of a number = %s, %v", got, err)
+	}
+
+	got, err = Redact(content, nil)
+	if err != nil || string(got) != string(content) {
+		t.Errorf("Redact() without secrets = %s, %v, want the content unchanged", got, err)
+	}
+}
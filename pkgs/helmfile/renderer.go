@@ -2,11 +2,16 @@ package helmfile
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
 
+	"github.com/reMarkable/helmfile-nix/pkgs/cache"
+	"github.com/reMarkable/helmfile-nix/pkgs/environment"
 	"github.com/reMarkable/helmfile-nix/pkgs/nixchart"
 	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
 	"github.com/reMarkable/helmfile-nix/pkgs/tempfiles"
@@ -15,64 +20,187 @@ import (
 
 // Renderer handles rendering helmfile configurations via Nix evaluation.
 type Renderer struct {
-	evalNix        string
-	showTrace      bool
-	stateValuesSet []string
-	logger         *log.Logger
+	evalNix      string
+	evaluator    nixeval.Evaluator
+	lib          string
+	cache        *cache.Cache
+	temp         *tempfiles.Manager
+	charts       *nixchart.Renderer
+	valuesWriter *environment.ValuesWriter
+	showTrace    bool
+	stateValues  environment.StateValues
+	logger       *log.Logger
 }
 
-// NewRenderer creates a new helmfile renderer.
-func NewRenderer(evalNix string, showTrace bool, stateValuesSet []string, logger *log.Logger) *Renderer {
+// RendererOptions configures a Renderer. The zero value is valid.
+type RendererOptions struct {
+	// Lib is the path to a local nixpkgs lib, or empty to fetch the pinned one.
+	Lib string
+	// Cache caches evaluations, unless it is nil.
+	Cache *cache.Cache
+	// Temp has the workspace rendered charts go in, and removes the generated files on Cleanup.
+	// A new one is used if it is nil.
+	Temp *tempfiles.Manager
+	// ValuesWriter provides the values of nested helmfile.nix files, a default one is used if it is nil.
+	ValuesWriter *environment.ValuesWriter
+	// ShowTrace passes --show-trace to nix.
+	ShowTrace bool
+	// StateValues are the state values given on the command line, for nested helmfile.nix files.
+	StateValues environment.StateValues
+	// Logger is log.Default() if it is nil.
+	Logger *log.Logger
+}
+
+// NewRenderer creates a new helmfile renderer, evaluating helmfiles with the eval.nix in evalNix.
+// The evaluator is used both for the helmfile itself and for any nixCharts it references.
+func NewRenderer(evalNix string, evaluator nixeval.Evaluator, opts RendererOptions) *Renderer {
+	if opts.Temp == nil {
+		opts.Temp = tempfiles.NewManager()
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
+	if opts.ValuesWriter == nil {
+		opts.ValuesWriter = environment.NewValuesWriter(environment.ValuesWriterOptions{
+			Evaluator: evaluator,
+			Cache:     opts.Cache,
+			Temp:      opts.Temp,
+			Logger:    opts.Logger,
+		})
+	}
 	return &Renderer{
-		evalNix:        evalNix,
-		showTrace:      showTrace,
-		stateValuesSet: stateValuesSet,
-		logger:         logger,
+		evalNix:      evalNix,
+		evaluator:    evaluator,
+		lib:          opts.Lib,
+		cache:        opts.Cache,
+		temp:         opts.Temp,
+		charts:       nixchart.NewRenderer(evaluator, opts.Lib, opts.Cache, opts.Temp),
+		valuesWriter: opts.ValuesWriter,
+		showTrace:    opts.ShowTrace,
+		stateValues:  opts.StateValues,
+		logger:       opts.Logger,
 	}
 }
 
 // Render renders the helmfile using Nix evaluation.
-// Returns the rendered YAML content and a slice of temporary chart directories that need cleanup.
+// Returns the rendered YAML content and the chart directories and files it generated,
+// which are removed with the workspace.
 func (r *Renderer) Render(ctx context.Context, fileName, base, env, valuesJSONPath string) ([]byte, []string, error) {
-	f, err := tempfiles.WriteEvalNix(r.evalNix)
+	return r.render(ctx, fileName, base, env, valuesJSONPath, nil)
+}
+
+// render renders a helmfile, parents are the helmfiles that include it through `helmfiles`.
+func (r *Renderer) render(ctx context.Context, fileName, base, env, valuesJSONPath string, parents []string) ([]byte, []string, error) {
+	// The cache outlives the run, so evaluations with decrypted secrets are not written to it.
+	if r.cache != nil {
+		secrets, err := hasSecrets(valuesJSONPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read values: %w", err)
+		}
+		if secrets {
+			r = r.withoutCache()
+		}
+	}
+
+	evalFile, err := r.temp.WriteTemp("eval.*.nix", []byte(r.evalNix))
 	if err != nil {
 		return nil, nil, fmt.Errorf("could not write eval.nix: %w", err)
 	}
+	defer r.temp.Remove(evalFile)
 
-	defer func() {
-		if err := os.Remove(f.Name()); err != nil {
-			r.logger.Fatalf("Could not remove eval.nix: %s", err)
+	expr := fmt.Sprintf(`%s.render "%s" "%s" "%s" "%s"`, nixeval.ImportEval(evalFile, r.lib), fileName, base, env, valuesJSONPath)
+	json, err := r.cache.Eval(ctx, r.evaluator, expr, r.showTrace, func(k *cache.Key) error {
+		k.AddString("eval.nix", r.evalNix)
+		if err := k.AddLib(r.lib); err != nil {
+			return err
 		}
-	}()
-
-	expr := fmt.Sprintf(`(import %s).render "%s" "%s" "%s" "%s"`, f.Name(), fileName, base, env, valuesJSONPath)
-	ne := nixeval.NewNixEval(expr)
-	cmd := ne.Args(r.showTrace)
-	json, err := ne.Eval(ctx, cmd)
+		k.AddString("env", env)
+		if err := addValues(k, valuesJSONPath); err != nil {
+			return err
+		}
+		return k.AddNixClosure(filepath.Join(base, fileName))
+	})
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to eval nix: %w\n%s", err, json)
+		return nil, nil, fmt.Errorf("failed to eval nix: %w", err)
 	}
 
 	var cleanup []string
+	var renderErr error
+	parents = append(slices.Clip(parents), filepath.Join(base, fileName))
 	yaml, err := transform.JSONToYAMLs(json, func(v any) {
-		if reflect.TypeOf(v).Kind() == reflect.Map {
-			// Check if map has a list of releases
-			vMap, ok := v.(map[string]any)
-			if !ok {
+		if v == nil || reflect.TypeOf(v).Kind() != reflect.Map || renderErr != nil {
+			return
+		}
+		vMap, ok := v.(map[string]any)
+		if !ok {
+			return
+		}
+
+		// Check if map has a list of releases
+		if _, ok := vMap["releases"]; ok {
+			rendered, err := r.charts.RenderCharts(ctx, vMap, base)
+			cleanup = append(cleanup, rendered...)
+			if err != nil {
+				renderErr = fmt.Errorf("failed to render charts: %w", err)
 				return
 			}
-			if _, ok := vMap["releases"]; ok {
-				var err error
-				cleanup, err = nixchart.RenderCharts(ctx, vMap, base)
-				if err != nil {
-					r.logger.Fatalf("Failed to render charts: %s", err)
-				}
+
+			rendered, err = r.renderValuesFiles(ctx, vMap, evalFile, base, env, valuesJSONPath)
+			cleanup = append(cleanup, rendered...)
+			if err != nil {
+				renderErr = fmt.Errorf("failed to render values: %w", err)
+				return
+			}
+		}
+
+		// Check if map includes other helmfiles
+		if _, ok := vMap["helmfiles"]; ok {
+			rendered, err := r.renderHelmfiles(ctx, vMap, base, env, parents)
+			cleanup = append(cleanup, rendered...)
+			if err != nil {
+				renderErr = fmt.Errorf("failed to render helmfiles: %w", err)
 			}
 		}
 	})
+	if renderErr != nil {
+		return nil, nil, renderErr
+	}
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to convert JSON to YAML: %w\n%s", err, json)
 	}
 
 	return yaml, cleanup, nil
 }
+
+// addValues adds the content of the values JSON file to the key. Its path is left out,
+// as the file is written to a new temporary file on every run.
+func addValues(k *cache.Key, valuesJSONPath string) error {
+	data, err := os.ReadFile(valuesJSONPath)
+	if err != nil {
+		return err
+	}
+	k.Add("values", data)
+	return nil
+}
+
+// hasSecrets returns whether the values JSON file has decrypted secrets.
+func hasSecrets(valuesJSONPath string) (bool, error) {
+	data, err := os.ReadFile(valuesJSONPath)
+	if err != nil {
+		return false, err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return false, err
+	}
+	_, ok := values[environment.SecretsKey]
+	return ok, nil
+}
+
+// withoutCache returns a copy of r that does not cache evaluations, also of nested helmfiles and nixCharts.
+func (r *Renderer) withoutCache() *Renderer {
+	c := *r
+	c.cache = nil
+	c.charts = r.charts.WithoutCache()
+	return &c
+}
@@ -1,18 +1,28 @@
 package helmfile
 
 import (
+	"errors"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/cache"
+	"github.com/reMarkable/helmfile-nix/pkgs/environment"
+	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
+	"github.com/reMarkable/helmfile-nix/pkgs/tempfiles"
 )
 
+var errBoom = errors.New("boom")
+
+// Resolved at init, as executor tests change the working directory.
+var testDataDir, _ = filepath.Abs(filepath.Join("..", "..", "testData"))
+
 var testEval = `
+{ lib ? null }:
 {
   render = file: state: env: val:
-    let
-      lib = (builtins.getFlake "nixpkgs").lib;
-    in
       [{ test = "output"; }];
 }
 `
@@ -20,7 +30,8 @@ var testEval = `
 func TestRenderer_Render_Success(t *testing.T) {
 	t.Parallel()
 	logger := log.Default()
-	renderer := NewRenderer(testEval, false, []string{}, logger)
+	evaluator := nixeval.NewFake().Respond("test.nix", []byte(`[{"test":"output"}]`))
+	renderer := NewRenderer(testEval, evaluator, RendererOptions{Logger: logger})
 
 	// Create temporary values file
 	tmpDir := t.TempDir()
@@ -41,21 +52,17 @@ func TestRenderer_Render_Success(t *testing.T) {
 
 	// Render with test eval
 	yaml, cleanup, err := renderer.Render(t.Context(), "test.nix", tmpDir, "dev", valFile.Name())
-	// Note: This will likely fail if nix isn't installed or the eval is invalid
-	// but we're testing the function structure
 	if err != nil {
-		// Check if it's a "nix not found" error, which is acceptable
-		if !strings.Contains(err.Error(), "executable file not found") &&
-			!strings.Contains(err.Error(), "no such file or directory") &&
-			!strings.Contains(err.Error(), "failed to eval nix") {
-			t.Errorf("Render() unexpected error: %v", err)
-		}
-		return
+		t.Fatalf("Render() unexpected error: %v", err)
 	}
 
-	// If successful, verify we got output
-	if yaml == nil {
-		t.Error("Render() returned nil yaml")
+	if string(yaml) != "test: output\n" {
+		t.Errorf("Render() unexpected yaml: %q", yaml)
+	}
+
+	calls := evaluator.Calls()
+	if len(calls) != 1 || !strings.Contains(calls[0], `"test.nix" "`+tmpDir+`" "dev" "`+valFile.Name()+`"`) {
+		t.Errorf("Render() unexpected expression: %v", calls)
 	}
 
 	// cleanup is nil when there are no nixCharts to render, which is expected for this test
@@ -67,7 +74,8 @@ func TestRenderer_Render_Success(t *testing.T) {
 func TestRenderer_Render_InvalidValuesPath(t *testing.T) {
 	t.Parallel()
 	logger := log.Default()
-	renderer := NewRenderer(testEval, false, []string{}, logger)
+	evaluator := nixeval.NewFake().Respond("", []byte(`[{"test":"output"}]`))
+	renderer := NewRenderer(testEval, evaluator, RendererOptions{Logger: logger})
 
 	tmpDir := t.TempDir()
 
@@ -75,16 +83,9 @@ func TestRenderer_Render_InvalidValuesPath(t *testing.T) {
 	// Note: nix eval doesn't validate the values file path at eval time,
 	// so this test verifies the function completes without panicking
 	yaml, _, err := renderer.Render(t.Context(), "test.nix", tmpDir, "dev", "/nonexistent/values.json")
-
-	// The render should still succeed since nix doesn't read the values file
+	// The render should still succeed since testEval doesn't read the values file
 	if err != nil {
-		// Accept nix-related errors (not installed, eval failure)
-		if !strings.Contains(err.Error(), "executable file not found") &&
-			!strings.Contains(err.Error(), "no such file or directory") &&
-			!strings.Contains(err.Error(), "failed to eval nix") {
-			t.Errorf("Render() unexpected error: %v", err)
-		}
-		return
+		t.Fatalf("Render() unexpected error: %v", err)
 	}
 
 	if yaml == nil {
@@ -92,11 +93,138 @@ func TestRenderer_Render_InvalidValuesPath(t *testing.T) {
 	}
 }
 
+func TestRenderer_Render_EvalError(t *testing.T) {
+	t.Parallel()
+	logger := log.Default()
+	evaluator := nixeval.NewFake().Fail("test.nix", errBoom)
+	renderer := NewRenderer(testEval, evaluator, RendererOptions{Logger: logger})
+
+	_, _, err := renderer.Render(t.Context(), "test.nix", t.TempDir(), "dev", "/nonexistent/values.json")
+	if !errors.Is(err, errBoom) {
+		t.Errorf("Render() error = %v, want %v", err, errBoom)
+	}
+}
+
+func TestRenderer_Render_NixChart(t *testing.T) {
+	t.Parallel()
+	logger := log.Default()
+	evaluator := nixeval.NewFake().
+		Respond("chart.nix", []byte(`[{"kind":"ConfigMap"}]`)).
+		Respond("helmfile.nix", []byte(`[{"releases":[{"name":"fake-nixchart","namespace":"fake","nixChart":"nixChart"}]}]`))
+	renderer := NewRenderer(testEval, evaluator, RendererOptions{Temp: testTemp(t), Logger: logger})
+
+	yaml, cleanup, err := renderer.Render(t.Context(), "helmfile.nix", testDataDir, "dev", "/nonexistent/values.json")
+	if err != nil {
+		t.Fatalf("Render() unexpected error: %v", err)
+	}
+	if len(cleanup) != 1 {
+		t.Fatalf("Render() expected one chart directory, got %v", cleanup)
+	}
+	if !strings.Contains(string(yaml), "chart: "+cleanup[0]) || strings.Contains(string(yaml), "nixChart:") {
+		t.Errorf("Render() expected nixChart to be replaced by chart path, got:\n%s", yaml)
+	}
+}
+
+func TestRenderer_Render_LocalLib(t *testing.T) {
+	t.Parallel()
+	logger := log.Default()
+	evaluator := nixeval.NewFake().Respond("", []byte(`[]`))
+	renderer := NewRenderer(testEval, evaluator, RendererOptions{Lib: "/opt/nixpkgs/lib", Logger: logger})
+
+	if _, _, err := renderer.Render(t.Context(), "test.nix", t.TempDir(), "dev", "/nonexistent/values.json"); err != nil {
+		t.Fatalf("Render() unexpected error: %v", err)
+	}
+
+	calls := evaluator.Calls()
+	if len(calls) != 1 || !strings.Contains(calls[0], `lib = import "/opt/nixpkgs/lib";`) {
+		t.Errorf("Render() expected local lib in expression, got: %v", calls)
+	}
+}
+
+func TestRenderer_Render_Cache(t *testing.T) {
+	t.Parallel()
+	logger := log.Default()
+	tmpDir := t.TempDir()
+	hfPath := filepath.Join(tmpDir, "helmfile.nix")
+	if err := os.WriteFile(hfPath, []byte("{ ... }: [ ]"), 0o600); err != nil {
+		t.Fatalf("Failed to write helmfile: %v", err)
+	}
+
+	evaluator := nixeval.NewFake().Respond("", []byte(`[{"test":"output"}]`))
+	renderer := NewRenderer(testEval, evaluator, RendererOptions{Cache: cache.New(t.TempDir(), "test"), Logger: logger})
+
+	render := func(env string) {
+		t.Helper()
+		// Like a run of helmfile-nix, which writes the values to a new temporary file.
+		valPath := filepath.Join(t.TempDir(), "val.json")
+		if err := os.WriteFile(valPath, []byte("{}"), 0o600); err != nil {
+			t.Fatalf("Failed to write values: %v", err)
+		}
+		yaml, _, err := renderer.Render(t.Context(), "helmfile.nix", tmpDir, env, valPath)
+		if err != nil {
+			t.Fatalf("Render() unexpected error: %v", err)
+		}
+		if string(yaml) != "test: output\n" {
+			t.Errorf("Render() unexpected yaml: %q", yaml)
+		}
+	}
+
+	render("dev")
+	render("dev")
+	if len(evaluator.Calls()) != 1 {
+		t.Errorf("Render() should hit the cache, got %d evaluations", len(evaluator.Calls()))
+	}
+
+	render("prod")
+	if err := os.WriteFile(hfPath, []byte("{ ... }: [ { } ]"), 0o600); err != nil {
+		t.Fatalf("Failed to update helmfile: %v", err)
+	}
+	render("dev")
+	if len(evaluator.Calls()) != 3 {
+		t.Errorf("Render() should miss on changed inputs, got %d evaluations", len(evaluator.Calls()))
+	}
+}
+
+func TestRenderer_Render_SecretsNotCached(t *testing.T) {
+	t.Parallel()
+	tmpDir := t.TempDir()
+	hfPath := filepath.Join(tmpDir, "helmfile.nix")
+	valPath := filepath.Join(tmpDir, "val.json")
+	chartPath := filepath.Join(tmpDir, "chart", "chart.nix")
+	if err := os.Mkdir(filepath.Dir(chartPath), 0o700); err != nil {
+		t.Fatalf("Failed to create chart: %v", err)
+	}
+	for p, content := range map[string]string{hfPath: "{ ... }: [ ]", chartPath: "{ ... }: [ ]", valPath: `{"secrets":{"password":"hunter2"}}`} {
+		if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", p, err)
+		}
+	}
+
+	evaluator := nixeval.NewFake().Respond("", []byte(`[{"releases":[{"name":"db","nixChart":"./chart","values":[{"password":"hunter2"}]}]}]`))
+	cacheDir := t.TempDir()
+	temp := tempfiles.NewManager()
+	t.Cleanup(temp.Cleanup)
+	renderer := NewRenderer(testEval, evaluator, RendererOptions{Cache: cache.New(cacheDir, "test"), Temp: temp})
+
+	for range 2 {
+		if _, _, err := renderer.Render(t.Context(), "helmfile.nix", tmpDir, "dev", valPath); err != nil {
+			t.Fatalf("Render() unexpected error: %v", err)
+		}
+	}
+	// The helmfile and the nixChart are evaluated on every render.
+	if len(evaluator.Calls()) != 4 {
+		t.Errorf("Render() should not use the cache with secrets, got %d evaluations", len(evaluator.Calls()))
+	}
+	if entries, _ := os.ReadDir(filepath.Join(cacheDir, "eval")); len(entries) != 0 {
+		t.Errorf("Render() should not write secrets to the cache, got %d entries", len(entries))
+	}
+}
+
 func TestRenderer_Render_ShowTrace(t *testing.T) {
 	t.Parallel()
 	logger := log.Default()
-	rendererWithTrace := NewRenderer(testEval, true, []string{}, logger)
-	rendererWithoutTrace := NewRenderer(testEval, false, []string{}, logger)
+	rendererWithTrace := NewRenderer(testEval, nixeval.NewFake(), RendererOptions{ShowTrace: true, Logger: logger})
+	rendererWithoutTrace := NewRenderer(testEval, nixeval.NewFake(), RendererOptions{Logger: logger})
 
 	// Verify that showTrace setting is stored
 	if !rendererWithTrace.showTrace {
@@ -111,16 +239,16 @@ func TestRenderer_Render_ShowTrace(t *testing.T) {
 func TestRenderer_Render_WithStateValuesSet(t *testing.T) {
 	t.Parallel()
 	logger := log.Default()
-	overrides := []string{"foo=bar", "baz=qux"}
-	renderer := NewRenderer(testEval, false, overrides, logger)
+	overrides := environment.StateValues{Set: []string{"foo=bar", "baz=qux"}}
+	renderer := NewRenderer(testEval, nixeval.NewFake(), RendererOptions{StateValues: overrides, Logger: logger})
 
 	// Verify that state values are stored
-	if len(renderer.stateValuesSet) != 2 {
-		t.Errorf("NewRenderer() expected 2 state values, got: %d", len(renderer.stateValuesSet))
+	if len(renderer.stateValues.Set) != 2 {
+		t.Errorf("NewRenderer() expected 2 state values, got: %d", len(renderer.stateValues.Set))
 	}
 
-	if renderer.stateValuesSet[0] != "foo=bar" {
-		t.Errorf("NewRenderer() state value mismatch. Expected: foo=bar, got: %s", renderer.stateValuesSet[0])
+	if renderer.stateValues.Set[0] != "foo=bar" {
+		t.Errorf("NewRenderer() state value mismatch. Expected: foo=bar, got: %s", renderer.stateValues.Set[0])
 	}
 }
 
@@ -129,9 +257,10 @@ func TestRenderer_NewRenderer(t *testing.T) {
 	logger := log.Default()
 	evalNix := "test eval content"
 	showTrace := true
-	stateValues := []string{"test=value"}
+	stateValues := environment.StateValues{Set: []string{"test=value"}}
 
-	renderer := NewRenderer(evalNix, showTrace, stateValues, logger)
+	evaluator := nixeval.NewFake()
+	renderer := NewRenderer(evalNix, evaluator, RendererOptions{ShowTrace: showTrace, StateValues: stateValues, Logger: logger})
 
 	if renderer == nil {
 		t.Fatal("NewRenderer() returned nil")
@@ -145,11 +274,30 @@ func TestRenderer_NewRenderer(t *testing.T) {
 		t.Errorf("NewRenderer() showTrace mismatch. Expected: %v, got: %v", showTrace, renderer.showTrace)
 	}
 
-	if len(renderer.stateValuesSet) != len(stateValues) {
-		t.Errorf("NewRenderer() stateValuesSet length mismatch. Expected: %d, got: %d", len(stateValues), len(renderer.stateValuesSet))
+	if len(renderer.stateValues.Set) != len(stateValues.Set) {
+		t.Errorf("NewRenderer() stateValuesSet length mismatch. Expected: %d, got: %d", len(stateValues.Set), len(renderer.stateValues.Set))
 	}
 
 	if renderer.logger != logger {
 		t.Error("NewRenderer() logger mismatch")
 	}
+
+	if renderer.evaluator != evaluator {
+		t.Error("NewRenderer() evaluator mismatch")
+	}
+}
+
+func TestRenderer_NewRenderer_ZeroOptions(t *testing.T) {
+	t.Parallel()
+	renderer := NewRenderer(testEval, nixeval.NewFake(), RendererOptions{})
+	if renderer.temp == nil || renderer.valuesWriter == nil || renderer.charts == nil || renderer.logger == nil {
+		t.Errorf("NewRenderer() did not default the options it was not given: %+v", renderer)
+	}
+}
+
+func testTemp(t *testing.T) *tempfiles.Manager {
+	t.Helper()
+	temp := tempfiles.NewManager()
+	t.Cleanup(temp.Cleanup)
+	return temp
 }
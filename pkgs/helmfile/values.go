@@ -0,0 +1,99 @@
+package helmfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/cache"
+	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
+	"github.com/reMarkable/helmfile-nix/pkgs/transform"
+)
+
+// ErrEvalValues is returned when a values .nix file of a release can not be evaluated.
+var ErrEvalValues = errors.New("failed to evaluate values")
+
+// renderValuesFiles evaluates every `.nix` file in the `values` of the releases in doc,
+// and points the entries to generated YAML files in the workspace instead.
+// Returns the generated files, which need cleanup.
+func (r *Renderer) renderValuesFiles(ctx context.Context, doc map[string]any, evalFile, base, env, valuesJSONPath string) ([]string, error) {
+	releases, ok := doc["releases"].([]any)
+	if !ok {
+		return nil, nil
+	}
+
+	var cleanup []string
+	for _, rel := range releases {
+		release, ok := rel.(map[string]any)
+		if !ok {
+			continue
+		}
+		values, ok := release["values"].([]any)
+		if !ok {
+			continue
+		}
+
+		for i, v := range values {
+			file, ok := v.(string)
+			if !ok || !strings.HasSuffix(file, ".nix") {
+				continue
+			}
+
+			generated, err := r.renderValuesFile(ctx, file, evalFile, base, env, valuesJSONPath)
+			if err != nil {
+				return cleanup, fmt.Errorf("release %s: %w", releaseID(release), err)
+			}
+			cleanup = append(cleanup, generated)
+			values[i] = generated
+		}
+	}
+	return cleanup, nil
+}
+
+// renderValuesFile evaluates a values .nix file with the same arguments as helmfile.nix,
+// and writes the result to a YAML file in the workspace, named after the .nix file.
+// The name is the same on every run, so exported and compared helmfiles do not change with it.
+func (r *Renderer) renderValuesFile(ctx context.Context, file, evalFile, base, env, valuesJSONPath string) (string, error) {
+	if filepath.IsAbs(file) {
+		rel, err := filepath.Rel(base, file)
+		if err != nil {
+			return "", err
+		}
+		file = rel
+	}
+
+	expr := fmt.Sprintf(`%s.renderValues "%s" "%s" "%s" "%s"`, nixeval.ImportEval(evalFile, r.lib), file, base, env, valuesJSONPath)
+	json, err := r.cache.Eval(ctx, r.evaluator, expr, r.showTrace, func(k *cache.Key) error {
+		k.AddString("eval.nix", r.evalNix)
+		if err := k.AddLib(r.lib); err != nil {
+			return err
+		}
+		k.AddString("env", env)
+		if err := addValues(k, valuesJSONPath); err != nil {
+			return err
+		}
+		return k.AddNixClosure(filepath.Join(base, file))
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w %s: %w", ErrEvalValues, file, err)
+	}
+
+	yaml, err := transform.JSONToYAML(json)
+	if err != nil {
+		return "", fmt.Errorf("%w %s: %w", ErrEvalValues, file, err)
+	}
+
+	// A directory of its own, as releases can use .nix files with the same name.
+	dir, err := r.temp.MkdirTemp("values-*")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, strings.TrimSuffix(filepath.Base(file), ".nix")+".values.yaml")
+	if err := os.WriteFile(path, yaml, 0o600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,77 @@
+package helmfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
+)
+
+func TestRenderer_Render_ValuesFiles(t *testing.T) {
+	t.Parallel()
+	base := writeHelmfiles(t, map[string]string{
+		"helmfile.nix":   "{ ... }: [ ]",
+		"values/app.nix": "{ var, ... }: { env = var.environment.name; }",
+		"values.json":    "{}",
+	})
+	evaluator := nixeval.NewFake().
+		Respond(`.renderValues "values/app.nix"`, []byte(`{"env":"dev","replicas":2}`)).
+		Respond(`.render "helmfile.nix"`, []byte(`[{"releases":[{"name":"app","values":["values/app.nix",{"inline":true},"plain.yaml"]}]}]`))
+	renderer := NewRenderer(testEval, evaluator, RendererOptions{Temp: testTemp(t)})
+
+	yaml, cleanup, err := renderer.Render(t.Context(), "helmfile.nix", base, "dev", filepath.Join(base, "values.json"))
+	if err != nil {
+		t.Fatalf("Render() unexpected error: %v", err)
+	}
+	if len(cleanup) != 1 || filepath.Base(cleanup[0]) != "app.values.yaml" || strings.HasPrefix(cleanup[0], base) {
+		t.Fatalf("Render() expected app.values.yaml in the workspace, got %v", cleanup)
+	}
+	expected := "releases:\n    - name: app\n      values:\n        - " + cleanup[0] + "\n        - inline: true\n        - plain.yaml\n"
+	if string(yaml) != expected {
+		t.Errorf("Render() unexpected yaml:\n%s\nwant:\n%s", yaml, expected)
+	}
+
+	content, err := os.ReadFile(cleanup[0])
+	if err != nil {
+		t.Fatalf("Failed to read generated values: %v", err)
+	}
+	if string(content) != "env: dev\nreplicas: 2\n" {
+		t.Errorf("Render() unexpected values file: %q", content)
+	}
+
+	outDir := t.TempDir()
+	if err := NewExporter(outDir).Export("helmfile.yaml", "", base, yaml, nil); err != nil {
+		t.Fatalf("Export() error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "values", "app.values.yaml")); err != nil {
+		t.Errorf("Export() did not copy the values by their stable name: %v", err)
+	}
+}
+
+func TestRenderer_Render_ValuesFilesError(t *testing.T) {
+	t.Parallel()
+	base := writeHelmfiles(t, map[string]string{
+		"helmfile.nix": "{ ... }: [ ]",
+		"values.json":  "{}",
+	})
+	evaluator := nixeval.NewFake().
+		Fail(`.renderValues`, errBoom).
+		Respond(`.render "helmfile.nix"`, []byte(`[{"releases":[{"name":"app","namespace":"web","values":["missing.nix"]}]}]`))
+	renderer := NewRenderer(testEval, evaluator, RendererOptions{})
+
+	_, _, err := renderer.Render(t.Context(), "helmfile.nix", base, "dev", filepath.Join(base, "values.json"))
+	if !errors.Is(err, ErrEvalValues) || !errors.Is(err, errBoom) {
+		t.Fatalf("Render() expected ErrEvalValues wrapping the eval error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "release web/app") {
+		t.Errorf("Render() error should name the release, got %v", err)
+	}
+
+	entries, _ := filepath.Glob(filepath.Join(base, "*.yaml"))
+	if len(entries) != 0 {
+		t.Errorf("Render() left generated values behind: %v", entries)
+	}
+}
@@ -2,7 +2,6 @@ package helmfile
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"strings"
 )
@@ -18,25 +17,26 @@ func NewWriter() *Writer {
 // WriteYAML writes the helmfile YAML to a temporary file in the base directory.
 // The caller is responsible for removing the file after use.
 func (w *Writer) WriteYAML(fileName, base string, content []byte) (*os.File, error) {
-	extension := "yaml"
-	if strings.HasSuffix(fileName, ".gotmpl.nix") {
-		extension = "yaml.gotmpl"
-	}
-
-	f, err := os.CreateTemp(base, fmt.Sprintf("helmfile.*.%s", extension))
+	f, err := os.CreateTemp(base, fmt.Sprintf("helmfile.*.%s", YAMLExtension(fileName)))
 	if err != nil {
 		return nil, err
 	}
 
-	defer func() {
-		if err := f.Close(); err != nil {
-			log.Fatalf("Could not close helmfile.yaml: %s", err)
-		}
-	}()
-
-	if _, err := f.Write(content); err != nil {
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
 		return nil, err
 	}
-
 	return f, nil
 }
+
+// YAMLExtension returns the extension helmfile expects for the rendered form of a helmfile.nix.
+func YAMLExtension(fileName string) string {
+	if strings.HasSuffix(fileName, ".gotmpl.nix") {
+		return "yaml.gotmpl"
+	}
+	return "yaml"
+}
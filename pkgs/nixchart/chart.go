@@ -0,0 +1,278 @@
+package nixchart
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/transform"
+)
+
+// Defaults of the chart metadata.
+const (
+	DefaultAPIVersion = "v2"
+	DefaultVersion    = "0.1.0"
+	DefaultType       = "application"
+)
+
+// ErrInvalidChart is returned when a chart.nix does not evaluate to a list of resources or a chart.
+var ErrInvalidChart = errors.New("invalid chart")
+
+// HookEvents are the helm hook events, in the order hooks are laid out.
+var HookEvents = []string{
+	"pre-install", "post-install",
+	"pre-upgrade", "post-upgrade",
+	"pre-rollback", "post-rollback",
+	"pre-delete", "post-delete",
+	"test",
+}
+
+// Annotations helm reads hooks from.
+const (
+	HookAnnotation             = "helm.sh/hook"
+	HookWeightAnnotation       = "helm.sh/hook-weight"
+	HookDeletePolicyAnnotation = "helm.sh/hook-delete-policy"
+)
+
+// Metadata is the Chart.yaml of a nixChart, as given in `meta`.
+type Metadata struct {
+	APIVersion  string            `json:"apiVersion"            yaml:"apiVersion"`
+	Name        string            `json:"name"                  yaml:"name"`
+	Version     string            `json:"version"               yaml:"version"`
+	KubeVersion string            `json:"kubeVersion,omitempty" yaml:"kubeVersion,omitempty"`
+	Description string            `json:"description,omitempty" yaml:"description,omitempty"`
+	Type        string            `json:"type,omitempty"        yaml:"type,omitempty"`
+	Keywords    []string          `json:"keywords,omitempty"    yaml:"keywords,omitempty"`
+	Home        string            `json:"home,omitempty"        yaml:"home,omitempty"`
+	Sources     []string          `json:"sources,omitempty"     yaml:"sources,omitempty"`
+	Maintainers []Maintainer      `json:"maintainers,omitempty" yaml:"maintainers,omitempty"`
+	Icon        string            `json:"icon,omitempty"        yaml:"icon,omitempty"`
+	AppVersion  string            `json:"appVersion,omitempty"  yaml:"appVersion,omitempty"`
+	Deprecated  bool              `json:"deprecated,omitempty"  yaml:"deprecated,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+}
+
+// Maintainer is a maintainer of a chart.
+type Maintainer struct {
+	Name  string `json:"name"            yaml:"name"`
+	Email string `json:"email,omitempty" yaml:"email,omitempty"`
+	URL   string `json:"url,omitempty"   yaml:"url,omitempty"`
+}
+
+// hookGroup is a set of hook resources of an event, sharing a weight and delete policy.
+type hookGroup struct {
+	Weight       int               `json:"weight"`
+	DeletePolicy []string          `json:"deletePolicy"`
+	Resources    []json.RawMessage `json:"resources"`
+}
+
+// chartOutput is what a chart.nix evaluated to. The manifests are YAML documents.
+type chartOutput struct {
+	// meta is nil for the plain list form, which is wrapped by chartify.
+	meta      *Metadata
+	resources []byte
+	crds      []byte
+	hooks     []byte
+}
+
+// parseChart parses the JSON a chart.nix evaluated to: either a list of resources,
+// or `{ meta = { ... }; resources = [ ... ]; crds = [ ... ]; hooks = { ... }; }`.
+// name is the default chart name.
+func parseChart(data []byte, name string) (chartOutput, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		resources, err := transform.JSONToYAMLs(data, func(any) {})
+		if err != nil {
+			return chartOutput{}, fmt.Errorf("failed to convert JSON to YAML: %w", err)
+		}
+		return chartOutput{resources: resources}, nil
+	}
+
+	var out struct {
+		Meta      Metadata               `json:"meta"`
+		Resources json.RawMessage        `json:"resources"`
+		CRDs      json.RawMessage        `json:"crds"`
+		Hooks     map[string][]hookGroup `json:"hooks"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&out); err != nil {
+		return chartOutput{}, fmt.Errorf("%w: expected a list of resources or { meta; resources; crds; hooks; }: %w", ErrInvalidChart, err)
+	}
+	if out.Resources == nil {
+		return chartOutput{}, fmt.Errorf("%w: missing resources", ErrInvalidChart)
+	}
+
+	c := chartOutput{}
+	var err error
+	if c.resources, err = transform.JSONToYAMLs(out.Resources, func(any) {}); err != nil {
+		return chartOutput{}, fmt.Errorf("%w: resources: %w", ErrInvalidChart, err)
+	}
+	if out.CRDs != nil {
+		if c.crds, err = transform.JSONToYAMLs(out.CRDs, func(any) {}); err != nil {
+			return chartOutput{}, fmt.Errorf("%w: crds: %w", ErrInvalidChart, err)
+		}
+	}
+	if c.hooks, err = hookDocuments(out.Hooks); err != nil {
+		return chartOutput{}, err
+	}
+
+	meta := out.Meta.withDefaults(name)
+	c.meta = &meta
+	return c, nil
+}
+
+// withDefaults returns m with the defaults set for the fields it does not have.
+func (m Metadata) withDefaults(name string) Metadata {
+	if m.APIVersion == "" {
+		m.APIVersion = DefaultAPIVersion
+	}
+	if m.Name == "" {
+		m.Name = name
+	}
+	if m.Version == "" {
+		m.Version = DefaultVersion
+	}
+	if m.Type == "" {
+		m.Type = DefaultType
+	}
+	return m
+}
+
+// hookDocuments returns the hook resources with the helm hook annotations, by event.
+// A resource given for several events with the same weight and delete policy is
+// written once for all of them, as helm expects.
+func hookDocuments(hooks map[string][]hookGroup) ([]byte, error) {
+	for event := range hooks {
+		if !slices.Contains(HookEvents, event) {
+			return nil, fmt.Errorf("%w: unknown hook event %q, expected one of %s", ErrInvalidChart, event, strings.Join(HookEvents, ", "))
+		}
+	}
+
+	type hook struct {
+		resource     json.RawMessage
+		weight       int
+		deletePolicy string
+		events       []string
+	}
+	var order []hook
+	for _, event := range HookEvents {
+		for _, g := range hooks[event] {
+			deletePolicy := strings.Join(g.DeletePolicy, ",")
+			for _, r := range g.Resources {
+				i := slices.IndexFunc(order, func(h hook) bool {
+					return h.weight == g.Weight && h.deletePolicy == deletePolicy && bytes.Equal(h.resource, r)
+				})
+				if i < 0 {
+					order = append(order, hook{resource: r, weight: g.Weight, deletePolicy: deletePolicy, events: []string{event}})
+				} else if !slices.Contains(order[i].events, event) {
+					order[i].events = append(order[i].events, event)
+				}
+			}
+		}
+	}
+
+	var out []byte
+	for _, h := range order {
+		var doc map[string]any
+		// yaml keeps the number types, see transform.JSONToYAMLs.
+		if err := yaml.Unmarshal(h.resource, &doc); err != nil || doc == nil {
+			return nil, fmt.Errorf("%w: hooks %s: expected a resource, got %s", ErrInvalidChart, strings.Join(h.events, ","), h.resource)
+		}
+		metadata, _ := doc["metadata"].(map[string]any)
+		if metadata == nil {
+			metadata = map[string]any{}
+			doc["metadata"] = metadata
+		}
+		annotations, _ := metadata["annotations"].(map[string]any)
+		if annotations == nil {
+			annotations = map[string]any{}
+			metadata["annotations"] = annotations
+		}
+		annotations[HookAnnotation] = strings.Join(h.events, ",")
+		annotations[HookWeightAnnotation] = strconv.Itoa(h.weight)
+		if h.deletePolicy != "" {
+			annotations[HookDeletePolicyAnnotation] = h.deletePolicy
+		}
+
+		res, err := yaml.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > 0 {
+			out = append(out, "---\n"...)
+		}
+		out = append(out, res...)
+	}
+	return out, nil
+}
+
+// manifest is a file of Kubernetes manifests in a chart directory.
+type manifest struct {
+	path    string
+	content []byte
+}
+
+// manifests returns the manifest files of the chart, in the order helm applies them.
+// The plain form is a single resources.yaml, a chart with metadata has templates/ and crds/.
+func (c chartOutput) manifests() []manifest {
+	if c.meta == nil {
+		return []manifest{{"resources.yaml", c.resources}}
+	}
+
+	var m []manifest
+	// helm installs the CRDs in crds/ before the templates, without templating them.
+	if len(c.crds) > 0 {
+		m = append(m, manifest{path.Join("crds", "crds.yaml"), c.crds})
+	}
+	m = append(m, manifest{path.Join("templates", "resources.yaml"), c.resources})
+	if len(c.hooks) > 0 {
+		m = append(m, manifest{path.Join("templates", "hooks.yaml"), c.hooks})
+	}
+	return m
+}
+
+// write lays out the chart in dir, see manifests.
+// A chart with metadata also gets a Chart.yaml and the values it was rendered with.
+func (c chartOutput) write(dir string, values map[string]any) error {
+	if c.meta != nil {
+		meta, err := yaml.Marshal(c.meta)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "Chart.yaml"), meta, 0o600); err != nil {
+			return err
+		}
+
+		// The release is injected by helmfile-nix, not a value of the chart.
+		values = maps.Clone(values)
+		delete(values, "release")
+		vals, err := yaml.Marshal(values)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "values.yaml"), vals, 0o600); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range c.manifests() {
+		file := filepath.Join(dir, filepath.FromSlash(m.path))
+		if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, m.content, 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,9 +1,14 @@
+# lib can be passed in to avoid fetching the pinned flake, e.g. in offline mode.
+{
+  # pin nixpkgs.lib
+  lib ?
+    (builtins.getFlake "github:nix-community/nixpkgs.lib/4b620020fd73bdd5104e32c702e65b60b6869426").lib,
+}:
+
 with builtins;
 
 rec {
-  # pin nixpkgs.lib
-  lib =
-    (builtins.getFlake "github:nix-community/nixpkgs.lib/4b620020fd73bdd5104e32c702e65b60b6869426").lib;
+  inherit lib;
 
   # render chart to object
   render =
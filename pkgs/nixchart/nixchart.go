@@ -7,16 +7,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 
+	"github.com/reMarkable/helmfile-nix/pkgs/cache"
 	"github.com/reMarkable/helmfile-nix/pkgs/environment"
 	"github.com/reMarkable/helmfile-nix/pkgs/filesystem"
 	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
 	"github.com/reMarkable/helmfile-nix/pkgs/tempfiles"
-	"github.com/reMarkable/helmfile-nix/pkgs/transform"
 )
 
 // Static errors for nixchart package.
@@ -26,14 +28,47 @@ var (
 	ErrNixChartNotString    = errors.New("expected 'nixChart' to be a string")
 	ErrWriteEvalNix         = errors.New("could not write eval.nix")
 	ErrCreateTempValuesFile = errors.New("failed to create temporary file for values")
+	ErrEvalChart            = errors.New("failed to evaluate chart")
+	ErrWriteChart           = errors.New("failed to write chart")
 )
 
 //go:embed eval.nix
 var eval string
 
+// Renderer renders nixCharts referenced from helmfile releases.
+type Renderer struct {
+	evaluator nixeval.Evaluator
+	lib       string
+	cache     *cache.Cache
+	temp      *tempfiles.Manager
+}
+
+// NewRenderer creates a new chart renderer using the given evaluator.
+// lib is the path to a local nixpkgs lib, or empty to fetch the pinned one.
+// Evaluations are cached in c, unless it is nil.
+// Charts are rendered to the workspace of temp, a new one is used if it is nil.
+func NewRenderer(evaluator nixeval.Evaluator, lib string, c *cache.Cache, temp *tempfiles.Manager) *Renderer {
+	if temp == nil {
+		temp = tempfiles.NewManager()
+	}
+	return &Renderer{
+		evaluator: evaluator,
+		lib:       lib,
+		cache:     c,
+		temp:      temp,
+	}
+}
+
+// WithoutCache returns a copy of r that does not cache evaluations, for values that must not be written to disk.
+func (r *Renderer) WithoutCache() *Renderer {
+	c := *r
+	c.cache = nil
+	return &c
+}
+
 // RenderCharts takes a map of chart objects and a base path, renders the charts,
 // and returns a slice of file paths to the rendered charts or an error.
-func RenderCharts(ctx context.Context, obj map[string]any, base string) ([]string, error) {
+func (r *Renderer) RenderCharts(ctx context.Context, obj map[string]any, base string) ([]string, error) {
 	releasesValue := reflect.ValueOf(obj["releases"])
 	if releasesValue.Kind() != reflect.Slice {
 		return nil, ErrReleasesNotSlice
@@ -41,7 +76,7 @@ func RenderCharts(ctx context.Context, obj map[string]any, base string) ([]strin
 
 	var cleanup []string
 	for i := 0; i < releasesValue.Len(); i++ {
-		rendered, err := processRelease(ctx, releasesValue.Index(i), i, base)
+		rendered, err := r.processRelease(ctx, releasesValue.Index(i), i, base)
 		if err != nil {
 			return nil, err
 		}
@@ -52,7 +87,7 @@ func RenderCharts(ctx context.Context, obj map[string]any, base string) ([]strin
 	return cleanup, nil
 }
 
-func processRelease(ctx context.Context, element reflect.Value, index int, base string) (string, error) {
+func (r *Renderer) processRelease(ctx context.Context, element reflect.Value, index int, base string) (string, error) {
 	if element.Kind() == reflect.Map {
 		return "", nil
 	}
@@ -67,7 +102,7 @@ func processRelease(ctx context.Context, element reflect.Value, index int, base
 		return "", nil
 	}
 
-	renderedChart, err := evalChart(ctx, chart, base)
+	renderedChart, err := r.evalChart(ctx, chart, base)
 	if err != nil {
 		return "", fmt.Errorf("failed to evaluate chart %s: %w", chart["name"], err)
 	}
@@ -79,31 +114,25 @@ func processRelease(ctx context.Context, element reflect.Value, index int, base
 	return renderedChart, nil
 }
 
-// CleanupCharts removes the chart files specified in the cleanup slice.
-// It is typically used to delete temporary chart files after processing.
-func CleanupCharts(cleanup []string) {
-	for _, chart := range cleanup {
-		if err := os.RemoveAll(chart); err != nil {
-			log.Printf("Failed to remove chart directory %s: %v", chart, err)
-		}
-	}
-}
-
 func prepareChartValues(chart map[string]any) map[string]any {
-	var v map[string]any
-	vl, ok := chart["values"].([]map[string]any)
-	if ok {
-		mergedValues := map[string]any{}
-		for _, m := range vl {
-			mergedValues = environment.MergeMaps(mergedValues, m)
+	v := map[string]any{}
+	switch values := chart["values"].(type) {
+	case []map[string]any:
+		for _, m := range values {
+			v = environment.MergeMaps(v, m)
 		}
-		v = mergedValues
-	} else {
-		v, ok = chart["values"].(map[string]any)
-		if !ok || v == nil {
-			v = map[string]any{}
+	case []any:
+		// As decoded from the rendered helmfile.
+		for _, m := range values {
+			if m, ok := m.(map[string]any); ok {
+				v = environment.MergeMaps(v, m)
+			}
 		}
+	case map[string]any:
+		v = values
 	}
+	// The directives are only for merging, also when there is a single map of values.
+	v = environment.WithoutMergeDirectives(v)
 	for _, key := range []string{"namespace", "release"} {
 		if v[key] != nil {
 			log.Printf("warning: `%s` in values is reserved and will be overwritten\n", key)
@@ -117,74 +146,98 @@ func prepareChartValues(chart map[string]any) map[string]any {
 	return v
 }
 
-var evalChart = func(ctx context.Context, chart map[string]any, hfbase string) (string, error) {
-	nixChart, ok := chart["nixChart"].(string)
-	if !ok {
-		return "", fmt.Errorf("%w, got %T", ErrNixChartNotString, chart["nixChart"])
+func (r *Renderer) evalChart(ctx context.Context, chart map[string]any, hfbase string) (string, error) {
+	c, v, err := r.evaluate(ctx, chart, hfbase)
+	if err != nil {
+		return "", err
 	}
-
-	fileName, base, err := filesystem.FindFileNameAndBase(path.Join(hfbase, nixChart), []string{"chart.nix"})
+	// The directory name is the chart name chartify uses, so it is kept stable in a unique parent.
+	dir, err := r.temp.MkdirTemp("chart-*")
 	if err != nil {
-		return "", fmt.Errorf("failed to find chart file: %w", err)
+		return "", fmt.Errorf("%w: %w", ErrWriteChart, err)
 	}
+	chartDir := filepath.Join(dir, fmt.Sprintf("nixChart-%s-%s", chart["namespace"], chart["name"]))
+	if err := os.Mkdir(chartDir, 0o700); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrWriteChart, err)
+	}
+	if err := c.write(chartDir, v); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrWriteChart, err)
+	}
+
+	return chartDir, nil
+}
 
-	f, err := tempfiles.WriteEvalNix(eval)
+// RenderManifests evaluates the chart.nix of release like RenderCharts does, and writes the manifests
+// it generates to w. The nixChart of release is relative to the working directory.
+// Each file of the chart is a YAML document stream headed by its path, like `helm template` prints them.
+func (r *Renderer) RenderManifests(ctx context.Context, release map[string]any, w io.Writer) error {
+	c, _, err := r.evaluate(ctx, release, "")
 	if err != nil {
-		return "", fmt.Errorf("%w: %w", ErrWriteEvalNix, err)
+		return err
 	}
 
-	defer func() {
-		if err := os.Remove(f.Name()); err != nil {
-			log.Fatalf("could not remove eval.nix: %s", err)
+	name := fmt.Sprint(release["name"])
+	if c.meta != nil {
+		name = c.meta.Name
+	}
+	for _, m := range c.manifests() {
+		if len(m.content) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "---\n# Source: %s/%s\n%s", name, m.path, m.content); err != nil {
+			return err
 		}
-	}()
+	}
+	return nil
+}
+
+// evaluate evaluates the chart.nix of the release chart, relative to hfbase.
+// Returns the chart and the values it was evaluated with.
+func (r *Renderer) evaluate(ctx context.Context, chart map[string]any, hfbase string) (chartOutput, map[string]any, error) {
+	nixChart, ok := chart["nixChart"].(string)
+	if !ok {
+		return chartOutput{}, nil, fmt.Errorf("%w, got %T", ErrNixChartNotString, chart["nixChart"])
+	}
 
-	val, err := os.CreateTemp("", "val.*.json")
+	fileName, base, err := filesystem.FindFileNameAndBase(path.Join(hfbase, nixChart), []string{"chart.nix"})
 	if err != nil {
-		return "", fmt.Errorf("%w: %w", ErrCreateTempValuesFile, err)
+		return chartOutput{}, nil, fmt.Errorf("failed to find chart file: %w", err)
 	}
 
-	defer func() {
-		if err := os.Remove(val.Name()); err != nil {
-			log.Println("Failed to remove temporary file for values:", val.Name())
-		}
-	}()
+	evalNix, err := r.temp.WriteTemp("eval.*.nix", []byte(eval))
+	if err != nil {
+		return chartOutput{}, nil, fmt.Errorf("%w: %w", ErrWriteEvalNix, err)
+	}
+	defer r.temp.Remove(evalNix)
 
 	v := prepareChartValues(chart)
 	// Serialize the values
 	values, err := json.Marshal(v)
 	if err != nil {
-		return "", err
-	}
-
-	// Write the values
-	if _, err := val.Write(values); err != nil {
-		return "", err
+		return chartOutput{}, nil, err
 	}
 
-	err = val.Close()
-	if err != nil {
-		log.Fatalln("Failed to close temporary file for values:", err)
-	}
-	expr := fmt.Sprintf(`(import %s).render "%s" "%s" "%s"`, f.Name(), fileName, base, val.Name())
-	ne := nixeval.NewNixEval(expr)
-	cmd := ne.Args(false)
-	json, err := ne.Eval(ctx, cmd)
+	val, err := r.temp.WriteTemp("val.*.json", values)
 	if err != nil {
-		log.Fatalln("Failed to evaluate chart:", chart, " : ", err)
+		return chartOutput{}, nil, fmt.Errorf("%w: %w", ErrCreateTempValuesFile, err)
 	}
-	yaml, err := transform.JSONToYAMLs(json, func(v any) {})
+	defer r.temp.Remove(val)
+
+	expr := fmt.Sprintf(`%s.render "%s" "%s" "%s"`, nixeval.ImportEval(evalNix, r.lib), fileName, base, val)
+	json, err := r.cache.Eval(ctx, r.evaluator, expr, false, func(k *cache.Key) error {
+		k.AddString("eval.nix", eval)
+		if err := k.AddLib(r.lib); err != nil {
+			return err
+		}
+		k.Add("values", values)
+		return k.AddNixClosure(path.Join(base, fileName))
+	})
 	if err != nil {
-		log.Fatalln("Failed to convert JSON to YAML for chart:", chart, " : ", err)
+		return chartOutput{}, nil, fmt.Errorf("%w: %w", ErrEvalChart, err)
 	}
-	chartDir := path.Join(os.TempDir(), fmt.Sprintf("nixChart-%s-%s", chart["namespace"], chart["name"]))
-	err = os.MkdirAll(chartDir, 0o700)
+	c, err := parseChart(json, fmt.Sprint(chart["name"]))
 	if err != nil {
-		log.Fatalln("Failed to create temporary directory for chart:", chartDir, " : ", err)
-	}
-	if err = os.WriteFile(chartDir+"/resources.yaml", yaml, 0o600); err != nil {
-		log.Fatalln("Failed to write resources.yaml for chart:", chart, " : ", err)
+		return chartOutput{}, nil, err
 	}
-
-	return chartDir, nil
+	return c, v, nil
 }
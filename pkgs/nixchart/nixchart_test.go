@@ -1,25 +1,24 @@
 package nixchart
 
 import (
-	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
+	"github.com/reMarkable/helmfile-nix/pkgs/tempfiles"
 )
 
+var errBoom = errors.New("boom")
+
 func TestRenderCharts_Success(t *testing.T) {
 	t.Parallel()
-	origEvalChart := evalChart
-	evalChart = func(_ context.Context, chart map[string]any, base string) (string, error) {
-		tmpDir := t.TempDir()
-		resourcesPath := filepath.Join(tmpDir, "resources.yaml")
-		if err := os.WriteFile(resourcesPath, []byte("mocked: true\n"), 0o600); err != nil {
-			return "", err
-		}
-
-		return tmpDir, nil
-	}
-	defer func() { evalChart = origEvalChart }()
+	evaluator := nixeval.NewFake().Respond("chart.nix", []byte(`[{"mocked":true}]`))
 
 	chartPath := filepath.Join("..", "..", "testData", "nixChart", "chart.nix")
 	obj := map[string]any{
@@ -35,7 +34,7 @@ func TestRenderCharts_Success(t *testing.T) {
 			},
 		},
 	}
-	cleanup, err := RenderCharts(t.Context(), obj, ".")
+	cleanup, err := NewRenderer(evaluator, "", nil, testTemp(t)).RenderCharts(t.Context(), obj, ".")
 	if err != nil {
 		t.Fatalf("RenderCharts failed: %v", err)
 	}
@@ -46,11 +45,34 @@ func TestRenderCharts_Success(t *testing.T) {
 
 	// Check that the rendered chart directory exists and contains resources.yaml
 	resourcesPath := filepath.Join(cleanup[0], "resources.yaml")
-	if _, err := os.Stat(resourcesPath); err != nil {
+	resources, err := os.ReadFile(resourcesPath)
+	if err != nil {
 		t.Fatalf("resources.yaml not found: %v", err)
 	}
+	if string(resources) != "mocked: true\n" {
+		t.Errorf("Unexpected resources.yaml content: %q", resources)
+	}
 
-	CleanupCharts(cleanup)
+}
+
+func TestRenderCharts_EvalError(t *testing.T) {
+	t.Parallel()
+	evaluator := nixeval.NewFake().Fail("chart.nix", errBoom)
+
+	chartPath := filepath.Join("..", "..", "testData", "nixChart", "chart.nix")
+	obj := map[string]any{
+		"releases": []any{
+			map[string]any{
+				"name":      "broken-chart",
+				"namespace": "test-ns",
+				"nixChart":  chartPath,
+			},
+		},
+	}
+	_, err := NewRenderer(evaluator, "", nil, testTemp(t)).RenderCharts(t.Context(), obj, ".")
+	if !errors.Is(err, ErrEvalChart) || !errors.Is(err, errBoom) {
+		t.Fatalf("RenderCharts() error = %v, want %v", err, ErrEvalChart)
+	}
 }
 
 func TestPrepareChartValues(t *testing.T) {
@@ -79,6 +101,25 @@ func TestPrepareChartValues(t *testing.T) {
 		t.Errorf("Expected merged values, got: %#v", vals)
 	}
 
+	// Directives are removed from a single map, and from lists as decoded from the helmfile.
+	chartMap = map[string]any{
+		"values": map[string]any{"_merge": map[string]any{"hosts": "append"}, "hosts": []any{"a"}},
+	}
+	vals = prepareChartValues(chartMap)
+	if _, ok := vals["_merge"]; ok || vals["hosts"] == nil {
+		t.Errorf("Expected values without directives, got: %#v", vals)
+	}
+	chartList = map[string]any{
+		"values": []any{
+			map[string]any{"_merge": map[string]any{"hosts": "append"}, "hosts": []any{"a"}},
+			map[string]any{"hosts": []any{"b"}},
+		},
+	}
+	vals = prepareChartValues(chartList)
+	if _, ok := vals["_merge"]; ok || !reflect.DeepEqual(vals["hosts"], []any{"a", "b"}) {
+		t.Errorf("Expected merged values without directives, got: %#v", vals)
+	}
+
 	// Test with no values
 	chartNil := map[string]any{}
 	vals = prepareChartValues(chartNil)
@@ -106,35 +147,227 @@ func TestPrepareChartValues(t *testing.T) {
 	}
 }
 
-func TestCleanupCharts_NonExistent(t *testing.T) {
+func TestRenderCharts_Metadata(t *testing.T) {
+	t.Parallel()
+	evaluator := nixeval.NewFake().Respond("chart.nix", []byte(`{"meta":{"version":"1.2.3","appVersion":"1.14.2","description":"nginx","annotations":{"team":"web"}},"resources":[{"kind":"Deployment"},{"kind":"Service"}]}`))
+
+	chartPath := filepath.Join("..", "..", "testData", "nixChart", "chart.nix")
+	obj := map[string]any{
+		"releases": []any{
+			map[string]any{
+				"name":      "meta-chart",
+				"namespace": "meta-ns",
+				"nixChart":  chartPath,
+				"values":    map[string]any{"replicas": 2},
+			},
+		},
+	}
+	cleanup, err := NewRenderer(evaluator, "", nil, testTemp(t)).RenderCharts(t.Context(), obj, ".")
+	if err != nil {
+		t.Fatalf("RenderCharts failed: %v", err)
+	}
+
+	for file, want := range map[string]string{
+		"Chart.yaml":               "apiVersion: v2\nname: meta-chart\nversion: 1.2.3\ndescription: nginx\ntype: application\nappVersion: 1.14.2\nannotations:\n    team: web\n",
+		"values.yaml":              "namespace: meta-ns\nreplicas: 2\n",
+		"templates/resources.yaml": "kind: Deployment\n---\nkind: Service\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(cleanup[0], file))
+		if err != nil {
+			t.Fatalf("%s not found: %v", file, err)
+		}
+		if string(got) != want {
+			t.Errorf("Unexpected %s content: %q", file, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cleanup[0], "resources.yaml")); !os.IsNotExist(err) {
+		t.Errorf("Expected no resources.yaml next to Chart.yaml, got: %v", err)
+	}
+}
+
+func TestParseChart(t *testing.T) {
 	t.Parallel()
-	// Test that CleanupCharts handles non-existent directories gracefully
-	cleanup := []string{"/nonexistent/directory/path"}
+	c, err := parseChart([]byte(`{"resources":[]}`), "app")
+	if err != nil {
+		t.Fatalf("parseChart() error: %v", err)
+	}
+	if c.meta == nil || c.meta.Name != "app" || c.meta.Version != DefaultVersion || c.meta.APIVersion != DefaultAPIVersion {
+		t.Errorf("Expected default metadata, got: %+v", c.meta)
+	}
+
+	c, err = parseChart([]byte(` [{"kind":"ConfigMap"}]`), "app")
+	if err != nil {
+		t.Fatalf("parseChart() error: %v", err)
+	}
+	if c.meta != nil || string(c.resources) != "kind: ConfigMap\n" {
+		t.Errorf("Expected the plain form, got: %+v", c)
+	}
+
+	for _, data := range []string{
+		`{"meta":{"name":"app"}}`,
+		`{"meta":{"verison":"1.0.0"},"resources":[]}`,
+		`{"resources":[],"extra":true}`,
+		`"resources"`,
+	} {
+		if _, err := parseChart([]byte(data), "app"); !errors.Is(err, ErrInvalidChart) {
+			t.Errorf("parseChart(%s) error = %v, want %v", data, err, ErrInvalidChart)
+		}
+	}
+}
+
+func TestParseChart_CRDsAndHooks(t *testing.T) {
+	t.Parallel()
+	data := `{
+		"resources": [{"kind": "Deployment"}],
+		"crds": [{"kind": "CustomResourceDefinition", "metadata": {"name": "widgets.example.com"}}],
+		"hooks": {
+			"post-upgrade": [{"weight": 5, "resources": [{"kind": "Job", "metadata": {"name": "migrate"}}]}],
+			"pre-install": [
+				{"weight": 5, "resources": [{"kind": "Job", "metadata": {"name": "migrate"}}]},
+				{"weight": -1, "deletePolicy": ["before-hook-creation", "hook-succeeded"], "resources": [{"kind": "Secret", "metadata": {"annotations": {"a": "b"}}}]}
+			]
+		}
+	}`
+	c, err := parseChart([]byte(data), "app")
+	if err != nil {
+		t.Fatalf("parseChart() error: %v", err)
+	}
+
+	if string(c.crds) != "kind: CustomResourceDefinition\nmetadata:\n    name: widgets.example.com\n" {
+		t.Errorf("Unexpected crds: %q", c.crds)
+	}
+	hooks := `kind: Job
+metadata:
+    annotations:
+        helm.sh/hook: pre-install,post-upgrade
+        helm.sh/hook-weight: "5"
+    name: migrate
+---
+kind: Secret
+metadata:
+    annotations:
+        a: b
+        helm.sh/hook: pre-install
+        helm.sh/hook-delete-policy: before-hook-creation,hook-succeeded
+        helm.sh/hook-weight: "-1"
+`
+	if string(c.hooks) != hooks {
+		t.Errorf("Unexpected hooks:\n%s", c.hooks)
+	}
+
+	dir := t.TempDir()
+	if err := c.write(dir, map[string]any{}); err != nil {
+		t.Fatalf("write() error: %v", err)
+	}
+	for _, file := range []string{"Chart.yaml", "values.yaml", "templates/resources.yaml", "templates/hooks.yaml", "crds/crds.yaml"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Errorf("Expected %s: %v", file, err)
+		}
+	}
 
-	// Should not panic, just log error
-	CleanupCharts(cleanup)
+	for _, data := range []string{
+		`{"resources":[],"hooks":{"pre-instal":[]}}`,
+		`{"resources":[],"hooks":{"pre-install":[{"resources":["job"]}]}}`,
+		`{"resources":[],"hooks":{"pre-install":[{"weight":"high"}]}}`,
+	} {
+		if _, err := parseChart([]byte(data), "app"); !errors.Is(err, ErrInvalidChart) {
+			t.Errorf("parseChart(%s) error = %v, want %v", data, err, ErrInvalidChart)
+		}
+	}
 }
 
-func TestCleanupCharts_Mixed(t *testing.T) {
+func TestRenderer_RenderManifests(t *testing.T) {
 	t.Parallel()
-	// Create a real directory
-	tmpDir := t.TempDir()
+	evaluator := nixeval.NewFake().Respond("chart.nix", []byte(`{"meta":{"name":"web"},"resources":[{"kind":"Deployment"}],"crds":[{"kind":"CustomResourceDefinition"}],"hooks":{"pre-install":[{"resources":[{"kind":"Job"}]}]}}`))
+	release := map[string]any{
+		"name":      "test",
+		"namespace": "test-ns",
+		"nixChart":  filepath.Join("..", "..", "testData", "nixChart"),
+		"values":    map[string]any{"replicas": 2},
+	}
 
-	// Mix of existing and non-existent directories
-	cleanup := []string{tmpDir, "/nonexistent/path"}
+	var out strings.Builder
+	if err := NewRenderer(evaluator, "", nil, testTemp(t)).RenderManifests(t.Context(), release, &out); err != nil {
+		t.Fatalf("RenderManifests() error: %v", err)
+	}
+	want := `---
+# Source: web/crds/crds.yaml
+kind: CustomResourceDefinition
+---
+# Source: web/templates/resources.yaml
+kind: Deployment
+---
+# Source: web/templates/hooks.yaml
+kind: Job
+metadata:
+    annotations:
+        helm.sh/hook: pre-install
+        helm.sh/hook-weight: "0"
+`
+	if out.String() != want {
+		t.Errorf("RenderManifests() =\n%s\nwant:\n%s", out.String(), want)
+	}
+}
 
-	// Should clean up what it can without panicking
-	CleanupCharts(cleanup)
+func TestRenderer_RenderManifests_PlainList(t *testing.T) {
+	t.Parallel()
+	evaluator := nixeval.NewFake().Respond("chart.nix", []byte(`[{"kind":"Deployment"},{"kind":"Service"}]`))
+	release := map[string]any{"name": "test", "nixChart": filepath.Join("..", "..", "testData", "nixChart")}
 
-	// Verify the temp directory was removed
-	if _, err := os.Stat(tmpDir); !os.IsNotExist(err) {
-		t.Error("CleanupCharts() should have removed temp directory")
+	var out strings.Builder
+	if err := NewRenderer(evaluator, "", nil, testTemp(t)).RenderManifests(t.Context(), release, &out); err != nil {
+		t.Fatalf("RenderManifests() error: %v", err)
 	}
+	want := "---\n# Source: test/resources.yaml\nkind: Deployment\n---\nkind: Service\n"
+	if out.String() != want {
+		t.Errorf("RenderManifests() = %q, want %q", out.String(), want)
+	}
+}
+
+func testTemp(t *testing.T) *tempfiles.Manager {
+	t.Helper()
+	temp := tempfiles.NewManager()
+	t.Cleanup(temp.Cleanup)
+	return temp
 }
 
-func TestCleanupCharts_Empty(t *testing.T) {
+func TestRenderCharts_Concurrent(t *testing.T) {
 	t.Parallel()
-	// Test with empty cleanup list
-	CleanupCharts([]string{})
-	// Should not panic
+	chartPath := filepath.Join("..", "..", "testData", "nixChart", "chart.nix")
+	release := func() map[string]any {
+		return map[string]any{
+			"releases": []any{
+				map[string]any{"name": "same", "namespace": "same-ns", "nixChart": chartPath},
+			},
+		}
+	}
+
+	// Like two runs of helmfile-nix on one host rendering the same release for different environments.
+	var wg sync.WaitGroup
+	dirs := make([]string, 2)
+	for i := range dirs {
+		wg.Go(func() {
+			evaluator := nixeval.NewFake().Respond("chart.nix", fmt.Appendf(nil, `[{"run":%d}]`, i))
+			cleanup, err := NewRenderer(evaluator, "", nil, testTemp(t)).RenderCharts(t.Context(), release(), ".")
+			if err != nil || len(cleanup) != 1 {
+				t.Errorf("RenderCharts() = %v, %v", cleanup, err)
+				return
+			}
+			dirs[i] = cleanup[0]
+		})
+	}
+	wg.Wait()
+
+	if dirs[0] == dirs[1] {
+		t.Fatalf("Expected separate chart directories, got %s", dirs[0])
+	}
+	for i, dir := range dirs {
+		if filepath.Base(dir) != "nixChart-same-ns-same" {
+			t.Errorf("Expected the chart directory to be named after the release, got %s", dir)
+		}
+		resources, err := os.ReadFile(filepath.Join(dir, "resources.yaml"))
+		if err != nil || string(resources) != fmt.Sprintf("run: %d\n", i) {
+			t.Errorf("Unexpected resources.yaml of run %d: %q, %v", i, resources, err)
+		}
+	}
 }
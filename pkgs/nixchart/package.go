@@ -0,0 +1,259 @@
+package nixchart
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/tempfiles"
+)
+
+// IndexFileName is the index of a chart repository.
+const IndexFileName = "index.yaml"
+
+// Static errors for packaging charts.
+var (
+	ErrInvalidVersion = errors.New("chart version is not a semantic version")
+	ErrInvalidArchive = errors.New("invalid chart archive")
+	ErrNoChartYAML    = errors.New("no Chart.yaml with a name and version")
+	ErrInvalidIndex   = errors.New("invalid " + IndexFileName)
+)
+
+var semver = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// IndexFile is the index.yaml of a chart repository.
+type IndexFile struct {
+	APIVersion string                  `yaml:"apiVersion"`
+	Entries    map[string][]IndexEntry `yaml:"entries"`
+	Generated  string                  `yaml:"generated"`
+	// Other are the fields of an existing index that are not known here, kept as they are.
+	Other map[string]any `yaml:",inline"`
+}
+
+// IndexEntry is a version of a chart in an IndexFile.
+type IndexEntry struct {
+	Metadata `yaml:",inline"`
+	URLs     []string `yaml:"urls"`
+	Created  string   `yaml:"created"`
+	Digest   string   `yaml:"digest"`
+	// Other are the fields of an existing entry that are not known here, like dependencies.
+	Other map[string]any `yaml:",inline"`
+}
+
+// Package evaluates the chart.nix of release, see RenderCharts, and writes it as a helm chart archive to dest.
+// The nixChart of release is relative to the working directory. A chart.nix returning a plain list of
+// resources gets the default metadata. version and appVersion override the ones in meta when set.
+// Returns the path of the archive, which is named <name>-<version>.tgz like helm names it.
+func (r *Renderer) Package(ctx context.Context, release map[string]any, version, appVersion, dest string) (string, error) {
+	c, values, err := r.evaluate(ctx, release, "")
+	if err != nil {
+		return "", err
+	}
+	if c.meta == nil {
+		meta := Metadata{}.withDefaults(fmt.Sprint(release["name"]))
+		c.meta = &meta
+	}
+	if version != "" {
+		c.meta.Version = version
+	}
+	if appVersion != "" {
+		c.meta.AppVersion = appVersion
+	}
+	if !semver.MatchString(c.meta.Version) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidVersion, c.meta.Version)
+	}
+
+	tmp, err := r.temp.MkdirTemp("package-*")
+	if err != nil {
+		return "", err
+	}
+	defer r.temp.Remove(tmp)
+
+	dir := filepath.Join(tmp, c.meta.Name)
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return "", err
+	}
+	if err := c.write(dir, values); err != nil {
+		return "", err
+	}
+
+	archive := filepath.Join(dest, fmt.Sprintf("%s-%s.tgz", c.meta.Name, c.meta.Version))
+	if err := writeArchive(archive, dir); err != nil {
+		return "", fmt.Errorf("could not write %s: %w", archive, err)
+	}
+	return archive, nil
+}
+
+// writeArchive writes dir to a gzipped tarball at path, with its files under the name of dir.
+// Times and owners are left out, so packaging the same chart twice gives the same archive.
+func writeArchive(path, dir string) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Dir(dir), file)
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{Name: filepath.ToSlash(rel), ModTime: time.Unix(0, 0), Format: tar.FormatPAX}
+		if d.IsDir() {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			hdr.Mode = 0o755
+			return tw.WriteHeader(hdr)
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		hdr.Typeflag = tar.TypeReg
+		hdr.Mode = 0o644
+		hdr.Size = int64(len(data))
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return tempfiles.WriteFileAtomic(path, buf.Bytes(), 0o600)
+}
+
+// UpdateIndex adds the chart archive to the index.yaml of the chart repository in dir, creating it if needed.
+// A version already in the index is replaced. url is the base URL of the repository,
+// without one the archive is referenced relative to the index.
+func UpdateIndex(dir, archive, url string) error {
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		return err
+	}
+	meta, err := archiveMetadata(data)
+	if err != nil {
+		return fmt.Errorf("%w %s: %w", ErrInvalidArchive, archive, err)
+	}
+
+	indexPath := filepath.Join(dir, IndexFileName)
+	index := IndexFile{APIVersion: "v1"}
+	existing, err := os.ReadFile(indexPath)
+	switch {
+	case err == nil:
+		if err := yaml.Unmarshal(existing, &index); err != nil {
+			return fmt.Errorf("%w %s: %w", ErrInvalidIndex, indexPath, err)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	if index.Entries == nil {
+		index.Entries = map[string][]IndexEntry{}
+	}
+
+	ref := filepath.Base(archive)
+	if url != "" {
+		ref = strings.TrimSuffix(url, "/") + "/" + ref
+	}
+	sum := sha256.Sum256(data)
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	entry := IndexEntry{Metadata: meta, URLs: []string{ref}, Created: now, Digest: hex.EncodeToString(sum[:])}
+
+	entries := slices.DeleteFunc(index.Entries[meta.Name], func(e IndexEntry) bool { return e.Version == meta.Version })
+	entries = append(entries, entry)
+	// Newest first, like helm repo index.
+	slices.SortStableFunc(entries, func(a, b IndexEntry) int { return compareVersions(b.Version, a.Version) })
+	index.Entries[meta.Name] = entries
+	index.Generated = now
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(index); err != nil {
+		return err
+	}
+	// Written atomically, as a web server may be serving the repository.
+	return tempfiles.WriteFileAtomic(indexPath, buf.Bytes(), 0o600)
+}
+
+// archiveMetadata reads the Chart.yaml at the top of a chart archive.
+func archiveMetadata(data []byte) (Metadata, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return Metadata{}, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return Metadata{}, ErrNoChartYAML
+		}
+		if err != nil {
+			return Metadata{}, err
+		}
+		if dir, file := path.Split(hdr.Name); file != "Chart.yaml" || strings.Count(dir, "/") != 1 {
+			continue
+		}
+
+		var meta Metadata
+		if err := yaml.NewDecoder(tr).Decode(&meta); err != nil {
+			return Metadata{}, fmt.Errorf("Chart.yaml: %w", err)
+		}
+		if meta.Name == "" || meta.Version == "" {
+			return Metadata{}, ErrNoChartYAML
+		}
+		return meta, nil
+	}
+}
+
+// compareVersions compares two semantic versions, versions that are not are compared as strings.
+func compareVersions(a, b string) int {
+	ma, mb := semver.FindStringSubmatch(a), semver.FindStringSubmatch(b)
+	if ma == nil || mb == nil {
+		return strings.Compare(a, b)
+	}
+	for i := 1; i <= 3; i++ {
+		na, _ := strconv.Atoi(ma[i])
+		nb, _ := strconv.Atoi(mb[i])
+		if na != nb {
+			return na - nb
+		}
+	}
+	// A pre-release comes before its release.
+	switch pa, pb := ma[4], mb[4]; {
+	case pa == pb:
+		return 0
+	case pa == "":
+		return 1
+	case pb == "":
+		return -1
+	default:
+		return strings.Compare(pa, pb)
+	}
+}
@@ -0,0 +1,185 @@
+package nixchart
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
+)
+
+func packageChart(t *testing.T, response, version, dest string) string {
+	t.Helper()
+	evaluator := nixeval.NewFake().Respond("chart.nix", []byte(response))
+	release := map[string]any{
+		"name":     "nginx",
+		"nixChart": filepath.Join("..", "..", "testData", "nixChart"),
+		"values":   map[string]any{"replicas": 2},
+	}
+	archive, err := NewRenderer(evaluator, "", nil, testTemp(t)).Package(t.Context(), release, version, "", dest)
+	if err != nil {
+		t.Fatalf("Package() error: %v", err)
+	}
+	return archive
+}
+
+func TestRenderer_Package(t *testing.T) {
+	t.Parallel()
+	dest := t.TempDir()
+	archive := packageChart(t, `{"meta":{"version":"1.0.0","appVersion":"1.14.2"},"resources":[{"kind":"Deployment"}]}`, "", dest)
+	if archive != filepath.Join(dest, "nginx-1.0.0.tgz") {
+		t.Errorf("Package() = %s, want nginx-1.0.0.tgz in %s", archive, dest)
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatalf("Failed to open archive: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	files := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read archive: %v", err)
+		}
+		content, _ := io.ReadAll(tr)
+		files[hdr.Name] = string(content)
+	}
+
+	if files["nginx/Chart.yaml"] != "apiVersion: v2\nname: nginx\nversion: 1.0.0\ntype: application\nappVersion: 1.14.2\n" {
+		t.Errorf("Unexpected Chart.yaml: %q", files["nginx/Chart.yaml"])
+	}
+	if files["nginx/templates/resources.yaml"] != "kind: Deployment\n" {
+		t.Errorf("Unexpected templates/resources.yaml: %q", files["nginx/templates/resources.yaml"])
+	}
+	if files["nginx/values.yaml"] != "replicas: 2\n" {
+		t.Errorf("Unexpected values.yaml: %q", files["nginx/values.yaml"])
+	}
+}
+
+func TestRenderer_Package_PlainList(t *testing.T) {
+	t.Parallel()
+	dest := t.TempDir()
+	archive := packageChart(t, `[{"kind":"Deployment"}]`, "2.0.0-rc.1", dest)
+	if filepath.Base(archive) != "nginx-2.0.0-rc.1.tgz" {
+		t.Errorf("Package() = %s, want nginx-2.0.0-rc.1.tgz", archive)
+	}
+
+	// Packaging again gives the same archive.
+	first, _ := os.ReadFile(archive)
+	packageChart(t, `[{"kind":"Deployment"}]`, "2.0.0-rc.1", dest)
+	second, _ := os.ReadFile(archive)
+	if string(first) != string(second) {
+		t.Error("Expected packaging to be reproducible")
+	}
+}
+
+func TestRenderer_Package_InvalidVersion(t *testing.T) {
+	t.Parallel()
+	evaluator := nixeval.NewFake().Respond("chart.nix", []byte(`{"meta":{"version":"latest"},"resources":[]}`))
+	release := map[string]any{"name": "nginx", "nixChart": filepath.Join("..", "..", "testData", "nixChart")}
+	_, err := NewRenderer(evaluator, "", nil, testTemp(t)).Package(t.Context(), release, "", "", t.TempDir())
+	if !errors.Is(err, ErrInvalidVersion) {
+		t.Errorf("Package() error = %v, want %v", err, ErrInvalidVersion)
+	}
+}
+
+func TestUpdateIndex(t *testing.T) {
+	t.Parallel()
+	repo := t.TempDir()
+	existing := `apiVersion: v1
+entries:
+  other:
+    - name: other
+      version: 0.1.0
+      urls: [other-0.1.0.tgz]
+      dependencies: [{name: redis, version: 1.0.0}]
+generated: "2020-01-01T00:00:00Z"
+serverInfo: {contextPath: /charts}
+`
+	if err := os.WriteFile(filepath.Join(repo, IndexFileName), []byte(existing), 0o600); err != nil {
+		t.Fatalf("Failed to write index: %v", err)
+	}
+
+	for _, version := range []string{"1.0.0", "1.10.0", "1.2.0", "1.0.0"} {
+		archive := packageChart(t, `[{"kind":"Deployment"}]`, version, repo)
+		if err := UpdateIndex(repo, archive, "https://charts.example.com/"); err != nil {
+			t.Fatalf("UpdateIndex() error: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(repo, IndexFileName))
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	var index IndexFile
+	if err := yaml.Unmarshal(data, &index); err != nil {
+		t.Fatalf("Failed to parse index: %v", err)
+	}
+
+	var versions []string
+	for _, e := range index.Entries["nginx"] {
+		versions = append(versions, e.Version)
+	}
+	if !slices.Equal(versions, []string{"1.10.0", "1.2.0", "1.0.0"}) {
+		t.Errorf("Unexpected versions: %v", versions)
+	}
+	latest := index.Entries["nginx"][0]
+	if !slices.Equal(latest.URLs, []string{"https://charts.example.com/nginx-1.10.0.tgz"}) || len(latest.Digest) != 64 || latest.Created == "" {
+		t.Errorf("Unexpected entry: %+v", latest)
+	}
+	if index.Other["serverInfo"] == nil || index.Entries["other"][0].Other["dependencies"] == nil {
+		t.Errorf("Expected unknown fields to be kept, got:\n%s", data)
+	}
+	if index.Generated == "2020-01-01T00:00:00Z" {
+		t.Errorf("Expected generated to be updated")
+	}
+}
+
+func TestUpdateIndex_InvalidArchive(t *testing.T) {
+	t.Parallel()
+	repo := t.TempDir()
+	archive := filepath.Join(repo, "broken.tgz")
+	if err := os.WriteFile(archive, []byte("not a tarball"), 0o600); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+
+	err := UpdateIndex(repo, archive, "")
+	if !errors.Is(err, ErrInvalidArchive) {
+		t.Errorf("UpdateIndex() error = %v, want %v", err, ErrInvalidArchive)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.10.0", "1.2.0", 1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"v2", "1.9.9", 1},
+		{"1.0.0-alpha", "1.0.0-beta", -1},
+	} {
+		got := compareVersions(tc.a, tc.b)
+		if (got > 0) != (tc.want > 0) || (got < 0) != (tc.want < 0) {
+			t.Errorf("compareVersions(%s, %s) = %d, want sign of %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
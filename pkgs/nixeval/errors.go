@@ -0,0 +1,220 @@
+package nixeval
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+	// `at /path/helmfile.nix:3:10:` on its own line.
+	positionLine = regexp.MustCompile(`^at (.+?):(\d+)(?::(\d+))?:?$`)
+	// `undefined variable 'foo' at /path/helmfile.nix:3:10`, as printed by older nix versions.
+	inlinePosition = regexp.MustCompile(`^(.*?),? at (/\S+?):(\d+):(\d+)$`)
+	// Source snippets nix prints below positions, e.g. `  3|   name = foo;` and `   |          ^`.
+	snippetLine = regexp.MustCompile(`^\d*\s*\|`)
+	// The eval.nix helmfile-nix writes to a temporary file.
+	internalFile = regexp.MustCompile(`^eval\.\d+\.nix$`)
+)
+
+// Position is a location in a nix file. Line and Column are 1-based, and 0 when unknown.
+type Position struct {
+	File   string `json:"file,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Column int    `json:"column,omitempty"`
+}
+
+// String returns the position as file:line:column.
+func (p Position) String() string {
+	switch {
+	case p.Column > 0:
+		return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+	case p.Line > 0:
+		return fmt.Sprintf("%s:%d", p.File, p.Line)
+	}
+	return p.File
+}
+
+// Frame is a single entry of the nix stack trace, e.g. "while evaluating the attribute 'releases'".
+type Frame struct {
+	Message string `json:"message"`
+	Position
+}
+
+// EvalError is a failed nix evaluation, parsed from the output of nix.
+// Frames pointing into helmfile-nix's own eval.nix are left out of the trace.
+type EvalError struct {
+	Message string `json:"message"`
+	Position
+	Trace []Frame `json:"trace,omitempty"`
+	// Stderr is the unparsed output of nix.
+	Stderr string `json:"-"`
+	// Err is the error returned by running nix.
+	Err error `json:"-"`
+}
+
+// Error returns the error message, prefixed with its position if known.
+func (e *EvalError) Error() string {
+	if e.File == "" {
+		return e.Message
+	}
+	return e.Position.String() + ": " + e.Message
+}
+
+// Unwrap returns the error returned by running nix.
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// WriteText writes the error with a snippet of the source it points to, followed by the trace.
+func (e *EvalError) WriteText(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "error: %s\n", e.Message)
+	if e.File != "" {
+		fmt.Fprintf(&buf, "  --> %s\n", e.Position)
+		writeSnippet(&buf, e.Position)
+	}
+	for _, f := range e.Trace {
+		fmt.Fprintf(&buf, "  … %s\n", f.Message)
+		if f.File != "" {
+			fmt.Fprintf(&buf, "    at %s\n", f.Position)
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ParseError parses the stderr of a failed nix evaluation into an EvalError wrapping err.
+func ParseError(stderr []byte, err error) *EvalError {
+	e := &EvalError{
+		Stderr: string(stderr),
+		Err:    err,
+	}
+
+	var frames []Frame
+	var pos *Position
+	inMessage := false
+	for _, line := range strings.Split(ansiEscape.ReplaceAllString(string(stderr), ""), "\n") {
+		t := strings.TrimSpace(line)
+		m := positionLine.FindStringSubmatch(t)
+		switch {
+		case t == "":
+			inMessage = false
+		case strings.HasPrefix(t, "… "):
+			frames = append(frames, Frame{Message: strings.TrimPrefix(t, "… ")})
+			pos = &frames[len(frames)-1].Position
+			inMessage = false
+		case strings.HasPrefix(t, "error:"):
+			msg := strings.TrimSpace(strings.TrimPrefix(t, "error:"))
+			if msg == "" {
+				continue
+			}
+			// The innermost error is printed last.
+			e.Message = msg
+			e.Position = Position{}
+			pos = &e.Position
+			inMessage = true
+		case m != nil && pos != nil:
+			*pos = newPosition(m[1], m[2], m[3])
+			inMessage = false
+		case snippetLine.MatchString(t):
+		case inMessage:
+			e.Message += "\n" + t
+		}
+	}
+
+	if m := inlinePosition.FindStringSubmatch(e.Message); m != nil && e.File == "" {
+		e.Message = m[1]
+		e.Position = newPosition(m[2], m[3], m[4])
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(stderr))
+	}
+	if e.Message == "" && err != nil {
+		e.Message = err.Error()
+	}
+
+	for _, f := range frames {
+		if isUserFile(f.File) {
+			e.Trace = append(e.Trace, f)
+		}
+	}
+	if !isUserFile(e.File) {
+		e.Position = Position{}
+		// Point at the innermost frame in the user's files instead.
+		if len(e.Trace) > 0 {
+			e.Position = e.Trace[len(e.Trace)-1].Position
+		}
+	}
+	return e
+}
+
+func newPosition(file, line, column string) Position {
+	p := Position{File: file}
+	p.Line, _ = strconv.Atoi(line)
+	p.Column, _ = strconv.Atoi(column)
+	return p
+}
+
+// isUserFile tells if a position points to a file of the user, rather than eval.nix or an expression.
+func isUserFile(file string) bool {
+	return file != "" && !strings.HasPrefix(file, "«") && !internalFile.MatchString(filepath.Base(file))
+}
+
+// writeSnippet writes the line at p with the line before and after it, and a marker at the column.
+func writeSnippet(w io.Writer, p Position) {
+	if p.Line == 0 {
+		return
+	}
+	f, err := os.Open(p.File)
+	if err != nil {
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	var lines []string
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan() && n <= p.Line+1; n++ {
+		if n >= p.Line-1 {
+			lines = append(lines, s.Text())
+		}
+	}
+	first := max(p.Line-1, 1)
+	if p.Line-first >= len(lines) {
+		return
+	}
+
+	width := len(strconv.Itoa(first + len(lines) - 1))
+	gutter := strings.Repeat(" ", width)
+	fmt.Fprintf(w, "%s |\n", gutter)
+	for i, line := range lines {
+		n := first + i
+		fmt.Fprintf(w, "%*d | %s\n", width, n, line)
+		if n == p.Line && p.Column > 0 {
+			fmt.Fprintf(w, "%s | %s^\n", gutter, markerIndent(line, p.Column))
+		}
+	}
+}
+
+// markerIndent returns the whitespace needed to put a marker below column, keeping tabs aligned.
+func markerIndent(line string, column int) string {
+	var b strings.Builder
+	for i, r := range []rune(line) {
+		if i >= column-1 {
+			break
+		}
+		if r == '\t' {
+			b.WriteRune('\t')
+		} else {
+			b.WriteRune(' ')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,146 @@
+package nixeval
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const traceStderr = "error:\n" +
+	"       … while calling the 'import' builtin\n" +
+	"         at /tmp/eval.12345.nix:30:12:\n" +
+	"           29|     let\n" +
+	"           30|       hf = import \"/${state}/${file}\";\n" +
+	"             |            ^\n" +
+	"           31|     in\n" +
+	"\n" +
+	"       … while evaluating the attribute 'name'\n" +
+	"         at /src/helmfile.nix:5:7:\n" +
+	"            4|     {\n" +
+	"            5|       name = foo;\n" +
+	"             |       ^\n" +
+	"\n" +
+	"       error: undefined variable 'foo'\n" +
+	"       at /src/helmfile.nix:5:14:\n" +
+	"            4|     {\n" +
+	"            5|       name = foo;\n" +
+	"             |              ^\n"
+
+func TestParseError(t *testing.T) {
+	t.Parallel()
+	exitErr := errors.New("exit status 1")
+	e := ParseError([]byte(traceStderr), exitErr)
+
+	want := &EvalError{
+		Message:  "undefined variable 'foo'",
+		Position: Position{File: "/src/helmfile.nix", Line: 5, Column: 14},
+		Trace: []Frame{
+			{Message: "while evaluating the attribute 'name'", Position: Position{File: "/src/helmfile.nix", Line: 5, Column: 7}},
+		},
+		Stderr: traceStderr,
+		Err:    exitErr,
+	}
+	if !reflect.DeepEqual(e, want) {
+		t.Errorf("ParseError() = %#v, want %#v", e, want)
+	}
+	if !errors.Is(e, exitErr) {
+		t.Errorf("ParseError() should wrap the exit error")
+	}
+	if e.Error() != "/src/helmfile.nix:5:14: undefined variable 'foo'" {
+		t.Errorf("Error() = %q", e.Error())
+	}
+}
+
+func TestParseError_Formats(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		stderr string
+		want   string
+	}{
+		{
+			name:   "ansi colors",
+			stderr: "\x1b[31;1merror:\x1b[0m undefined variable '\x1b[35;1mfoo\x1b[0m'\n\n       at \x1b[35;1m/src/helmfile.nix:3:10\x1b[0m:\n",
+			want:   "/src/helmfile.nix:3:10: undefined variable 'foo'",
+		},
+		{
+			name:   "inline position",
+			stderr: "error: undefined variable 'foo' at /src/helmfile.nix:3:10\n",
+			want:   "/src/helmfile.nix:3:10: undefined variable 'foo'",
+		},
+		{
+			name:   "multiline message",
+			stderr: "error: attribute 'nope' missing\n       did you mean 'name'?\n\n       at /src/helmfile.nix:2:1:\n",
+			want:   "/src/helmfile.nix:2:1: attribute 'nope' missing\ndid you mean 'name'?",
+		},
+		{
+			name:   "only internal positions",
+			stderr: "error: value is a set while a list was expected\n\n       at /tmp/eval.999.nix:12:3:\n",
+			want:   "value is a set while a list was expected",
+		},
+		{
+			name:   "unstructured",
+			stderr: "nix: command not found\n",
+			want:   "nix: command not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := ParseError([]byte(tt.stderr), nil).Error(); got != tt.want {
+				t.Errorf("ParseError().Error() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalError_WriteText(t *testing.T) {
+	t.Parallel()
+	file := filepath.Join(t.TempDir(), "helmfile.nix")
+	if err := os.WriteFile(file, []byte("{ ... }:\n{\n  name = foo;\n}\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write helmfile.nix: %v", err)
+	}
+	e := &EvalError{
+		Message:  "undefined variable 'foo'",
+		Position: Position{File: file, Line: 3, Column: 10},
+		Trace:    []Frame{{Message: "while evaluating the attribute 'name'", Position: Position{File: file, Line: 3, Column: 3}}},
+	}
+
+	var out bytes.Buffer
+	if err := e.WriteText(&out); err != nil {
+		t.Fatalf("WriteText() error: %v", err)
+	}
+
+	want := "error: undefined variable 'foo'\n" +
+		"  --> " + file + ":3:10\n" +
+		"  |\n" +
+		"2 | {\n" +
+		"3 |   name = foo;\n" +
+		"  |          ^\n" +
+		"4 | }\n" +
+		"  … while evaluating the attribute 'name'\n" +
+		"    at " + file + ":3:3\n"
+	if out.String() != want {
+		t.Errorf("WriteText() =\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestEvalError_JSON(t *testing.T) {
+	t.Parallel()
+	e := ParseError([]byte(traceStderr), errors.New("exit status 1"))
+
+	out, err := json.Marshal(e)
+	if err != nil {
+		t.Fatalf("json.Marshal() error: %v", err)
+	}
+
+	want := `{"message":"undefined variable 'foo'","file":"/src/helmfile.nix","line":5,"column":14,` +
+		`"trace":[{"message":"while evaluating the attribute 'name'","file":"/src/helmfile.nix","line":5,"column":7}]}`
+	if string(out) != want {
+		t.Errorf("json.Marshal() = %s, want %s", out, want)
+	}
+}
@@ -0,0 +1,72 @@
+package nixeval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ErrNoResponse is returned by Fake when no canned response matches the expression.
+var ErrNoResponse = errors.New("no canned response for expression")
+
+// Fake is an in-process Evaluator that returns canned JSON or errors, for hermetic tests.
+// Responses are matched against the expression by substring, in registration order.
+type Fake struct {
+	mu        sync.Mutex
+	responses []fakeResponse
+	calls     []string
+}
+
+type fakeResponse struct {
+	match string
+	out   []byte
+	err   error
+}
+
+// NewFake creates a new fake evaluator without any responses.
+func NewFake() *Fake {
+	return &Fake{}
+}
+
+// Respond returns out for every expression containing match.
+// An empty match acts as a catch-all.
+func (f *Fake) Respond(match string, out []byte) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, fakeResponse{match: match, out: out})
+	return f
+}
+
+// Fail returns err for every expression containing match.
+func (f *Fake) Fail(match string, err error) *Fake {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, fakeResponse{match: match, err: err})
+	return f
+}
+
+// Eval returns the first registered response matching the expression.
+func (f *Fake) Eval(ctx context.Context, expr string, _ bool) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, expr)
+	for _, r := range f.responses {
+		if strings.Contains(expr, r.match) {
+			return r.out, r.err
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoResponse, expr)
+}
+
+// Calls returns the expressions evaluated so far.
+func (f *Fake) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
@@ -0,0 +1,65 @@
+package nixeval
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+var errBoom = errors.New("boom")
+
+func TestFake_Respond(t *testing.T) {
+	t.Parallel()
+	f := NewFake().
+		Respond("helmfile.nix", []byte(`[{"a":1}]`)).
+		Respond("", []byte(`[]`))
+
+	out, err := f.Eval(t.Context(), `(import /tmp/eval.nix).render "helmfile.nix"`, false)
+	if err != nil {
+		t.Fatalf("Eval() error: %v", err)
+	}
+	if string(out) != `[{"a":1}]` {
+		t.Errorf("Eval() = %s, want matching response", out)
+	}
+
+	out, err = f.Eval(t.Context(), `(import /tmp/eval.nix).render "chart.nix"`, false)
+	if err != nil {
+		t.Fatalf("Eval() error: %v", err)
+	}
+	if string(out) != `[]` {
+		t.Errorf("Eval() = %s, want catch-all response", out)
+	}
+
+	if len(f.Calls()) != 2 {
+		t.Errorf("Calls() = %v, want 2 calls", f.Calls())
+	}
+}
+
+func TestFake_Fail(t *testing.T) {
+	t.Parallel()
+	f := NewFake().Fail("broken", errBoom)
+
+	if _, err := f.Eval(t.Context(), "broken expr", false); !errors.Is(err, errBoom) {
+		t.Errorf("Eval() error = %v, want %v", err, errBoom)
+	}
+}
+
+func TestFake_NoResponse(t *testing.T) {
+	t.Parallel()
+	f := NewFake()
+
+	if _, err := f.Eval(t.Context(), "anything", false); !errors.Is(err, ErrNoResponse) {
+		t.Errorf("Eval() error = %v, want %v", err, ErrNoResponse)
+	}
+}
+
+func TestFake_CanceledContext(t *testing.T) {
+	t.Parallel()
+	f := NewFake().Respond("", []byte(`[]`))
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	if _, err := f.Eval(ctx, "anything", false); !errors.Is(err, context.Canceled) {
+		t.Errorf("Eval() error = %v, want %v", err, context.Canceled)
+	}
+}
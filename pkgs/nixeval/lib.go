@@ -0,0 +1,43 @@
+package nixeval
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ErrLibNotFound is returned when a local nixpkgs lib can not be found.
+var ErrLibNotFound = errors.New("nixpkgs lib not found")
+
+// ResolveLib returns the directory of a local nixpkgs lib.
+// The path may point to the lib directory itself, or to a nixpkgs or nixpkgs.lib checkout containing it.
+func ResolveLib(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("%w: no path given", ErrLibNotFound)
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, dir := range []string{filepath.Join(abs, "lib"), abs} {
+		if _, err := os.Stat(filepath.Join(dir, "default.nix")); err == nil {
+			return dir, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: expected %s or %s", ErrLibNotFound,
+		filepath.Join(abs, "default.nix"), filepath.Join(abs, "lib", "default.nix"))
+}
+
+// ImportEval returns an expression importing the eval.nix at evalFile.
+// If lib is empty, eval.nix fetches its pinned nixpkgs lib, otherwise the local lib is used.
+func ImportEval(evalFile string, lib string) string {
+	if lib == "" {
+		return fmt.Sprintf("(import %s { })", evalFile)
+	}
+	return fmt.Sprintf("(import %s { lib = import %s; })", evalFile, strconv.Quote(lib))
+}
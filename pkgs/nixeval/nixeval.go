@@ -4,42 +4,99 @@ package nixeval
 import (
 	"bytes"
 	"context"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"strings"
 )
 
+// Evaluator evaluates a Nix expression and returns the result as JSON.
+type Evaluator interface {
+	Eval(ctx context.Context, expr string, trace bool) ([]byte, error)
+}
+
+// NixEval evaluates expressions by calling the `nix` binary.
 type NixEval struct {
-	expr string
+	offline bool
 }
 
-func NewNixEval(expr string) *NixEval {
-	return &NixEval{expr: expr}
+// NewNixEval creates a new evaluator backed by the `nix` command line tool.
+// In offline mode nix is told not to use the network.
+func NewNixEval(offline bool) *NixEval {
+	return &NixEval{offline: offline}
 }
 
-func (n *NixEval) Eval(ctx context.Context, cmd []string) ([]byte, error) {
+// Eval runs `nix eval` on the expression and returns the JSON output.
+// Failed evaluations are returned as an *EvalError.
+func (n *NixEval) Eval(ctx context.Context, expr string, trace bool) ([]byte, error) {
+	cmd := n.Args(expr, trace)
 	eval := exec.CommandContext(ctx, "nix", cmd...)
 	log.Println("Running nix", strings.Join(cmd, " "))
-	eval.Stderr = os.Stderr
-	var out bytes.Buffer
+	var out, stderr bytes.Buffer
+	progress := &progressWriter{w: os.Stderr}
 	eval.Stdout = &out
+	// Warnings, downloads and traces are shown as they come, the copy is parsed on failure.
+	eval.Stderr = io.MultiWriter(&stderr, progress)
 	err := eval.Run()
+	progress.Flush()
 	if err != nil {
-		return nil, err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, ParseError(stderr.Bytes(), err)
 	}
-
 	return out.Bytes(), nil
 }
 
-func (n *NixEval) Args(trace bool) []string {
+// progressWriter passes on the output of nix line by line, up to the error it fails with,
+// which is shown as an EvalError instead.
+type progressWriter struct {
+	w      io.Writer
+	line   []byte
+	failed bool
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	if p.failed {
+		return len(b), nil
+	}
+	for _, c := range b {
+		p.line = append(p.line, c)
+		if c == '\n' {
+			p.Flush()
+		}
+	}
+	return len(b), nil
+}
+
+// Flush writes the pending line, even if it is not complete.
+func (p *progressWriter) Flush() {
+	line := p.line
+	p.line = nil
+	if len(line) == 0 || p.failed {
+		return
+	}
+	if strings.HasPrefix(ansiEscape.ReplaceAllString(string(line), ""), "error:") {
+		p.failed = true
+		return
+	}
+	// Only for the user to see, a failed write must not fail the evaluation.
+	_, _ = p.w.Write(line)
+}
+
+// Args returns the arguments passed to `nix` to evaluate the expression.
+func (n *NixEval) Args(expr string, trace bool) []string {
 	args := []string{
 		"--extra-experimental-features", "nix-command",
 		"--extra-experimental-features", "flakes",
 		"eval",
 		"--json",
 		"--impure",
-		"--expr", n.expr,
+		"--expr", expr,
+	}
+	if n.offline {
+		args = append(args, "--offline")
 	}
 	if trace {
 		args = append(args, "--show-trace")
@@ -0,0 +1,113 @@
+package nixeval
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNixEval_Args(t *testing.T) {
+	t.Parallel()
+	n := NewNixEval(false)
+
+	args := n.Args("1 + 1", false)
+	if args[len(args)-1] != "1 + 1" {
+		t.Errorf("Args() should end with the expression, got %v", args)
+	}
+
+	args = n.Args("1 + 1", true)
+	if args[len(args)-1] != "--show-trace" {
+		t.Errorf("Args() with trace should end with --show-trace, got %v", args)
+	}
+}
+
+func TestNixEval_Args_Offline(t *testing.T) {
+	t.Parallel()
+	args := NewNixEval(true).Args("1 + 1", false)
+	if !slices.Contains(args, "--offline") {
+		t.Errorf("Args() in offline mode should contain --offline, got %v", args)
+	}
+
+	args = NewNixEval(false).Args("1 + 1", false)
+	if slices.Contains(args, "--offline") {
+		t.Errorf("Args() should not contain --offline, got %v", args)
+	}
+}
+
+func TestResolveLib(t *testing.T) {
+	t.Parallel()
+	checkout := t.TempDir()
+	libDir := filepath.Join(checkout, "lib")
+	if err := os.MkdirAll(libDir, 0o700); err != nil {
+		t.Fatalf("Failed to create lib dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(libDir, "default.nix"), []byte("{ }"), 0o600); err != nil {
+		t.Fatalf("Failed to write default.nix: %v", err)
+	}
+
+	for _, path := range []string{checkout, libDir} {
+		got, err := ResolveLib(path)
+		if err != nil {
+			t.Fatalf("ResolveLib(%s) error: %v", path, err)
+		}
+		if got != libDir {
+			t.Errorf("ResolveLib(%s) = %s, want %s", path, got, libDir)
+		}
+	}
+}
+
+func TestResolveLib_NotFound(t *testing.T) {
+	t.Parallel()
+	for _, path := range []string{"", t.TempDir(), "/nonexistent/lib"} {
+		if _, err := ResolveLib(path); !errors.Is(err, ErrLibNotFound) {
+			t.Errorf("ResolveLib(%q) error = %v, want %v", path, err, ErrLibNotFound)
+		}
+	}
+}
+
+func TestImportEval(t *testing.T) {
+	t.Parallel()
+	if got := ImportEval("/tmp/eval.nix", ""); got != "(import /tmp/eval.nix { })" {
+		t.Errorf("ImportEval() without lib = %s", got)
+	}
+
+	got := ImportEval("/tmp/eval.nix", "/nix/store/abc-lib/lib")
+	if !strings.Contains(got, `lib = import "/nix/store/abc-lib/lib";`) {
+		t.Errorf("ImportEval() with lib = %s", got)
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	t.Parallel()
+	var out strings.Builder
+	p := &progressWriter{w: &out}
+	for _, chunk := range []string{"warning: Git tree is dirty\ntrace: ", "replicas = 3\n", "\x1b[31;1merror:\x1b[0m undefined variable\n", "       at /helmfile.nix:3:10\n"} {
+		if _, err := p.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Write() error: %v", err)
+		}
+	}
+	p.Flush()
+
+	// The error is shown as an EvalError, not passed on.
+	want := "warning: Git tree is dirty\ntrace: replicas = 3\n"
+	if out.String() != want {
+		t.Errorf("progressWriter wrote %q, want %q", out.String(), want)
+	}
+}
+
+func TestProgressWriter_Flush(t *testing.T) {
+	t.Parallel()
+	var out strings.Builder
+	p := &progressWriter{w: &out}
+	_, _ = p.Write([]byte("copying path"))
+	if out.Len() != 0 {
+		t.Errorf("progressWriter wrote an incomplete line: %q", out.String())
+	}
+	p.Flush()
+	if out.String() != "copying path" {
+		t.Errorf("Flush() wrote %q, want the pending line", out.String())
+	}
+}
@@ -0,0 +1,444 @@
+// Package schema validates decoded YAML and JSON documents against a subset of JSON Schema.
+//
+// Supported keywords are type, enum, const, properties, required, additionalProperties,
+// items, minItems, maxItems, minimum, maximum, minLength, maxLength, pattern,
+// allOf, anyOf, oneOf and local $ref into definitions or $defs.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Static errors for schema package.
+var (
+	ErrInvalidSchema = errors.New("invalid schema")
+	ErrUnknownRef    = errors.New("unknown $ref")
+)
+
+// Schema is a parsed JSON Schema.
+type Schema struct {
+	Type                 Types              `json:"type,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Const                any                `json:"const,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Definitions          map[string]*Schema `json:"definitions,omitempty"`
+	Defs                 map[string]*Schema `json:"$defs,omitempty"`
+
+	// Boolean schemas, `true` accepts and `false` rejects everything.
+	never   bool
+	pattern *regexp.Regexp
+}
+
+// Types is the `type` keyword, which is a single type name or a list of them.
+type Types []string
+
+// UnmarshalJSON accepts both a single type name and a list.
+func (t *Types) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = Types{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%w: type must be a string or a list of strings", ErrInvalidSchema)
+	}
+	*t = list
+	return nil
+}
+
+// UnmarshalJSON parses a schema, including the boolean forms.
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch string(data) {
+	case "true":
+		*s = Schema{}
+		return nil
+	case "false":
+		*s = Schema{never: true}
+		return nil
+	}
+
+	// Avoid recursing into this method.
+	type plain Schema
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*s = Schema(p)
+	return nil
+}
+
+// Parse parses a JSON Schema and checks that its patterns and references are valid.
+func Parse(data []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSchema, err)
+	}
+	if err := s.compile(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// MustParse parses a JSON Schema and panics if it is invalid. Meant for built-in schemas.
+func MustParse(data []byte) *Schema {
+	s, err := Parse(data)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Finding is a single place where a document does not match the schema.
+type Finding struct {
+	// Path to the offending value, e.g. `releases[3].namespace`. Empty for the document itself.
+	Path    string `json:"path"`
+	Message string `json:"message"`
+	// Value is the offending value, or nil for missing and unknown fields.
+	Value any `json:"-"`
+}
+
+func (f Finding) String() string {
+	if f.Path == "" {
+		return f.Message
+	}
+	return f.Path + ": " + f.Message
+}
+
+// Validate returns every place in v that does not match the schema, ordered by path.
+func (s *Schema) Validate(v any) []Finding {
+	var findings []Finding
+	s.validate(s, "", v, &findings)
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Path < findings[j].Path })
+	return findings
+}
+
+func (s *Schema) compile(root *Schema) error {
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%w: pattern %q: %w", ErrInvalidSchema, s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	if s.Ref != "" {
+		if _, err := root.resolve(s.Ref); err != nil {
+			return err
+		}
+	}
+
+	children := slices.Concat(s.AllOf, s.AnyOf, s.OneOf, []*Schema{s.AdditionalProperties, s.Items})
+	for _, m := range []map[string]*Schema{s.Properties, s.Definitions, s.Defs} {
+		for _, c := range m {
+			children = append(children, c)
+		}
+	}
+	for _, c := range children {
+		if c == nil {
+			continue
+		}
+		if err := c.compile(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Schema) resolve(ref string) (*Schema, error) {
+	for _, prefix := range []string{"#/definitions/", "#/$defs/"} {
+		name, ok := strings.CutPrefix(ref, prefix)
+		if !ok {
+			continue
+		}
+		defs := s.Definitions
+		if prefix == "#/$defs/" {
+			defs = s.Defs
+		}
+		if d, ok := defs[name]; ok {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownRef, ref)
+}
+
+func (s *Schema) validate(root *Schema, path string, v any, findings *[]Finding) {
+	fail := func(format string, args ...any) {
+		*findings = append(*findings, Finding{Path: path, Message: fmt.Sprintf(format, args...), Value: v})
+	}
+
+	if s.never {
+		fail("not allowed")
+		return
+	}
+	if s.Ref != "" {
+		ref, err := root.resolve(s.Ref)
+		if err != nil {
+			fail("%s", err)
+			return
+		}
+		ref.validate(root, path, v, findings)
+	}
+
+	if len(s.Type) > 0 && !slices.ContainsFunc(s.Type, func(t string) bool { return hasType(v, t) }) {
+		fail("expected %s, got %s", strings.Join(s.Type, " or "), typeName(v))
+		// Nothing below makes sense for a value of the wrong type.
+		return
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e any) bool { return equal(e, v) }) {
+		fail("must be one of %s", formatList(s.Enum))
+	}
+	if s.Const != nil && !equal(s.Const, v) {
+		fail("must be %s", formatValue(s.Const))
+	}
+
+	for _, sub := range s.AllOf {
+		sub.validate(root, path, v, findings)
+	}
+	if len(s.AnyOf) > 0 && s.matching(root, s.AnyOf, v) == 0 {
+		fail("does not match any of the allowed forms")
+	}
+	if len(s.OneOf) > 0 {
+		if n := s.matching(root, s.OneOf, v); n != 1 {
+			fail("must match exactly one of the allowed forms, matches %d", n)
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		s.validateObject(root, path, v, findings)
+	case []any:
+		s.validateArray(root, path, v, findings, fail)
+	case string:
+		n := len([]rune(v))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("must be at most %d characters long", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match %q", s.Pattern)
+		}
+	default:
+		if f, ok := number(v); ok {
+			if s.Minimum != nil && f < *s.Minimum {
+				fail("must be at least %v", *s.Minimum)
+			}
+			if s.Maximum != nil && f > *s.Maximum {
+				fail("must be at most %v", *s.Maximum)
+			}
+		}
+	}
+}
+
+func (s *Schema) validateObject(root *Schema, path string, v map[string]any, findings *[]Finding) {
+	for _, name := range s.Required {
+		if _, ok := v[name]; !ok {
+			*findings = append(*findings, Finding{Path: path, Message: fmt.Sprintf("missing required field %q", name)})
+		}
+	}
+
+	for _, k := range sortedKeys(v) {
+		p := JoinPath(path, k)
+		if prop, ok := s.Properties[k]; ok {
+			prop.validate(root, p, v[k], findings)
+			continue
+		}
+		if s.AdditionalProperties == nil {
+			continue
+		}
+		if s.AdditionalProperties.never {
+			msg := "unknown field"
+			if suggestion := closest(k, s.Properties); suggestion != "" {
+				msg += fmt.Sprintf(", did you mean %q?", suggestion)
+			}
+			*findings = append(*findings, Finding{Path: p, Message: msg})
+			continue
+		}
+		s.AdditionalProperties.validate(root, p, v[k], findings)
+	}
+}
+
+func (s *Schema) validateArray(root *Schema, path string, v []any, findings *[]Finding, fail func(string, ...any)) {
+	if s.MinItems != nil && len(v) < *s.MinItems {
+		fail("must have at least %d items", *s.MinItems)
+	}
+	if s.MaxItems != nil && len(v) > *s.MaxItems {
+		fail("must have at most %d items", *s.MaxItems)
+	}
+	if s.Items == nil {
+		return
+	}
+	for i, item := range v {
+		s.Items.validate(root, fmt.Sprintf("%s[%d]", path, i), item, findings)
+	}
+}
+
+// matching returns how many of the schemas v matches.
+func (s *Schema) matching(root *Schema, schemas []*Schema, v any) int {
+	n := 0
+	for _, sub := range schemas {
+		var f []Finding
+		sub.validate(root, "", v, &f)
+		if len(f) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// JoinPath appends a field to a path, quoting it if it would be ambiguous.
+func JoinPath(path, key string) string {
+	if key == "" || strings.ContainsAny(key, ".[]\" ") {
+		key = strconv.Quote(key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func hasType(v any, t string) bool {
+	switch t {
+	case "null":
+		return v == nil
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "number":
+		_, ok := number(v)
+		return ok
+	case "integer":
+		f, ok := number(v)
+		return ok && f == math.Trunc(f)
+	}
+	return false
+}
+
+func typeName(v any) string {
+	for _, t := range []string{"null", "boolean", "string", "object", "array", "integer", "number"} {
+		if hasType(v, t) {
+			return t
+		}
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func number(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func equal(a, b any) bool {
+	if fa, ok := number(a); ok {
+		fb, ok := number(b)
+		return ok && fa == fb
+	}
+	aj, errA := json.Marshal(a)
+	bj, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aj, bj)
+}
+
+func formatValue(v any) string {
+	out, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(out)
+}
+
+func formatList(values []any) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = formatValue(v)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// closest returns the known property closest to name, if it looks like a typo of it.
+func closest(name string, properties map[string]*Schema) string {
+	best, bestDist := "", 3
+	for _, p := range sortedKeys(properties) {
+		if d := distance(strings.ToLower(name), strings.ToLower(p)); d < bestDist {
+			best, bestDist = p, d
+		}
+	}
+	return best
+}
+
+// distance is the Levenshtein distance between a and b.
+func distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
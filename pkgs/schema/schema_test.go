@@ -0,0 +1,144 @@
+package schema
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const testSchema = `{
+  "type": "object",
+  "additionalProperties": false,
+  "required": ["name"],
+  "properties": {
+    "name": {"type": "string", "pattern": "^[a-z-]+$"},
+    "namespace": {"type": "string"},
+    "replicas": {"type": "integer", "minimum": 1},
+    "mode": {"enum": ["fast", "slow"]},
+    "ports": {"type": "array", "maxItems": 2, "items": {"$ref": "#/$defs/port"}},
+    "labels": {"type": "object", "additionalProperties": {"type": "string"}},
+    "image": {"anyOf": [{"type": "string"}, {"$ref": "#/definitions/image"}]}
+  },
+  "$defs": {
+    "port": {"type": "integer", "maximum": 65535}
+  },
+  "definitions": {
+    "image": {"type": "object", "required": ["tag"], "properties": {"tag": {"type": "string"}}}
+  }
+}`
+
+func decode(t *testing.T, doc string) any {
+	t.Helper()
+	var v any
+	if err := yaml.Unmarshal([]byte(doc), &v); err != nil {
+		t.Fatalf("Failed to decode %q: %v", doc, err)
+	}
+	return v
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	s, err := Parse([]byte(testSchema))
+	if err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{
+			name: "valid",
+			doc:  "{name: app, replicas: 2, mode: fast, ports: [80], labels: {team: a}, image: {tag: v1}}",
+		},
+		{
+			name: "unknown field",
+			doc:  "{name: app, namspace: web}",
+			want: []string{`namspace: unknown field, did you mean "namespace"?`},
+		},
+		{
+			name: "wrong types",
+			doc:  "{name: app, namespace: [web], replicas: 1.5}",
+			want: []string{"namespace: expected string, got array", "replicas: expected integer, got number"},
+		},
+		{
+			name: "missing required",
+			doc:  "{namespace: web}",
+			want: []string{`missing required field "name"`},
+		},
+		{
+			name: "nested",
+			doc:  "{name: App, ports: [80, 70000, 443], labels: {team: 1}, mode: medium}",
+			want: []string{
+				"labels.team: expected string, got integer",
+				`mode: must be one of "fast", "slow"`,
+				`name: must match "^[a-z-]+$"`,
+				"ports: must have at most 2 items",
+				"ports[1]: must be at most 65535",
+			},
+		},
+		{
+			name: "any of",
+			doc:  "{name: app, image: {repo: nginx}}",
+			want: []string{"image: does not match any of the allowed forms"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var got []string
+			for _, f := range s.Validate(decode(t, tt.doc)) {
+				got = append(got, f.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate_Paths(t *testing.T) {
+	t.Parallel()
+	s := MustParse([]byte(`{"properties": {"releases": {"items": {"additionalProperties": false, "properties": {"name": {}}}}}}`))
+
+	findings := s.Validate(decode(t, "releases: [{name: a}, {name: b, chart.name: c}]"))
+	if len(findings) != 1 || findings[0].Path != `releases[1]."chart.name"` {
+		t.Errorf("Validate() unexpected findings: %v", findings)
+	}
+}
+
+func TestValidate_BooleanSchemas(t *testing.T) {
+	t.Parallel()
+	s := MustParse([]byte(`{"properties": {"any": true, "none": false}}`))
+
+	if f := s.Validate(decode(t, "{any: [1, {a: b}]}")); len(f) != 0 {
+		t.Errorf("Validate() with true schema should accept anything, got %v", f)
+	}
+	if f := s.Validate(decode(t, "{none: 1}")); len(f) != 1 || f[0].String() != "none: not allowed" {
+		t.Errorf("Validate() with false schema should reject, got %v", f)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		schema string
+		err    error
+	}{
+		"json":    {`{"type": `, ErrInvalidSchema},
+		"type":    {`{"type": 1}`, ErrInvalidSchema},
+		"pattern": {`{"pattern": "("}`, ErrInvalidSchema},
+		"ref":     {`{"items": {"$ref": "#/$defs/missing"}}`, ErrUnknownRef},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := Parse([]byte(tt.schema)); !errors.Is(err, tt.err) {
+				t.Errorf("Parse() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+// Package sops decrypts YAML files encrypted by sops with age recipients.
+//
+// Only the parts of the sops format needed to read such files are implemented:
+// values encrypted with AES256_GCM, the data key encrypted with age and the MAC.
+package sops
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// MetadataKey is the top level key sops stores its metadata under.
+const MetadataKey = "sops"
+
+// Static errors for the sops package.
+var (
+	ErrNotEncrypted   = errors.New("not a sops encrypted file")
+	ErrNoAgeKey       = errors.New("no age identity can decrypt the file")
+	ErrInvalidValue   = errors.New("invalid encrypted value")
+	ErrMACMismatch    = errors.New("MAC mismatch, the file has been modified")
+	ErrNoIdentities   = errors.New("no age identities found")
+	ErrNotMapping     = errors.New("expected a mapping at the top of the file")
+	ErrUnsupportedKey = errors.New("keys must be strings")
+)
+
+// encrypted matches a value encrypted by sops.
+var encrypted = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// metadata is the part of the sops metadata needed to decrypt with age.
+type metadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+		Enc       string `yaml:"enc"`
+	} `yaml:"age"`
+	LastModified     string `yaml:"lastmodified"`
+	MAC              string `yaml:"mac"`
+	MACOnlyEncrypted bool   `yaml:"mac_only_encrypted"`
+}
+
+// Decrypt decrypts a sops encrypted YAML document with one of the age identities,
+// and verifies its MAC. The sops metadata is not part of the result.
+func Decrypt(data []byte, identities []age.Identity) (map[string]any, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, ErrNotMapping
+	}
+	root := doc.Content[0]
+
+	var meta *metadata
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == MetadataKey {
+			meta = &metadata{}
+			if err := root.Content[i+1].Decode(meta); err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrNotEncrypted, err)
+			}
+		}
+	}
+	if meta == nil || len(meta.Age) == 0 {
+		return nil, ErrNotEncrypted
+	}
+
+	key, err := meta.dataKey(identities)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decrypter{key: key, hash: sha512.New(), macOnlyEncrypted: meta.MACOnlyEncrypted}
+	values, err := d.mapping(root, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	mac, err := decryptValue(meta.MAC, key, meta.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt MAC: %w", err)
+	}
+	if mac != fmt.Sprintf("%X", d.hash.Sum(nil)) {
+		return nil, ErrMACMismatch
+	}
+
+	m, ok := values.(map[string]any)
+	if !ok {
+		return nil, ErrNotMapping
+	}
+	return m, nil
+}
+
+// dataKey decrypts the data key the values are encrypted with.
+func (m *metadata) dataKey(identities []age.Identity) ([]byte, error) {
+	var errs []error
+	for _, a := range m.Age {
+		r, err := age.Decrypt(armor.NewReader(strings.NewReader(a.Enc)), identities...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", a.Recipient, err))
+			continue
+		}
+		return io.ReadAll(r)
+	}
+	return nil, fmt.Errorf("%w: %w", ErrNoAgeKey, errors.Join(errs...))
+}
+
+// decrypter walks a document in order, decrypting values and hashing them for the MAC like sops does.
+type decrypter struct {
+	key              []byte
+	hash             hash.Hash
+	macOnlyEncrypted bool
+}
+
+func (d *decrypter) mapping(n *yaml.Node, path []string, top bool) (any, error) {
+	m := make(map[string]any, len(n.Content)/2)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k := n.Content[i]
+		if k.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedKey, strings.Join(path, "."))
+		}
+		if top && k.Value == MetadataKey {
+			continue
+		}
+		v, err := d.node(n.Content[i+1], append(path[:len(path):len(path)], k.Value))
+		if err != nil {
+			return nil, err
+		}
+		m[k.Value] = v
+	}
+	return m, nil
+}
+
+func (d *decrypter) node(n *yaml.Node, path []string) (any, error) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return d.mapping(n, path, false)
+	case yaml.SequenceNode:
+		// sops does not add list indices to the path.
+		list := make([]any, 0, len(n.Content))
+		for _, c := range n.Content {
+			v, err := d.node(c, path)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case yaml.AliasNode:
+		return d.node(n.Alias, path)
+	}
+
+	var v any
+	if err := n.Decode(&v); err != nil {
+		return nil, err
+	}
+	s, ok := v.(string)
+	isEncrypted := ok && encrypted.MatchString(s)
+	if isEncrypted {
+		var err error
+		v, err = decryptTyped(s, d.key, strings.Join(path, ":")+":")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", strings.Join(path, "."), err)
+		}
+	}
+	if isEncrypted || !d.macOnlyEncrypted {
+		d.hash.Write(macBytes(v))
+	}
+	return v, nil
+}
+
+// macBytes is how sops writes a value to the MAC.
+func macBytes(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return []byte(v)
+	case int:
+		return []byte(strconv.Itoa(v))
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		if v {
+			return []byte("True")
+		}
+		return []byte("False")
+	case []byte:
+		return v
+	}
+	return nil
+}
+
+// decryptTyped decrypts a value and converts it to the type it had before encryption.
+func decryptTyped(value string, key []byte, additionalData string) (any, error) {
+	match := encrypted.FindStringSubmatch(value)
+	if match == nil {
+		return nil, ErrInvalidValue
+	}
+	plain, err := decrypt(match, key, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	switch match[4] {
+	case "str":
+		return string(plain), nil
+	case "int":
+		return strconv.Atoi(string(plain))
+	case "float":
+		return strconv.ParseFloat(string(plain), 64)
+	case "bool":
+		return strconv.ParseBool(string(plain))
+	case "bytes":
+		return plain, nil
+	}
+	return nil, fmt.Errorf("%w: unknown type %s", ErrInvalidValue, match[4])
+}
+
+// decryptValue decrypts a string value.
+func decryptValue(value string, key []byte, additionalData string) (string, error) {
+	match := encrypted.FindStringSubmatch(value)
+	if match == nil {
+		return "", ErrInvalidValue
+	}
+	plain, err := decrypt(match, key, additionalData)
+	return string(plain), err
+}
+
+func decrypt(match []string, key []byte, additionalData string) ([]byte, error) {
+	var parts [3][]byte
+	for i := range parts {
+		b, err := base64.StdEncoding.DecodeString(match[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidValue, err)
+		}
+		parts[i] = b
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidValue, err)
+	}
+	return plain, nil
+}
+
+// Identities loads the age identities to decrypt with, from the same places as sops:
+// keyFile if it is set, otherwise $SOPS_AGE_KEY or the sops keys.txt in the user config dir.
+func Identities(keyFile string) ([]age.Identity, error) {
+	if keyFile == "" {
+		if keys := os.Getenv("SOPS_AGE_KEY"); keys != "" {
+			return parseIdentities(strings.NewReader(keys), "SOPS_AGE_KEY")
+		}
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrNoIdentities, err)
+		}
+		keyFile = filepath.Join(dir, "sops", "age", "keys.txt")
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoIdentities, err)
+	}
+	return parseIdentities(bytes.NewReader(data), keyFile)
+}
+
+func parseIdentities(r io.Reader, source string) ([]age.Identity, error) {
+	ids, err := age.ParseIdentities(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w in %s: %w", ErrNoIdentities, source, err)
+	}
+	return ids, nil
+}
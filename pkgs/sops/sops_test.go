@@ -0,0 +1,229 @@
+package sops
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+const lastModified = "2025-01-02T03:04:05Z"
+
+// encryptValue encrypts a value the way sops does.
+func encryptValue(t *testing.T, v any, key []byte, additionalData string) string {
+	t.Helper()
+	var typ string
+	switch v.(type) {
+	case string:
+		typ = "str"
+	case int:
+		typ = "int"
+	case float64:
+		typ = "float"
+	case bool:
+		typ = "bool"
+	default:
+		t.Fatalf("can not encrypt %#v", v)
+	}
+
+	iv := make([]byte, 32)
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := gcm.Seal(nil, iv, macBytes(v), []byte(additionalData))
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]",
+		base64.StdEncoding.EncodeToString(out[:len(out)-aes.BlockSize]),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(out[len(out)-aes.BlockSize:]),
+		typ)
+}
+
+// Encrypt a plain YAML document like `sops --encrypt --age <recipient>`.
+// Keys ending in _unencrypted are left as they are.
+func encryptYAML(t *testing.T, plain string, recipient *age.X25519Recipient) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(plain), &doc); err != nil {
+		t.Fatal(err)
+	}
+	h := sha512.New()
+	var walk func(n *yaml.Node, path []string, skip bool)
+	walk = func(n *yaml.Node, path []string, skip bool) {
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				k := n.Content[i].Value
+				walk(n.Content[i+1], append(path[:len(path):len(path)], k), skip || strings.HasSuffix(k, "_unencrypted"))
+			}
+		case yaml.SequenceNode:
+			for _, c := range n.Content {
+				walk(c, path, skip)
+			}
+		case yaml.ScalarNode:
+			var v any
+			if err := n.Decode(&v); err != nil {
+				t.Fatal(err)
+			}
+			h.Write(macBytes(v))
+			if !skip {
+				n.SetString(encryptValue(t, v, key, strings.Join(path, ":")+":"))
+			}
+		}
+	}
+	walk(doc.Content[0], nil, false)
+
+	var enc bytes.Buffer
+	aw := armor.NewWriter(&enc)
+	w, err := age.Encrypt(aw, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := yaml.Marshal(map[string]any{
+		MetadataKey: map[string]any{
+			"age":                []map[string]string{{"recipient": recipient.String(), "enc": enc.String()}},
+			"lastmodified":       lastModified,
+			"mac":                encryptValue(t, fmt.Sprintf("%X", h.Sum(nil)), key, lastModified),
+			"unencrypted_suffix": "_unencrypted",
+			"version":            "3.9.0",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(out, meta...)
+}
+
+func newIdentity(t *testing.T) *age.X25519Identity {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestDecrypt(t *testing.T) {
+	t.Parallel()
+	id := newIdentity(t)
+	data := encryptYAML(t, `
+db:
+  password: hunter2
+  port: 5432
+  ratio: 0.5
+  enabled: true
+tokens: [a, b]
+name_unencrypted: visible
+`, id.Recipient())
+
+	if !bytes.Contains(data, []byte("name_unencrypted: visible")) || bytes.Contains(data, []byte("hunter2")) {
+		t.Fatalf("unexpected encrypted file:\n%s", data)
+	}
+
+	got, err := Decrypt(data, []age.Identity{newIdentity(t), id})
+	if err != nil {
+		t.Fatalf("Decrypt() error: %v", err)
+	}
+	want := map[string]any{
+		"db":               map[string]any{"password": "hunter2", "port": 5432, "ratio": 0.5, "enabled": true},
+		"tokens":           []any{"a", "b"},
+		"name_unencrypted": "visible",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decrypt() = %#v, want %#v", got, want)
+	}
+}
+
+func TestDecrypt_Errors(t *testing.T) {
+	t.Parallel()
+	id := newIdentity(t)
+	data := encryptYAML(t, "password: hunter2\nname_unencrypted: visible\n", id.Recipient())
+
+	tests := []struct {
+		name       string
+		data       []byte
+		identities []age.Identity
+		wantErr    error
+	}{
+		{"plain file", []byte("password: hunter2\n"), []age.Identity{id}, ErrNotEncrypted},
+		{"not a mapping", []byte("- a\n"), []age.Identity{id}, ErrNotMapping},
+		{"wrong key", data, []age.Identity{newIdentity(t)}, ErrNoAgeKey},
+		{"tampered plain value", bytes.Replace(data, []byte("visible"), []byte("changed"), 1), []age.Identity{id}, ErrMACMismatch},
+		{"moved value", bytes.Replace(data, []byte("password:"), []byte("secret:"), 1), []age.Identity{id}, ErrInvalidValue},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := Decrypt(tt.data, tt.identities)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Decrypt() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIdentities(t *testing.T) {
+	id := newIdentity(t)
+	keyFile := filepath.Join(t.TempDir(), "keys.txt")
+	content := "# created: 2025-01-02T03:04:05Z\n# public key: " + id.Recipient().String() + "\n" + id.String() + "\n"
+	if err := os.WriteFile(keyFile, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := Identities(keyFile)
+	if err != nil {
+		t.Fatalf("Identities() error: %v", err)
+	}
+	if len(ids) != 1 {
+		t.Errorf("Identities() = %d identities, want 1", len(ids))
+	}
+
+	t.Setenv("SOPS_AGE_KEY", id.String())
+	if ids, err := Identities(""); err != nil || len(ids) != 1 {
+		t.Errorf("Identities(\"\") with SOPS_AGE_KEY = %d identities, %v", len(ids), err)
+	}
+
+	if _, err := Identities(filepath.Join(t.TempDir(), "missing.txt")); !errors.Is(err, ErrNoIdentities) {
+		t.Errorf("Identities() error = %v, want %v", err, ErrNoIdentities)
+	}
+}
@@ -2,28 +2,135 @@
 package tempfiles
 
 import (
+	"errors"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
 )
 
 var l = log.Default()
 
-// WriteEvalNix writes the eval.nix to a temporary file. Must be removed after use.
-func WriteEvalNix(eval string) (*os.File, error) {
-	f, err := os.CreateTemp("", "eval.*.nix")
+// ErrCleanedUp is returned when a Manager is used after Cleanup.
+var ErrCleanedUp = errors.New("temporary files were already cleaned up")
+
+// Manager owns the temporary files of one run of helmfile-nix. They are created in a workspace
+// directory unique to the run, so concurrent runs never share files and nothing is reused from
+// an earlier run. Files that must live elsewhere, like next to a helmfile, can be tracked so that
+// Cleanup removes them too. A Manager is safe for concurrent use.
+type Manager struct {
+	mu      sync.Mutex
+	dir     string
+	tracked []string
+	closed  bool
+}
+
+// NewManager creates a manager. The workspace is created on first use.
+func NewManager() *Manager {
+	return &Manager{}
+}
+
+// workspace returns the workspace directory, creating it if needed. m.mu must be held.
+func (m *Manager) workspace() (string, error) {
+	if m.closed {
+		return "", ErrCleanedUp
+	}
+	if m.dir == "" {
+		dir, err := os.MkdirTemp("", "helmfile-nix-*")
+		if err != nil {
+			return "", err
+		}
+		m.dir = dir
+	}
+	return m.dir, nil
+}
+
+// MkdirTemp creates a new directory in the workspace, named like os.MkdirTemp does with pattern.
+func (m *Manager) MkdirTemp(pattern string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, err := m.workspace()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	return os.MkdirTemp(dir, pattern)
+}
 
-	defer func() {
-		if err := f.Close(); err != nil {
-			l.Fatalf("Could not close eval.nix: %s", err)
+// WriteTemp writes data to a new file in the workspace, named like os.CreateTemp does with pattern.
+// Returns the path of the file.
+func (m *Manager) WriteTemp(pattern string, data []byte) (string, error) {
+	m.mu.Lock()
+	dir, err := m.workspace()
+	m.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// Remove removes a temporary file or directory once it is no longer needed, instead of waiting
+// for Cleanup. A file that is already gone, like after Cleanup on a signal, is not an error.
+func (m *Manager) Remove(path string) {
+	if err := os.RemoveAll(path); err != nil {
+		l.Printf("Could not remove %s: %s", path, err)
+	}
+}
+
+// Track makes Cleanup remove path, for temporary files outside the workspace.
+func (m *Manager) Track(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tracked = append(m.tracked, path)
+}
+
+// Cleanup removes the workspace and the tracked files. It can be called several times,
+// and from another goroutine, like on a signal. The manager can not be used afterwards.
+func (m *Manager) Cleanup() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	for _, path := range append(m.tracked, m.dir) {
+		if path == "" {
+			continue
 		}
-	}()
+		if err := os.RemoveAll(path); err != nil {
+			l.Printf("Could not remove %s: %s", path, err)
+		}
+	}
+	m.tracked, m.dir = nil, ""
+}
 
-	if _, err := f.WriteString(eval); err != nil {
-		return nil, err
+// WriteFileAtomic writes data to path through a temporary file in the same directory that is
+// renamed over it, so readers never see a partly written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
 	}
+	defer func() {
+		// Only left over if something failed.
+		_ = os.Remove(f.Name())
+	}()
 
-	return f, nil
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
 }
@@ -1,132 +1,122 @@
 package tempfiles
 
 import (
+	"errors"
 	"os"
-	"strings"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
-func TestWriteEvalNix_Success(t *testing.T) {
+func TestManager(t *testing.T) {
 	t.Parallel()
-	evalContent := `
-{
-  test = "content";
-}
-`
+	m := NewManager()
 
-	f, err := WriteEvalNix(evalContent)
+	first, err := m.MkdirTemp("chart-*")
 	if err != nil {
-		t.Fatalf("WriteEvalNix() error: %v", err)
-	}
-
-	// File should exist
-	if _, err := os.Stat(f.Name()); os.IsNotExist(err) {
-		t.Errorf("WriteEvalNix() file does not exist: %s", f.Name())
+		t.Fatalf("MkdirTemp() error: %v", err)
 	}
-
-	// Verify filename pattern
-	if !strings.HasPrefix(f.Name(), os.TempDir()) {
-		t.Errorf("WriteEvalNix() file not in temp dir: %s", f.Name())
+	second, err := m.MkdirTemp("chart-*")
+	if err != nil {
+		t.Fatalf("MkdirTemp() error: %v", err)
 	}
-
-	if !strings.Contains(f.Name(), "eval.") || !strings.HasSuffix(f.Name(), ".nix") {
-		t.Errorf("WriteEvalNix() filename pattern incorrect: %s", f.Name())
+	if first == second || filepath.Dir(first) != filepath.Dir(second) {
+		t.Errorf("MkdirTemp() = %s and %s, want different directories in one workspace", first, second)
 	}
 
-	// Read and verify content
-	content, err := os.ReadFile(f.Name())
+	file, err := m.WriteTemp("val.*.json", []byte("{}"))
 	if err != nil {
-		t.Fatalf("Failed to read file: %v", err)
+		t.Fatalf("WriteTemp() error: %v", err)
 	}
-
-	if string(content) != evalContent {
-		t.Errorf("WriteEvalNix() content mismatch.\nExpected: %s\nGot: %s", evalContent, content)
+	if content, err := os.ReadFile(file); err != nil || string(content) != "{}" {
+		t.Errorf("WriteTemp() content = %q, %v", content, err)
 	}
-
-	// Cleanup
-	if err := os.Remove(f.Name()); err != nil {
-		t.Logf("Failed to cleanup temp file: %v", err)
-	}
-}
-
-func TestWriteEvalNix_EmptyContent(t *testing.T) {
-	t.Parallel()
-	f, err := WriteEvalNix("")
-	if err != nil {
-		t.Fatalf("WriteEvalNix() error with empty content: %v", err)
+	m.Remove(file)
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("Remove() did not remove %s", file)
 	}
 
-	// Verify empty file was created
-	info, err := os.Stat(f.Name())
-	if err != nil {
-		t.Fatalf("Failed to stat file: %v", err)
+	tracked := filepath.Join(t.TempDir(), "helmfile.yaml")
+	if err := os.WriteFile(tracked, nil, 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", tracked, err)
 	}
+	m.Track(tracked)
 
-	if info.Size() != 0 {
-		t.Errorf("WriteEvalNix() with empty content should create 0-byte file, got size: %d", info.Size())
+	m.Cleanup()
+	for _, path := range []string{filepath.Dir(first), tracked} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Cleanup() did not remove %s", path)
+		}
 	}
+	// Like a deferred removal after Cleanup on a signal, which must not fail.
+	m.Remove(first)
 
-	// Cleanup
-	if err := os.Remove(f.Name()); err != nil {
-		t.Logf("Failed to cleanup temp file: %v", err)
+	m.Cleanup()
+	if _, err := m.MkdirTemp("chart-*"); !errors.Is(err, ErrCleanedUp) {
+		t.Errorf("MkdirTemp() after Cleanup() error = %v, want %v", err, ErrCleanedUp)
 	}
 }
 
-func TestWriteEvalNix_LargeContent(t *testing.T) {
+func TestManager_Concurrent(t *testing.T) {
 	t.Parallel()
-	// Create large Nix expression (10KB)
-	largeContent := strings.Repeat("# comment\n", 500)
-
-	f, err := WriteEvalNix(largeContent)
-	if err != nil {
-		t.Fatalf("WriteEvalNix() error with large content: %v", err)
-	}
-
-	// Verify size
-	info, err := os.Stat(f.Name())
-	if err != nil {
-		t.Fatalf("Failed to stat file: %v", err)
-	}
-
-	if info.Size() != int64(len(largeContent)) {
-		t.Errorf("WriteEvalNix() size mismatch. Expected: %d, got: %d", len(largeContent), info.Size())
-	}
-
-	// Cleanup
-	if err := os.Remove(f.Name()); err != nil {
-		t.Logf("Failed to cleanup temp file: %v", err)
+	managers := []*Manager{NewManager(), NewManager()}
+	for _, m := range managers {
+		t.Cleanup(m.Cleanup)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := map[string]bool{}
+	for i := range 20 {
+		wg.Go(func() {
+			dir, err := managers[i%2].MkdirTemp("chart-*")
+			if err != nil {
+				t.Errorf("MkdirTemp() error: %v", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			seen[dir] = true
+		})
+	}
+	wg.Wait()
+
+	if len(seen) != 20 {
+		t.Errorf("Expected 20 distinct directories, got %d", len(seen))
+	}
+	workspaces := map[string]bool{}
+	for dir := range seen {
+		workspaces[filepath.Dir(dir)] = true
+	}
+	if len(workspaces) != 2 {
+		t.Errorf("Expected a workspace per manager, got %v", workspaces)
 	}
 }
 
-func TestWriteEvalNix_SpecialCharacters(t *testing.T) {
+func TestWriteFileAtomic(t *testing.T) {
 	t.Parallel()
-	// Test with special characters that might cause issues
-	evalContent := `
-{
-  # Comment with "quotes" and 'apostrophes'
-  test = "value with\nnewlines\tand\ttabs";
-  unicode = "Unicode: 你好世界 🎉";
-  escaped = "path\\with\\backslashes";
-}
-`
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index.yaml")
 
-	f, err := WriteEvalNix(evalContent)
-	if err != nil {
-		t.Fatalf("WriteEvalNix() error: %v", err)
+	for _, content := range []string{"first", "second"} {
+		if err := WriteFileAtomic(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("WriteFileAtomic() error: %v", err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil || string(got) != content {
+			t.Errorf("WriteFileAtomic() content = %q, %v, want %q", got, err, content)
+		}
 	}
 
-	// Read and verify content preserved special characters
-	content, err := os.ReadFile(f.Name())
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		t.Fatalf("Failed to read file: %v", err)
+		t.Fatalf("Failed to read dir: %v", err)
 	}
-
-	if string(content) != evalContent {
-		t.Errorf("WriteEvalNix() special characters not preserved")
+	if len(entries) != 1 {
+		t.Errorf("Expected only the written file, got %v", entries)
 	}
 
-	// Cleanup
-	if err := os.Remove(f.Name()); err != nil {
-		t.Logf("Failed to cleanup temp file: %v", err)
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "index.yaml"), nil, 0o600); err == nil {
+		t.Error("WriteFileAtomic() in a missing directory should fail")
 	}
 }
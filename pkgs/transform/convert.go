@@ -5,16 +5,6 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-func UnmarshalOption(val string) (any, error) {
-	var v any
-	err := yaml.Unmarshal([]byte(val), &v)
-	if err != nil {
-		return nil, err
-	}
-
-	return v, nil
-}
-
 // JSONToYAMLs converts a JSON list to YAML documents.
 func JSONToYAMLs(j []byte, preprocess func(any)) ([]byte, error) {
 	var jsonObj []any
@@ -44,3 +34,13 @@ func JSONToYAMLs(j []byte, preprocess func(any)) ([]byte, error) {
 	}
 	return y, nil
 }
+
+// JSONToYAML converts a single JSON value to a YAML document.
+func JSONToYAML(j []byte) ([]byte, error) {
+	var jsonObj any
+	// yaml.Unmarshal keeps number types, see JSONToYAMLs.
+	if err := yaml.Unmarshal(j, &jsonObj); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(jsonObj)
+}
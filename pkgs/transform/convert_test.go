@@ -1,35 +1,10 @@
 package transform
 
 import (
-	"reflect"
 	"strings"
 	"testing"
 )
 
-func TestUnmarshalOption(t *testing.T) {
-	t.Parallel()
-	tests := []struct {
-		input    string
-		expected any
-	}{
-		{`"foo"`, "foo"},
-		{`123`, 123},
-		{`true`, true},
-		{`[1, 2, 3]`, []any{1, 2, 3}},
-		{`{"a": 1}`, map[string]any{"a": 1}},
-	}
-
-	for _, tt := range tests {
-		got, err := UnmarshalOption(tt.input)
-		if err != nil {
-			t.Errorf("UnmarshalOption(%q) error: %v", tt.input, err)
-		}
-		if !reflect.DeepEqual(got, tt.expected) {
-			t.Errorf("UnmarshalOption(%q) = %#v, want %#v", tt.input, got, tt.expected)
-		}
-	}
-}
-
 func TestJSONToYAMLs_Success(t *testing.T) {
 	t.Parallel()
 	json := []byte(`[{"key": "value"}, {"foo": "bar"}]`)
@@ -142,3 +117,18 @@ values:
 		t.Errorf("JSONToYAMLs() missing expected content: %q", yamlStr)
 	}
 }
+
+func TestJSONToYAML(t *testing.T) {
+	t.Parallel()
+	json := []byte(`{"replicas": 2, "image": {"tag": "v1"}}`)
+
+	yaml, err := JSONToYAML(json)
+	if err != nil {
+		t.Fatalf("JSONToYAML() error: %v", err)
+	}
+
+	expected := "image:\n    tag: v1\nreplicas: 2\n"
+	if string(yaml) != expected {
+		t.Errorf("JSONToYAML() = %q, want %q", string(yaml), expected)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/reMarkable/helmfile-nix/pkgs/nixeval"
+)
+
+// jsonError is the form errors are reported in with --error-format json.
+type jsonError struct {
+	Error string             `json:"error"`
+	Nix   *nixeval.EvalError `json:"nix,omitempty"`
+}
+
+// Report a failure to w, in the given format.
+// Nix evaluation errors are shown with a snippet of the source they point to.
+func reportError(w io.Writer, format, msg string, err error) {
+	var evalErr *nixeval.EvalError
+	isEval := errors.As(err, &evalErr)
+
+	if format == "json" {
+		out, jsonErr := json.Marshal(jsonError{Error: fmt.Sprintf("%s: %s", msg, err), Nix: evalErr})
+		if jsonErr == nil {
+			_, _ = fmt.Fprintf(w, "%s\n", out)
+			return
+		}
+	}
+
+	_, _ = fmt.Fprintf(w, "%s: %s\n", msg, err)
+	if isEval {
+		_ = evalErr.WriteText(w)
+	}
+}
@@ -0,0 +1,27 @@
+{ var, ... }:
+[
+  {
+    environments = {
+      dev = {
+        values = [ ];
+      };
+    };
+  }
+  {
+    releases = [
+      {
+        name = "test";
+        chart = "../chart/";
+        values = [
+          {
+            replicas = var.values.replicas;
+            database = {
+              inherit (var.values.secrets.db) user password;
+            };
+            apiToken = var.values.secrets.apiToken or "";
+          }
+        ];
+      }
+    ];
+  }
+]